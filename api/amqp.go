@@ -4,16 +4,15 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/streadway/amqp"
 
+	"context"
 	"crypto/tls"
 	"fmt"
-	"os"
 	"strings"
-	"time"
 )
 
 var topicSuffix = "pmb"
 
-func connectAMQP(URI string, id string, sub string) (*Connection, error) {
+func connectAMQP(ctx context.Context, URI string, id string, sub string, opts connectOptions) (*Connection, error) {
 
 	uriParts, err := amqp.ParseURI(URI)
 	if err != nil {
@@ -28,20 +27,25 @@ func connectAMQP(URI string, id string, sub string) (*Connection, error) {
 		prefix = uriParts.Username
 	}
 
-	in := make(chan Message, 10)
-	out := make(chan Message, 10)
+	done := make(chan error, 2)
 
-	done := make(chan error)
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
 
-	conn := &Connection{In: in, Out: out, uri: URI, prefix: prefix, Id: id}
+	conn := newConnection(ctx, URI, prefix, id, opts)
+	conn.tlsConfig = tlsConfig
 
 	logrus.Debugf("calling listen/send AMQP")
+	conn.wg.Add(2)
 	go listenToAMQP(conn, done, id)
 	go sendToAMQP(conn, done, id)
 
 	for i := 1; i <= 2; i++ {
 		err := <-done
 		if err != nil {
+			conn.cancel()
 			return nil, err
 		}
 	}
@@ -50,22 +54,34 @@ func connectAMQP(URI string, id string, sub string) (*Connection, error) {
 }
 
 func sendToAMQP(pmbConn *Connection, done chan error, id string) {
+	defer pmbConn.wg.Done()
 
 	logrus.Debugf("calling setupSend")
-	ch, err := setupSend(pmbConn.uri, pmbConn.prefix, id)
+	conn, ch, err := setupSend(pmbConn.uri, pmbConn.tlsConfig, pmbConn.prefix, id)
 
 	if err != nil {
 		done <- err
 		return
 	}
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
 
 	done <- nil
 
 	sender := pmbConn.Out
 	for {
-		message := <-sender
+		var message Message
+		select {
+		case message = <-sender:
+		case <-pmbConn.ctx.Done():
+			logrus.Debugf("closing AMQP send connection")
+			return
+		}
 
-		bodies, err := prepareMessage(message, pmbConn.Keys, id)
+		bodies, err := pmbConn.bodies(message, id)
 		if err != nil {
 			logrus.Warningf("Error preparing message: %s", err)
 			continue
@@ -75,34 +91,33 @@ func sendToAMQP(pmbConn *Connection, done chan error, id string) {
 			logrus.Debugf("Sending raw message: %s", string(body))
 			err = ch.Publish(
 				fmt.Sprintf("%s-%s", pmbConn.prefix, topicSuffix), // exchange
-				"test", // routing key
-				false,  // mandatory
-				false,  // immediate
+				destination(message),                              // routing key
+				false,                                             // mandatory
+				false,                                             // immediate
 				amqp.Publishing{
 					ContentType: "text/plain",
 					Body:        body,
 				})
 
 			if err != nil {
-				logrus.Warningf("Send connection fail reconnecting...", err)
+				logrus.Warningf("Send connection fail reconnecting... %s", err)
+				pmbConn.setState(Disconnected)
+				conn.Close()
 
-				// attempt to reconnect forever
-				ch, err = setupSendForever(pmbConn.uri, pmbConn.prefix, id)
+				// attempt to reconnect, backing off between attempts
+				conn, ch, err = setupSendWithRetry(pmbConn, id)
 
 				if err != nil {
 					logrus.Errorf("Unable to reconnect, exiting... %s", err)
 					return
 				} else {
-					pmbConn.In <- Message{
-						Contents: map[string]interface{}{"type": "Reconnected"},
-						Internal: true,
-					}
+					pmbConn.deliver(reconnectedMessage())
 					logrus.Infof("Reconnected.")
 					err = ch.Publish(
 						fmt.Sprintf("%s-%s", pmbConn.prefix, topicSuffix), // exchange
-						"test", // routing key
-						false,  // mandatory
-						false,  // immediate
+						destination(message),                              // routing key
+						false,                                             // mandatory
+						false,                                             // immediate
 						amqp.Publishing{
 							ContentType: "text/plain",
 							Body:        body,
@@ -111,25 +126,16 @@ func sendToAMQP(pmbConn *Connection, done chan error, id string) {
 			}
 		}
 
-		if message.Done != nil {
-			logrus.Debugf("Done channel present, sending message")
-			message.Done <- nil
-		}
+		pmbConn.sent(message, nil)
 	}
 }
 
-func connectToAMQP(uri string) (*amqp.Connection, error) {
+func connectToAMQP(uri string, cfg *tls.Config) (*amqp.Connection, error) {
 
 	var conn *amqp.Connection
 	var err error
 
 	if strings.Contains(uri, "amqps") {
-		cfg := new(tls.Config)
-
-		if len(os.Getenv("PMB_SSL_INSECURE_SKIP_VERIFY")) > 0 {
-			cfg.InsecureSkipVerify = true
-		}
-
 		logrus.Debugf("calling DialTLS")
 		conn, err = amqp.DialTLS(uri, cfg)
 		logrus.Debugf("Connection obtained")
@@ -146,33 +152,46 @@ func connectToAMQP(uri string) (*amqp.Connection, error) {
 }
 
 func listenToAMQP(pmbConn *Connection, done chan error, id string) {
+	defer pmbConn.wg.Done()
 
 	logrus.Debugf("calling setupListen")
-	msgs, err := setupListen(pmbConn.uri, pmbConn.prefix, id)
+	conn, msgs, err := setupListen(pmbConn.uri, pmbConn.tlsConfig, pmbConn.prefix, id, pmbConn.bindings())
 
 	if err != nil {
 		done <- err
 		return
 	}
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
 
 	done <- nil
 
 	for {
-		delivery, ok := <-msgs
+		var delivery amqp.Delivery
+		var ok bool
+		select {
+		case delivery, ok = <-msgs:
+		case <-pmbConn.ctx.Done():
+			logrus.Debugf("closing AMQP listen connection")
+			return
+		}
+
 		if !ok {
 			logrus.Warningf("Listen connection fail, reconnecting...")
+			pmbConn.setState(Disconnected)
+			conn.Close()
 
-			// attempt to reconnect forever
-			msgs, err = setupListenForever(pmbConn.uri, pmbConn.prefix, id)
+			// attempt to reconnect, backing off between attempts
+			conn, msgs, err = setupListenWithRetry(pmbConn, id)
 
 			if err != nil {
 				logrus.Errorf("Unable to reconnect, exiting... %s", err)
 				return
 			} else {
-				pmbConn.In <- Message{
-					Contents: map[string]interface{}{"type": "Reconnected"},
-					Internal: true,
-				}
+				pmbConn.deliver(reconnectedMessage())
 				logrus.Infof("Reconnected.")
 				continue
 			}
@@ -180,66 +199,77 @@ func listenToAMQP(pmbConn *Connection, done chan error, id string) {
 		}
 		logrus.Debugf("Raw message received: %s", string(delivery.Body))
 
-		parseMessage(delivery.Body, pmbConn.Keys, pmbConn.In, id)
+		pmbConn.receive(delivery.RoutingKey, delivery.Body)
 	}
 }
 
-func setupSendForever(uri string, prefix string, id string) (*amqp.Channel, error) {
-
-	for {
-		ch, err := setupSend(uri, prefix, id)
+func setupSendWithRetry(pmbConn *Connection, id string) (*amqp.Connection, *amqp.Channel, error) {
+	var conn *amqp.Connection
+	var ch *amqp.Channel
 
-		if err == nil {
-			return ch, nil
-		}
+	err := pmbConn.retry("Send setup", func() error {
+		var err error
+		conn, ch, err = setupSend(pmbConn.uri, pmbConn.tlsConfig, pmbConn.prefix, id)
+		return err
+	})
 
-		logrus.Warningf("Send setup failed, sleeping and then re-trying")
-		time.Sleep(1 * time.Second)
-	}
+	return conn, ch, err
 }
 
-func setupSend(uri string, prefix string, id string) (*amqp.Channel, error) {
+func setupSend(uri string, tlsConfig *tls.Config, prefix string, id string) (*amqp.Connection, *amqp.Channel, error) {
 	logrus.Debugf("calling connectToAMQP")
-	conn, err := connectToAMQP(uri)
+	conn, err := connectToAMQP(uri, tlsConfig)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	ch, err := conn.Channel()
 	if err != nil {
-		return nil, err
+		conn.Close()
+		return nil, nil, err
 	}
 
 	err = ch.ExchangeDeclare(fmt.Sprintf("%s-%s", prefix, topicSuffix), "topic", true, false, false, false, nil)
 	if err != nil {
-		return nil, err
+		conn.Close()
+		return nil, nil, err
 	}
 
-	return ch, nil
+	return conn, ch, nil
 }
 
-func setupListenForever(uri string, prefix string, id string) (<-chan amqp.Delivery, error) {
-
-	for {
-		msgs, err := setupListen(uri, prefix, id)
+func setupListenWithRetry(pmbConn *Connection, id string) (*amqp.Connection, <-chan amqp.Delivery, error) {
+	var conn *amqp.Connection
+	var msgs <-chan amqp.Delivery
 
-		if err == nil {
-			return msgs, nil
-		}
+	err := pmbConn.retry("Listen setup", func() error {
+		var err error
+		conn, msgs, err = setupListen(pmbConn.uri, pmbConn.tlsConfig, pmbConn.prefix, id, pmbConn.bindings())
+		return err
+	})
 
-		logrus.Warningf("Listen setup failed, sleeping and then re-trying")
-		time.Sleep(1 * time.Second)
-	}
+	return conn, msgs, err
 }
 
-func setupListen(uri string, prefix string, id string) (<-chan amqp.Delivery, error) {
+func setupListen(uri string, tlsConfig *tls.Config, prefix string, id string, bindings []string) (*amqp.Connection, <-chan amqp.Delivery, error) {
 
 	logrus.Debugf("calling connectToAMQP")
-	conn, err := connectToAMQP(uri)
+	conn, err := connectToAMQP(uri, tlsConfig)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	msgs, err := consumeAMQP(conn, prefix, id, bindings)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
 	}
 
+	return conn, msgs, nil
+}
+
+func consumeAMQP(conn *amqp.Connection, prefix string, id string, bindings []string) (<-chan amqp.Delivery, error) {
+
 	ch, err := conn.Channel()
 	if err != nil {
 		return nil, err
@@ -265,12 +295,14 @@ func setupListen(uri string, prefix string, id string) (<-chan amqp.Delivery, er
 		return nil, err
 	}
 
-	err = ch.QueueBind(q.Name, "#", fmt.Sprintf("%s-%s", prefix, topicSuffix), false, nil)
-	if err != nil {
-		return nil, err
+	// only receive messages for this client, broadcasts, and whatever else
+	// it subscribed to
+	for _, binding := range bindings {
+		err = ch.QueueBind(q.Name, binding, fmt.Sprintf("%s-%s", prefix, topicSuffix), false, nil)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	msgs, err := ch.Consume(q.Name, "", true, false, false, false, nil)
-
-	return msgs, nil
+	return ch.Consume(q.Name, "", true, false, false, false, nil)
 }
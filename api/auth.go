@@ -0,0 +1,42 @@
+package pmb
+
+import (
+	"net/http"
+	neturl "net/url"
+)
+
+// brokerToken splits the access token for the broker out of a websocket or
+// HTTP broker URI.  The token is the password of the URI's userinfo, or
+// the username if there is no password, so both ws://token@host/pmb/realm/
+// and ws://user:token@host/pmb/realm/ work.  The URI is returned without
+// the userinfo, as it must not be sent as part of the URI.
+func brokerToken(uri string) (string, string, error) {
+	u, err := neturl.Parse(uri)
+	if err != nil {
+		return "", "", err
+	}
+
+	if u.User == nil {
+		return uri, "", nil
+	}
+
+	token, ok := u.User.Password()
+	if !ok {
+		token = u.User.Username()
+	}
+	u.User = nil
+
+	return u.String(), token, nil
+}
+
+// authorize adds the connection's broker token to a request.
+func (conn *Connection) authorize(header http.Header) http.Header {
+	if header == nil {
+		header = make(http.Header)
+	}
+	if len(conn.token) > 0 {
+		header.Set("Authorization", "Bearer "+conn.token)
+	}
+
+	return header
+}
@@ -127,25 +127,35 @@ func fileExists(path string) bool {
 	return true
 }
 
-func NewDefaultConfigClient() (*RealConfigClient, error) {
+// ConfigDir returns the directory that holds the user's config, and other
+// local state such as the offline queue.
+func ConfigDir() (string, error) {
 	var baseDir string
 	if xdgConfigHome := os.Getenv("XDG_CONFIG_HOME"); len(xdgConfigHome) > 0 {
 		baseDir = filepath.Join(xdgConfigHome, "pmb")
 	} else {
 		var home string
 		if home = os.Getenv("HOME"); len(home) == 0 {
-			return nil, fmt.Errorf("$HOME environment variable not found")
+			return "", fmt.Errorf("$HOME environment variable not found")
 		}
 		baseDir = filepath.Join(home, ".config", "pmb")
 		os.MkdirAll(baseDir, 0755)
 	}
 
+	return baseDir, nil
+}
+
+func NewDefaultConfigClient() (*RealConfigClient, error) {
+	baseDir, err := ConfigDir()
+	if err != nil {
+		return nil, err
+	}
+
 	systemHome := "/etc"
 	if pmbSystemEnv := os.Getenv("PMB_SYSTEM_CONFIG"); len(pmbSystemEnv) > 0 {
 		systemHome = pmbSystemEnv
 	}
 
-	var err error
 	systemConfigPath := filepath.Join(systemHome, "pmbconfig")
 	if fileExists(systemConfigPath) {
 		systemConfigPath, err = filepath.EvalSymlinks(systemConfigPath)
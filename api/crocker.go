@@ -16,13 +16,13 @@ func GetCredHelperKey() (string, error) {
 		return "", err
 	}
 
-	logrus.Debugf("found cred helper instance", cr)
+	logrus.Debugf("found cred helper instance: %v", cr)
 	creds, err := cr.Get(url)
 	if err != nil {
 		return "", err
 	}
 
-	logrus.Debugf("found cred helper creds", creds)
+	logrus.Debugf("found cred helper creds: %v", creds)
 	return creds.Secret, nil
 }
 
@@ -35,14 +35,14 @@ func StoreCredHelperKey(keys string) error {
 		return err
 	}
 
-	logrus.Debugf("found cred helper instance", cr)
+	logrus.Debugf("found cred helper instance: %v", cr)
 	creds := &credentials.Credentials{url, "key", keys}
 	err = cr.Store(creds)
 	if err != nil {
 		return err
 	}
 
-	logrus.Debugf("stored cred helper creds", creds)
+	logrus.Debugf("stored cred helper creds: %v", creds)
 	return nil
 }
 
@@ -55,7 +55,7 @@ func ClearCredHelperKey() error {
 		return err
 	}
 
-	logrus.Debugf("found cred helper instance", cr)
+	logrus.Debugf("found cred helper instance: %v", cr)
 	err = cr.Erase(url)
 	if err != nil {
 		return err
@@ -0,0 +1,83 @@
+package pmb
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ElectionTimeout is how long an inactive introducer waits without hearing
+// from other introducers before it checks whether it should take over.
+const ElectionTimeout = 30 * time.Second
+
+// An Election decides which of the introducers on a bus acts on messages.
+// Introducers announce their level, and any introducer that hears of one
+// with a higher level steps down, leaving the highest active.
+type Election struct {
+	conn   *Connection
+	level  float64
+	active bool
+}
+
+func NewElection(conn *Connection, level float64) *Election {
+	return &Election{conn: conn, level: level, active: true}
+}
+
+// Start announces the introducer and asks the others to do the same.
+func (e *Election) Start() {
+	e.present()
+	e.rollCall()
+}
+
+// Active reports whether the introducer should act on messages.
+func (e *Election) Active() bool {
+	return e.active
+}
+
+// Handle acts on the election messages, returning false for any other
+// message.
+func (e *Election) Handle(message Message) bool {
+	switch message.Type() {
+	case "IntroducerPresent":
+		logrus.Debugf("IntroducerPresent message received")
+		body, err := Decode(message)
+		if err != nil {
+			logrus.Warningf("Skipping message: %s", err)
+			return true
+		}
+		if level := body.(*IntroducerPresent).Level; level > e.level {
+			logrus.Infof("deactivating, saw an introducer with level %0.2f, which is higher than my %0.2f", level, e.level)
+			e.active = false
+		}
+	case "IntroducerRollCall":
+		logrus.Debugf("IntroducerRollCall message received")
+		e.present()
+	case "Reconnected":
+		e.active = true
+		logrus.Infof("checking if I should become active... (after reconnect)")
+		e.Start()
+	default:
+		return false
+	}
+
+	return true
+}
+
+// Timeout is called when nothing has been heard from other introducers for
+// ElectionTimeout, and becomes active again if this introducer had stepped
+// down, unless another introducer answers the roll call.
+func (e *Election) Timeout() {
+	if !e.active {
+		logrus.Infof("checking if I should become active...")
+		e.active = true
+		e.rollCall()
+	}
+}
+
+func (e *Election) present() {
+	e.conn.Out <- Encode(&IntroducerPresent{Level: e.level})
+}
+
+func (e *Election) rollCall() {
+	e.conn.Out <- Encode(&IntroducerRollCall{})
+}
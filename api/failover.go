@@ -0,0 +1,69 @@
+package pmb
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// when failing over, ask the new broker for messages from a little before
+// the last one received, to allow for the brokers' clocks not agreeing.
+// The copies this causes are dropped as already seen.
+const failoverOverlap = 30 * time.Second
+
+// brokerEndpoint is one of the brokers a websocket connection can use.
+type brokerEndpoint struct {
+	uri   string
+	token string
+}
+
+// parseBrokers splits a comma separated list of websocket broker URIs, for
+// brokers that are peers of each other.
+func parseBrokers(URI string) ([]brokerEndpoint, error) {
+	var brokers []brokerEndpoint
+	for _, uri := range strings.Split(URI, ",") {
+		uri = strings.TrimSpace(uri)
+		if len(uri) == 0 {
+			continue
+		}
+
+		uri, token, err := brokerToken(uri)
+		if err != nil {
+			return nil, err
+		}
+		brokers = append(brokers, brokerEndpoint{uri: uri, token: token})
+	}
+
+	return brokers, nil
+}
+
+// useBroker switches the connection to one of its brokers.
+func (conn *Connection) useBroker(i int) {
+	conn.current = i % len(conn.brokers)
+	conn.uri = conn.brokers[conn.current].uri
+	conn.token = conn.brokers[conn.current].token
+}
+
+// failover moves the connection on to its next broker, if it has more
+// than one.  Sequence numbers are only meaningful to the broker that gave
+// them out, so the new broker is asked for what was missed by time.
+func (conn *Connection) failover() {
+	if len(conn.brokers) < 2 {
+		return
+	}
+
+	conn.useBroker(conn.current + 1)
+	atomic.StoreUint64(&conn.lastSeq, 0)
+	if at := atomic.LoadInt64(&conn.lastAt); at > 0 {
+		conn.opts.replaySince = time.Unix(0, at).Add(-failoverOverlap)
+	}
+
+	logrus.Infof("Failing over to broker %s", conn.uri)
+}
+
+// heard records that the broker was last heard from now.
+func (conn *Connection) heard() {
+	atomic.StoreInt64(&conn.lastAt, time.Now().UnixNano())
+}
@@ -0,0 +1,83 @@
+package pmb
+
+import (
+	"errors"
+	"sync"
+)
+
+// A Handler acts on one type of message received by an introducer.
+type Handler interface {
+	Handle(conn *Connection, message Message) error
+}
+
+// HandlerFunc lets an ordinary function be used as a Handler.
+type HandlerFunc func(conn *Connection, message Message) error
+
+func (f HandlerFunc) Handle(conn *Connection, message Message) error {
+	return f(conn, message)
+}
+
+// ErrNoHandler is returned by Dispatch for a message type that has no
+// handler.
+var ErrNoHandler = errors.New("no handler for message type")
+
+// Handlers is a registry of handlers keyed by message type.  Types don't
+// have to be known to Decode, so handlers can be added for message types
+// that only some clients know about.
+type Handlers struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+	fallback Handler
+}
+
+func NewHandlers() *Handlers {
+	return &Handlers{handlers: make(map[string]Handler)}
+}
+
+// Register sets the handler for a message type, replacing any handler it
+// already had.
+func (h *Handlers) Register(messageType string, handler Handler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.handlers[messageType] = handler
+}
+
+func (h *Handlers) RegisterFunc(messageType string, handler func(conn *Connection, message Message) error) {
+	h.Register(messageType, HandlerFunc(handler))
+}
+
+// Fallback sets the handler for message types without a handler of their
+// own.
+func (h *Handlers) Fallback(handler Handler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.fallback = handler
+}
+
+// Handles reports whether there's a handler for the message type, other
+// than the fallback.
+func (h *Handlers) Handles(messageType string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	_, ok := h.handlers[messageType]
+	return ok
+}
+
+// Dispatch passes a message to the handler for its type.
+func (h *Handlers) Dispatch(conn *Connection, message Message) error {
+	h.mu.RLock()
+	handler, ok := h.handlers[message.Type()]
+	if !ok {
+		handler = h.fallback
+	}
+	h.mu.RUnlock()
+
+	if handler == nil {
+		return ErrNoHandler
+	}
+
+	return handler.Handle(conn, message)
+}
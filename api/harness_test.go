@@ -0,0 +1,37 @@
+package pmb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/justone/pmb/api"
+)
+
+// receive returns the next message of the given type that conn receives,
+// or false if none arrives within timeout.
+func receive(conn *pmb.Connection, messageType string, timeout time.Duration) (pmb.Message, bool) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case message := <-conn.In:
+			if message.Type() == messageType {
+				return message, true
+			}
+		case <-deadline:
+			return pmb.Message{}, false
+		}
+	}
+}
+
+// send sends message on conn, and waits for it to be sent.
+func send(t *testing.T, conn *pmb.Connection, message pmb.Message) {
+	t.Helper()
+
+	message.Done = make(chan error, 1)
+	conn.Out <- message
+	select {
+	case <-message.Done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message wasn't sent")
+	}
+}
@@ -2,19 +2,32 @@ package pmb
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
-	"time"
+	"strconv"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 )
 
-func connectHTTP(URI string, id string, sub string) (*Connection, error) {
-	in := make(chan Message, 10)
-	out := make(chan Message, 10)
+// DestinationHeader carries the destination of messages published to the
+// broker over HTTP, and of the messages returned by polls.
+const DestinationHeader = "X-PMB-Destination"
 
-	done := make(chan error)
+func connectHTTP(ctx context.Context, URI string, id string, sub string, opts connectOptions) (*Connection, error) {
+	done := make(chan error, 2)
+
+	URI, token, err := brokerToken(URI)
+	if err != nil {
+		return nil, err
+	}
+
+	// the broker serves realms without the trailing slash that websocket
+	// URIs use, so accept either form
+	URI = strings.TrimRight(URI, "/")
 
 	var finalURI string
 	if len(sub) > 0 {
@@ -23,77 +36,192 @@ func connectHTTP(URI string, id string, sub string) (*Connection, error) {
 		finalURI = URI
 	}
 
-	conn := &Connection{In: in, Out: out, uri: finalURI, prefix: "", Id: id}
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := newConnection(ctx, finalURI, "", id, opts)
+	conn.token = token
+	conn.httpClient = httpClient(tlsConfig)
 
 	logrus.Debugf("calling listen/send HTTP")
+	conn.wg.Add(2)
 	go listenToHTTP(conn, done, id)
 	go sendToHTTP(conn, done, id)
 
 	for i := 1; i <= 2; i++ {
 		err := <-done
 		if err != nil {
+			conn.cancel()
 			return nil, err
 		}
 	}
 
 	return conn, nil
-	return nil, nil
 }
 
 func listenToHTTP(pmbConn *Connection, done chan error, id string) {
+	defer pmbConn.wg.Done()
+
 	listenURI := fmt.Sprintf("%s/%s", pmbConn.uri, id)
 	logrus.Debugf("Listening on URI %s.", listenURI)
+
+	// the first poll registers this id with the broker, so that replies to
+	// anything sent right after connecting are queued for us
+	dest, body, status, err := pollHTTP(pmbConn, listenURI)
+	if err != nil {
+		done <- err
+		return
+	}
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		done <- fmt.Errorf("Broker refused access: %d %s", status, http.StatusText(status))
+		return
+	} else if checkPoll(status) != nil {
+		done <- fmt.Errorf("Unable to register with broker: %d", status)
+		return
+	}
 	done <- nil
+
 	for {
-		res, err := http.Get(listenURI)
-		if err != nil {
-			logrus.Warningf("Error receiving: %s", err)
-			time.Sleep(1 * time.Second)
-			continue
+		if status == http.StatusOK {
+			pmbConn.receive(dest, body)
 		}
 
-		body, err := ioutil.ReadAll(res.Body)
-		res.Body.Close()
-		if err != nil {
-			logrus.Warningf("Error reading body: %s", err)
-			time.Sleep(1 * time.Second)
+		dest, body, status, err = pollHTTP(pmbConn, listenURI)
+		if pmbConn.ctx.Err() != nil {
+			logrus.Debugf("closing HTTP listener")
+			return
+		} else if err == nil {
+			err = checkPoll(status)
+		}
+		if err == nil {
 			continue
 		}
 
-		if res.StatusCode == 200 {
-			parseMessage(body, pmbConn.Keys, pmbConn.In, id)
-		} else if res.StatusCode == 408 {
-			continue
-		} else {
-			logrus.Warningf("Bad request: %s", res.Status)
-			time.Sleep(1 * time.Second)
+		logrus.Warningf("Error receiving: %s", err)
+		pmbConn.setState(Disconnected)
+
+		err = pmbConn.retry("Poll", func() error {
+			var err error
+			dest, body, status, err = pollHTTP(pmbConn, listenURI)
+			if err != nil {
+				return err
+			}
+			return checkPoll(status)
+		})
+		if err != nil {
+			if err != ErrClosed {
+				logrus.Errorf("Unable to reconnect, exiting... %s", err)
+			}
+			return
 		}
+
+		pmbConn.deliver(reconnectedMessage())
+		logrus.Infof("Reconnected.")
 	}
 }
 
+// checkPoll returns an error for any status other than a message, no
+// message yet, or the poll timing out.
+func checkPoll(status int) error {
+	if status != http.StatusOK && status != http.StatusNoContent && status != http.StatusRequestTimeout {
+		return fmt.Errorf("Bad poll response from broker: %d", status)
+	}
+
+	return nil
+}
+
+// pollHTTP returns the destination and body of the next message, along with
+// the status of the poll.
+func pollHTTP(pmbConn *Connection, listenURI string) (string, []byte, int, error) {
+	// the broker only queues messages for the destinations we bind, and
+	// replays what we missed when it registers us
+	uri, err := pmbConn.brokerURI(listenURI)
+	if err != nil {
+		return "", nil, 0, err
+	}
+
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	req.Header = pmbConn.authorize(req.Header)
+
+	res, err := pmbConn.httpClient.Do(req.WithContext(pmbConn.ctx))
+	if err != nil {
+		return "", nil, 0, err
+	}
+	defer res.Body.Close()
+
+	if seq, err := strconv.ParseUint(res.Header.Get(SequenceHeader), 10, 64); err == nil {
+		pmbConn.received(seq)
+	}
+
+	dest := res.Header.Get(DestinationHeader)
+	if len(dest) == 0 {
+		dest = Broadcast
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", nil, 0, err
+	}
+
+	return dest, body, res.StatusCode, nil
+}
+
 func sendToHTTP(pmbConn *Connection, done chan error, id string) {
+	defer pmbConn.wg.Done()
+
 	logrus.Debugf("Sending to URI %s.", pmbConn.uri)
 	done <- nil
 	for {
-		message := <-pmbConn.Out
+		var message Message
+		select {
+		case message = <-pmbConn.Out:
+		case <-pmbConn.ctx.Done():
+			logrus.Debugf("closing HTTP sender")
+			return
+		}
 
-		bodies, err := prepareMessage(message, pmbConn.Keys, id)
+		bodies, err := pmbConn.bodies(message, id)
 		if err != nil {
 			logrus.Warningf("Error preparing message: %s", err)
 			continue
 		}
 
+		var failed error
 		for _, body := range bodies {
 			logrus.Debugf("Sending raw message: %s", string(body))
-			_, err := http.Post(pmbConn.uri, "application/json", bytes.NewReader(body))
+			req, err := http.NewRequest("POST", pmbConn.uri, bytes.NewReader(body))
 			if err != nil {
 				logrus.Warningf("Error sending: %s", err)
+				failed = err
+				continue
 			}
-		}
+			req.Header = pmbConn.authorize(req.Header)
+			req.Header.Set("Content-Type", "text/plain")
+			req.Header.Set(DestinationHeader, destination(message))
 
-		if message.Done != nil {
-			logrus.Debugf("Done channel present, sending message")
-			message.Done <- nil
+			res, err := pmbConn.httpClient.Do(req.WithContext(pmbConn.ctx))
+			if err != nil {
+				logrus.Warningf("Error sending: %s", err)
+				failed = err
+				continue
+			}
+			reason, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+			res.Body.Close()
+
+			if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusRequestEntityTooLarge {
+				pmbConn.throttled(retryAfter(res.Header), strings.TrimSpace(string(reason)))
+				failed = fmt.Errorf("Broker refused message: %s", res.Status)
+			} else if res.StatusCode != http.StatusNoContent {
+				logrus.Warningf("Error sending: %s", res.Status)
+				failed = fmt.Errorf("Broker refused message: %s", res.Status)
+			}
 		}
+
+		pmbConn.sent(message, failed)
 	}
 }
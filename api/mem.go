@@ -0,0 +1,121 @@
+package pmb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// memHub routes messages between the connections to one mem:// URI, which
+// all live in the same process.  Messages still go through prepareMessage
+// and parseMessage, so they are encrypted and checked just as they would
+// be on a real broker.
+type memHub struct {
+	sync.Mutex
+	conns map[*Connection]bool
+}
+
+var (
+	memHubsLock sync.Mutex
+	memHubs     = make(map[string]*memHub)
+)
+
+func getMemHub(URI string) *memHub {
+	memHubsLock.Lock()
+	defer memHubsLock.Unlock()
+
+	hub, ok := memHubs[URI]
+	if !ok {
+		hub = &memHub{conns: make(map[*Connection]bool)}
+		memHubs[URI] = hub
+	}
+
+	return hub
+}
+
+func (hub *memHub) add(conn *Connection) error {
+	hub.Lock()
+	defer hub.Unlock()
+
+	for other := range hub.conns {
+		if other.Id == conn.Id {
+			return fmt.Errorf("Another connection with the same id (%s) already exists.", conn.Id)
+		}
+	}
+	hub.conns[conn] = true
+
+	return nil
+}
+
+func (hub *memHub) remove(conn *Connection) {
+	hub.Lock()
+	defer hub.Unlock()
+
+	delete(hub.conns, conn)
+}
+
+func (hub *memHub) publish(destination string, body []byte) {
+	hub.Lock()
+	var targets []*Connection
+	for conn := range hub.conns {
+		if Wants(conn.bindings(), destination) {
+			targets = append(targets, conn)
+		}
+	}
+	hub.Unlock()
+
+	for _, conn := range targets {
+		conn.receive(destination, body)
+	}
+}
+
+func connectMem(ctx context.Context, URI string, id string, sub string, opts connectOptions) (*Connection, error) {
+	URI = strings.TrimRight(URI, "/")
+	if len(sub) > 0 {
+		URI = fmt.Sprintf("%s-%s", URI, sub)
+	}
+
+	conn := newConnection(ctx, URI, "", id, opts)
+
+	hub := getMemHub(URI)
+	if err := hub.add(conn); err != nil {
+		conn.cancel()
+		return nil, err
+	}
+
+	conn.wg.Add(1)
+	go sendToMem(conn, hub, id)
+
+	return conn, nil
+}
+
+func sendToMem(pmbConn *Connection, hub *memHub, id string) {
+	defer pmbConn.wg.Done()
+	defer hub.remove(pmbConn)
+
+	for {
+		var message Message
+		select {
+		case message = <-pmbConn.Out:
+		case <-pmbConn.ctx.Done():
+			logrus.Debugf("closing mem connection")
+			return
+		}
+
+		bodies, err := pmbConn.bodies(message, id)
+		if err != nil {
+			logrus.Warningf("Error preparing message: %s", err)
+			continue
+		}
+
+		for _, body := range bodies {
+			logrus.Debugf("Sending raw message: %s", string(body))
+			hub.publish(destination(message), body)
+		}
+
+		pmbConn.sent(message, nil)
+	}
+}
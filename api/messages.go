@@ -0,0 +1,581 @@
+package pmb
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// SchemaVersion is the version of the message schema sent by this package.
+// It only changes when an existing message changes incompatibly.
+const SchemaVersion = 1
+
+// A Body is the typed contents of one type of message.
+type Body interface {
+	// MessageType returns the value of the "type" field.
+	MessageType() string
+
+	// Validate returns an error if the message is missing anything that
+	// receivers depend on.
+	Validate() error
+}
+
+// Header holds the fields common to all messages.  Apart from Type, Schema,
+// RequestID and TTL, these are filled in by the sending connection.
+type Header struct {
+	Type      string  `json:"type"`
+	Schema    int     `json:"schema,omitempty"`
+	ID        string  `json:"id,omitempty"`
+	Hostname  string  `json:"hostname,omitempty"`
+	IP        string  `json:"ip,omitempty"`
+	Sent      string  `json:"sent,omitempty"`
+	MessageID string  `json:"message-id,omitempty"`
+	RequestID string  `json:"request-id,omitempty"`
+	TTL       float64 `json:"ttl,omitempty"`
+}
+
+// The selections that can be copied to and pasted from.  Primary is the X11
+// selection, and is the same as the clipboard where there's no such thing.
+const (
+	SelectionClipboard = "clipboard"
+	SelectionPrimary   = "primary"
+)
+
+type CopyData struct {
+	Header
+	Data      string `json:"data"`
+	Selection string `json:"selection,omitempty"`
+}
+
+type DataCopied struct {
+	Header
+	Origin string `json:"origin"`
+}
+
+// CopyFailed is sent in place of DataCopied when the introducer couldn't
+// copy the data.
+type CopyFailed struct {
+	Header
+	Origin string `json:"origin"`
+	Reason string `json:"reason"`
+}
+
+type OpenURL struct {
+	Header
+	Data   string `json:"data"`
+	IsHTML bool   `json:"is_html"`
+}
+
+type URLOpened struct {
+	Header
+	Origin string `json:"origin"`
+}
+
+type Notification struct {
+	Header
+	NotificationID string  `json:"notification-id"`
+	Message        string  `json:"message"`
+	URL            string  `json:"url"`
+	Level          float64 `json:"level"`
+}
+
+type NotificationDisplayed struct {
+	Header
+	Origin         string  `json:"origin"`
+	NotificationID string  `json:"notification-id"`
+	Message        string  `json:"message"`
+	Level          float64 `json:"level"`
+	ScreenSaverOn  bool    `json:"screenSaverOn"`
+}
+
+type Trigger struct {
+	Header
+	Trigger string `json:"trigger"`
+	From    string `json:"from"`
+	Success bool   `json:"success"`
+}
+
+type Stream struct {
+	Header
+	Identifier string `json:"identifier"`
+	Data       string `json:"data"`
+}
+
+type TestAuth struct {
+	Header
+}
+
+type AuthValid struct {
+	Header
+	Origin string `json:"origin"`
+}
+
+type RequestAuth struct {
+	Header
+}
+
+type IntroducerPresent struct {
+	Header
+	Level float64 `json:"level"`
+}
+
+type IntroducerRollCall struct {
+	Header
+}
+
+type RequestClipboard struct {
+	Header
+	Selection string `json:"selection,omitempty"`
+}
+
+type ClipboardData struct {
+	Header
+	Origin string `json:"origin"`
+	Data   string `json:"data"`
+}
+
+// ClipboardDenied is sent in place of ClipboardData when the introducer
+// won't hand over the clipboard, either by policy or because the user
+// refused.
+type ClipboardDenied struct {
+	Header
+	Origin string `json:"origin"`
+	Reason string `json:"reason"`
+}
+
+// FileOffer starts a file transfer.  The file is sent in Chunks chunks of
+// ChunkSize bytes, the last of which may be short, and Checksum is the hex
+// SHA-256 of the whole file.  TransferID is derived from the file, so that
+// offering the same file again resumes the transfer.
+type FileOffer struct {
+	Header
+	TransferID string `json:"transfer-id"`
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	ChunkSize  int    `json:"chunk-size"`
+	Chunks     int    `json:"chunks"`
+	Checksum   string `json:"checksum"`
+}
+
+// Limits on file transfers, which receivers enforce on offers so that a
+// bad offer can't make them allocate more than they can hold.
+const (
+	// chunks are base64 encoded, then encrypted and encoded again, so
+	// this keeps them under the broker's message size limit
+	MaxFileChunkSize = 128 * 1024
+
+	MaxFileChunks = 1 << 20
+	MaxFileSize   = 64 << 30
+)
+
+// FileAccepted is the reply to a FileOffer when the receiver wants the
+// file.  Received is how many chunks it already has from an earlier
+// attempt.
+type FileAccepted struct {
+	Header
+	Origin     string `json:"origin"`
+	TransferID string `json:"transfer-id"`
+	Received   int    `json:"received"`
+}
+
+// FileRejected is the reply to a FileOffer when the receiver doesn't want
+// the file, and is also sent by either side to abandon a transfer.
+type FileRejected struct {
+	Header
+	Origin     string `json:"origin"`
+	TransferID string `json:"transfer-id"`
+	Reason     string `json:"reason"`
+}
+
+// FileChunkRequest asks the sender for chunks, by index.
+type FileChunkRequest struct {
+	Header
+	TransferID string `json:"transfer-id"`
+	Chunks     []int  `json:"chunks"`
+}
+
+// FileChunk is one chunk of a file, base64 encoded, with the hex SHA-256
+// of the chunk.
+type FileChunk struct {
+	Header
+	TransferID string `json:"transfer-id"`
+	Index      int    `json:"index"`
+	Data       string `json:"data"`
+	Checksum   string `json:"checksum"`
+}
+
+// FileReceived tells the sender that the whole file arrived and matched its
+// checksum.
+type FileReceived struct {
+	Header
+	TransferID string `json:"transfer-id"`
+	Name       string `json:"name"`
+}
+
+// NotificationEntry is a notification as recorded in an introducer's
+// history, along with how it was displayed.
+type NotificationEntry struct {
+	NotificationID string  `json:"notification-id"`
+	Message        string  `json:"message"`
+	URL            string  `json:"url,omitempty"`
+	Level          float64 `json:"level"`
+	Hostname       string  `json:"hostname"`
+	IP             string  `json:"ip"`
+	Sent           string  `json:"sent"`
+	Received       string  `json:"received"`
+	Sticky         bool    `json:"sticky"`
+	ScreenSaverOn  bool    `json:"screenSaverOn"`
+}
+
+// RequestNotifications asks the introducer for the most recent Count
+// notifications in its history, of at least Level and containing Search.
+type RequestNotifications struct {
+	Header
+	Search string  `json:"search,omitempty"`
+	Level  float64 `json:"level,omitempty"`
+	Count  int     `json:"count"`
+}
+
+// NotificationHistory is the reply to RequestNotifications.  Truncated is
+// set if older entries were left out to keep the reply small enough to
+// send.
+type NotificationHistory struct {
+	Header
+	Origin    string              `json:"origin"`
+	Entries   []NotificationEntry `json:"entries"`
+	Truncated bool                `json:"truncated,omitempty"`
+}
+
+// NotificationRecorded is sent by an introducer to the notifications topic
+// each time it adds a notification to its history.
+type NotificationRecorded struct {
+	Header
+	Entry NotificationEntry `json:"entry"`
+}
+
+// Reconnected is generated by a connection, rather than being sent by
+// another client, after the transport has reconnected.
+type Reconnected struct {
+	Header
+}
+
+// Throttled is generated by a connection when the broker refuses a message
+// for going over a rate limit or quota.  The message is not retried.
+type Throttled struct {
+	Header
+	Reason string `json:"reason"`
+
+	// seconds until the broker will accept messages again
+	RetryAfter float64 `json:"retry-after"`
+}
+
+func (m *CopyData) MessageType() string              { return "CopyData" }
+func (m *DataCopied) MessageType() string            { return "DataCopied" }
+func (m *CopyFailed) MessageType() string            { return "CopyFailed" }
+func (m *OpenURL) MessageType() string               { return "OpenURL" }
+func (m *URLOpened) MessageType() string             { return "URLOpened" }
+func (m *Notification) MessageType() string          { return "Notification" }
+func (m *NotificationDisplayed) MessageType() string { return "NotificationDisplayed" }
+func (m *Trigger) MessageType() string               { return "Trigger" }
+func (m *Stream) MessageType() string                { return "Stream" }
+func (m *TestAuth) MessageType() string              { return "TestAuth" }
+func (m *AuthValid) MessageType() string             { return "AuthValid" }
+func (m *RequestAuth) MessageType() string           { return "RequestAuth" }
+func (m *IntroducerPresent) MessageType() string     { return "IntroducerPresent" }
+func (m *IntroducerRollCall) MessageType() string    { return "IntroducerRollCall" }
+func (m *RequestClipboard) MessageType() string      { return "RequestClipboard" }
+func (m *ClipboardData) MessageType() string         { return "ClipboardData" }
+func (m *ClipboardDenied) MessageType() string       { return "ClipboardDenied" }
+func (m *FileOffer) MessageType() string             { return "FileOffer" }
+func (m *FileAccepted) MessageType() string          { return "FileAccepted" }
+func (m *FileRejected) MessageType() string          { return "FileRejected" }
+func (m *FileChunkRequest) MessageType() string      { return "FileChunkRequest" }
+func (m *FileChunk) MessageType() string             { return "FileChunk" }
+func (m *FileReceived) MessageType() string          { return "FileReceived" }
+func (m *RequestNotifications) MessageType() string  { return "RequestNotifications" }
+func (m *NotificationHistory) MessageType() string   { return "NotificationHistory" }
+func (m *NotificationRecorded) MessageType() string  { return "NotificationRecorded" }
+func (m *Reconnected) MessageType() string           { return "Reconnected" }
+func (m *Throttled) MessageType() string             { return "Throttled" }
+
+func (m *CopyData) Validate() error {
+	return validSelection(m, m.Selection)
+}
+
+func (m *DataCopied) Validate() error {
+	return require(m, "origin", m.Origin)
+}
+
+func (m *CopyFailed) Validate() error {
+	return require(m, "origin", m.Origin)
+}
+
+func (m *OpenURL) Validate() error {
+	return require(m, "data", m.Data)
+}
+
+func (m *URLOpened) Validate() error {
+	return require(m, "origin", m.Origin)
+}
+
+func (m *Notification) Validate() error {
+	return require(m, "notification-id", m.NotificationID, "message", m.Message)
+}
+
+func (m *NotificationDisplayed) Validate() error {
+	return require(m, "origin", m.Origin, "notification-id", m.NotificationID)
+}
+
+func (m *Trigger) Validate() error {
+	return require(m, "trigger", m.Trigger, "from", m.From)
+}
+
+func (m *Stream) Validate() error { return nil }
+
+func (m *TestAuth) Validate() error { return nil }
+
+func (m *AuthValid) Validate() error {
+	return require(m, "origin", m.Origin)
+}
+
+func (m *RequestAuth) Validate() error { return nil }
+
+func (m *IntroducerPresent) Validate() error { return nil }
+
+func (m *IntroducerRollCall) Validate() error { return nil }
+
+func (m *RequestClipboard) Validate() error {
+	return validSelection(m, m.Selection)
+}
+
+func (m *ClipboardData) Validate() error {
+	return require(m, "origin", m.Origin)
+}
+
+func (m *ClipboardDenied) Validate() error {
+	return require(m, "origin", m.Origin)
+}
+
+func (m *FileOffer) Validate() error {
+	if err := require(m, "transfer-id", m.TransferID, "name", m.Name, "checksum", m.Checksum); err != nil {
+		return err
+	}
+	// receivers name the partial file after the transfer id
+	if !validTransferID(m.TransferID) {
+		return fmt.Errorf("invalid %s message: bad transfer-id %q", m.MessageType(), m.TransferID)
+	}
+	if m.Size < 0 || m.Size > MaxFileSize {
+		return fmt.Errorf("invalid %s message: size must be at most %d bytes", m.MessageType(), int64(MaxFileSize))
+	}
+	if m.ChunkSize <= 0 || m.ChunkSize > MaxFileChunkSize {
+		return fmt.Errorf("invalid %s message: chunk size must be between 1 and %d bytes", m.MessageType(), MaxFileChunkSize)
+	}
+	if m.Chunks < 0 || m.Chunks > MaxFileChunks {
+		return fmt.Errorf("invalid %s message: at most %d chunks are allowed", m.MessageType(), MaxFileChunks)
+	}
+	if int64(m.Chunks) != (m.Size+int64(m.ChunkSize)-1)/int64(m.ChunkSize) {
+		return fmt.Errorf("invalid %s message: chunks don't match size", m.MessageType())
+	}
+
+	return nil
+}
+
+func (m *FileAccepted) Validate() error {
+	return require(m, "origin", m.Origin, "transfer-id", m.TransferID)
+}
+
+func (m *FileRejected) Validate() error {
+	return require(m, "transfer-id", m.TransferID)
+}
+
+func (m *FileChunkRequest) Validate() error {
+	return require(m, "transfer-id", m.TransferID)
+}
+
+func (m *FileChunk) Validate() error {
+	return require(m, "transfer-id", m.TransferID, "checksum", m.Checksum)
+}
+
+func (m *FileReceived) Validate() error {
+	return require(m, "transfer-id", m.TransferID)
+}
+
+func (m *RequestNotifications) Validate() error { return nil }
+
+func (m *NotificationHistory) Validate() error {
+	return require(m, "origin", m.Origin)
+}
+
+func (m *NotificationRecorded) Validate() error {
+	return require(m, "message", m.Entry.Message)
+}
+
+func (m *Reconnected) Validate() error { return nil }
+
+func (m *Throttled) Validate() error { return nil }
+
+// require takes pairs of field names and values, and returns an error for
+// the first that is empty.
+func require(body Body, fields ...string) error {
+	for i := 0; i+1 < len(fields); i += 2 {
+		if len(fields[i+1]) == 0 {
+			return fmt.Errorf("invalid %s message: missing %s", body.MessageType(), fields[i])
+		}
+	}
+
+	return nil
+}
+
+// validTransferID reports whether a transfer id is safe to use in a file
+// name: short, and only letters, digits, dashes and underscores.
+func validTransferID(id string) bool {
+	if len(id) > 64 {
+		return false
+	}
+
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validSelection returns an error for an unknown selection.  No selection
+// leaves the choice to the receiver.
+func validSelection(body Body, selection string) error {
+	switch selection {
+	case "", SelectionClipboard, SelectionPrimary:
+		return nil
+	}
+
+	return fmt.Errorf("invalid %s message: unknown selection %s", body.MessageType(), selection)
+}
+
+var messageTypes = map[string]func() Body{}
+
+// RegisterMessageType makes a message type known to Decode.  newBody must
+// return a pointer to a new, empty body.
+func RegisterMessageType(newBody func() Body) {
+	messageTypes[newBody().MessageType()] = newBody
+}
+
+func init() {
+	for _, newBody := range []func() Body{
+		func() Body { return &CopyData{} },
+		func() Body { return &DataCopied{} },
+		func() Body { return &CopyFailed{} },
+		func() Body { return &OpenURL{} },
+		func() Body { return &URLOpened{} },
+		func() Body { return &Notification{} },
+		func() Body { return &NotificationDisplayed{} },
+		func() Body { return &Trigger{} },
+		func() Body { return &Stream{} },
+		func() Body { return &TestAuth{} },
+		func() Body { return &AuthValid{} },
+		func() Body { return &RequestAuth{} },
+		func() Body { return &IntroducerPresent{} },
+		func() Body { return &IntroducerRollCall{} },
+		func() Body { return &RequestClipboard{} },
+		func() Body { return &ClipboardData{} },
+		func() Body { return &ClipboardDenied{} },
+		func() Body { return &FileOffer{} },
+		func() Body { return &FileAccepted{} },
+		func() Body { return &FileRejected{} },
+		func() Body { return &FileChunkRequest{} },
+		func() Body { return &FileChunk{} },
+		func() Body { return &FileReceived{} },
+		func() Body { return &RequestNotifications{} },
+		func() Body { return &NotificationHistory{} },
+		func() Body { return &NotificationRecorded{} },
+		func() Body { return &Reconnected{} },
+		func() Body { return &Throttled{} },
+	} {
+		RegisterMessageType(newBody)
+	}
+}
+
+// Encode converts a typed body into a message, ready to be sent.
+func Encode(body Body) Message {
+	contents := make(map[string]interface{})
+
+	encoded, err := json.Marshal(body)
+	if err == nil {
+		err = json.Unmarshal(encoded, &contents)
+	}
+	if err != nil {
+		logrus.Errorf("Unable to encode %s message: %s", body.MessageType(), err)
+	}
+
+	contents["type"] = body.MessageType()
+	contents["schema"] = SchemaVersion
+
+	return Message{Contents: contents}
+}
+
+// Reply encodes body as a reply to the request with the given header, so
+// that it is sent only to the requester and matched up with the request by
+// Connection.Request.
+func Reply(request Header, body Body) Message {
+	message := Encode(body)
+	if len(request.ID) > 0 {
+		message.Destination = ToClient(request.ID)
+	}
+	if len(request.RequestID) > 0 {
+		message.Contents["request-id"] = request.RequestID
+	}
+
+	return message
+}
+
+// Decode converts a received message into its typed body, returning an
+// error if the type is unknown or the message is malformed.
+func Decode(message Message) (Body, error) {
+	messageType := message.Type()
+
+	newBody, ok := messageTypes[messageType]
+	if !ok {
+		return nil, fmt.Errorf("unknown message type '%s'", messageType)
+	}
+
+	var raw []byte
+	if len(message.Raw) > 0 {
+		raw = []byte(message.Raw)
+	} else {
+		var err error
+		raw, err = json.Marshal(message.Contents)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	body := newBody()
+	if err := json.Unmarshal(raw, body); err != nil {
+		return nil, fmt.Errorf("invalid %s message: %s", messageType, err)
+	}
+
+	if schema, _ := message.Contents["schema"].(float64); int(schema) > SchemaVersion {
+		return nil, fmt.Errorf("%s message has unsupported schema version %d", messageType, int(schema))
+	}
+
+	if err := body.Validate(); err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// Type returns the message type, or an empty string if there isn't one.
+func (message Message) Type() string {
+	messageType, _ := message.Contents["type"].(string)
+	return messageType
+}
+
+func reconnectedMessage() Message {
+	message := Encode(&Reconnected{})
+	message.Internal = true
+
+	return message
+}
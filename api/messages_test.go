@@ -0,0 +1,39 @@
+package pmb_test
+
+import (
+	"testing"
+
+	"github.com/justone/pmb/api"
+)
+
+func TestFileOfferValidate(t *testing.T) {
+	valid := func(size int64, chunkSize int, chunks int) *pmb.FileOffer {
+		return &pmb.FileOffer{TransferID: "transfer-1", Name: "file", Checksum: "abc", Size: size, ChunkSize: chunkSize, Chunks: chunks}
+	}
+
+	tests := []struct {
+		name  string
+		offer *pmb.FileOffer
+		valid bool
+	}{
+		{name: "empty file", offer: valid(0, 1024, 0), valid: true},
+		{name: "short last chunk", offer: valid(2500, 1024, 3), valid: true},
+		{name: "largest chunks", offer: valid(pmb.MaxFileChunkSize, pmb.MaxFileChunkSize, 1), valid: true},
+		{name: "chunks don't match", offer: valid(2500, 1024, 2)},
+		{name: "negative size", offer: valid(-1, 1024, 0)},
+		{name: "no chunk size", offer: valid(10, 0, 1)},
+		{name: "chunks too big", offer: valid(pmb.MaxFileChunkSize+1, pmb.MaxFileChunkSize+1, 1)},
+		{name: "too many chunks", offer: valid(pmb.MaxFileChunks+1, 1, pmb.MaxFileChunks+1)},
+		{name: "too big", offer: valid(1<<40, 1, 1<<40)},
+		{name: "too big in big chunks", offer: valid(pmb.MaxFileSize+1, pmb.MaxFileChunkSize, pmb.MaxFileChunks)},
+		{name: "path in transfer id", offer: &pmb.FileOffer{TransferID: "../../etc/x", Name: "file", Checksum: "abc", Size: 0, ChunkSize: 1024}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.offer.Validate(); (err == nil) != test.valid {
+				t.Errorf("Validate() = %v, want valid: %t", err, test.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package pmb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// A NotificationLog is an introducer's history of the notifications it
+// displayed, kept as a file of JSON lines, oldest first.  Only the most
+// recent entries are kept: once the file has twice as many, it is rewritten
+// with just those, so the cost is spread over many additions.
+type NotificationLog struct {
+	mu   sync.Mutex
+	path string
+	keep int
+
+	// lines in the file, or -1 until they have been counted
+	lines int
+}
+
+// DefaultNotificationHistorySize is how many entries a log keeps, unless
+// the notifications.history-size config key says otherwise.
+const DefaultNotificationHistorySize = 1000
+
+// NewDefaultNotificationLog returns the log set by the
+// notifications.history config key, or the one in the user's config
+// directory.
+func NewDefaultNotificationLog() (*NotificationLog, error) {
+	var path string
+	keep := DefaultNotificationHistorySize
+	if config, err := NewDefaultConfigClient(); err == nil {
+		path, _ = config.Get("notifications.history")
+		if size, _ := config.Get("notifications.history-size"); len(size) > 0 {
+			if keep, err = strconv.Atoi(size); err != nil || keep <= 0 {
+				return nil, fmt.Errorf("Invalid notifications.history-size: %s", size)
+			}
+		}
+	}
+
+	if len(path) == 0 {
+		baseDir, err := ConfigDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(baseDir, "notifications.jsonl")
+	}
+
+	return NewNotificationLog(path).Keep(keep), nil
+}
+
+func NewNotificationLog(path string) *NotificationLog {
+	return &NotificationLog{path: path, keep: DefaultNotificationHistorySize, lines: -1}
+}
+
+// Keep sets how many of the most recent entries the log keeps.
+func (l *NotificationLog) Keep(entries int) *NotificationLog {
+	l.keep = entries
+	return l
+}
+
+// Path returns the file the log is kept in.
+func (l *NotificationLog) Path() string {
+	return l.path
+}
+
+// Add appends an entry to the log, dropping the oldest entries if it has
+// grown too long.
+func (l *NotificationLog) Add(entry NotificationEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(line, '\n'))
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if l.lines < 0 {
+		if l.lines, err = l.count(); err != nil {
+			return err
+		}
+	} else {
+		l.lines++
+	}
+
+	if l.lines > 2*l.keep {
+		return l.trim()
+	}
+
+	return nil
+}
+
+// count returns how many lines the log has.
+func (l *NotificationLog) count() (int, error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	lines := 0
+	reader := bufio.NewReaderSize(file, 64*1024)
+	for {
+		line, err := readLogLine(reader, maxMessageSize)
+		if err == io.EOF && len(line) == 0 {
+			return lines, nil
+		} else if err != nil && err != io.EOF && err != errLineTooLong {
+			return lines, err
+		}
+		lines++
+	}
+}
+
+// trim rewrites the log with only the entries it keeps.  The new log is
+// written alongside and renamed over the old, so a reader never sees it
+// half written.
+func (l *NotificationLog) trim() error {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var kept [][]byte
+	reader := bufio.NewReaderSize(file, 64*1024)
+	for {
+		line, err := readLogLine(reader, maxMessageSize)
+		if err == errLineTooLong {
+			continue
+		} else if err == io.EOF && len(line) == 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+
+		kept = append(kept, line)
+		if len(kept) > l.keep {
+			kept = kept[1:]
+		}
+	}
+
+	var buffer bytes.Buffer
+	for _, line := range kept {
+		buffer.Write(line)
+		buffer.WriteByte('\n')
+	}
+
+	tmp := l.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buffer.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+
+	logrus.Debugf("Trimmed notification log %s to %d entries", l.path, len(kept))
+	l.lines = len(kept)
+
+	return nil
+}
+
+// A NotificationFilter picks entries from a log.  Search matches the
+// message, URL, hostname or IP, ignoring case.  A Count of zero means no
+// limit.
+type NotificationFilter struct {
+	Search string
+	Level  float64
+	Count  int
+}
+
+func (f NotificationFilter) Matches(entry NotificationEntry) bool {
+	if entry.Level < f.Level {
+		return false
+	}
+
+	if len(f.Search) == 0 {
+		return true
+	}
+
+	search := strings.ToLower(f.Search)
+	for _, field := range []string{entry.Message, entry.URL, entry.Hostname, entry.IP} {
+		if strings.Contains(strings.ToLower(field), search) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Query returns the most recent entries that match the filter, oldest
+// first.  Lines that can't be parsed, or are too long to be a notification,
+// are skipped.
+func (l *NotificationLog) Query(filter NotificationFilter) ([]NotificationEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	file, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []NotificationEntry
+	reader := bufio.NewReaderSize(file, 64*1024)
+	for {
+		line, err := readLogLine(reader, maxMessageSize)
+		if err == errLineTooLong {
+			logrus.Debugf("Skipping notification log entry over %d bytes", maxMessageSize)
+			continue
+		} else if err == io.EOF && len(line) == 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		var entry NotificationEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			logrus.Debugf("Skipping bad notification log entry: %s", err)
+			continue
+		}
+
+		if !filter.Matches(entry) {
+			continue
+		}
+
+		entries = append(entries, entry)
+		if filter.Count > 0 && len(entries) > filter.Count {
+			entries = entries[1:]
+		}
+	}
+
+	return entries, nil
+}
+
+var errLineTooLong = errors.New("line too long")
+
+// readLogLine reads the next line, without its newline.  A line longer than
+// max is read to its end and errLineTooLong returned, so that the caller
+// can carry on with the line after it.
+func readLogLine(reader *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(chunk) > max+1 {
+				tooLong = true
+				line = nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if tooLong && (err == nil || err == io.EOF) {
+			return nil, errLineTooLong
+		}
+
+		return bytes.TrimSuffix(line, []byte("\n")), err
+	}
+}
@@ -0,0 +1,145 @@
+package pmb_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/justone/pmb/api"
+)
+
+func TestNotificationLogQuery(t *testing.T) {
+	entries := []pmb.NotificationEntry{
+		{Message: "build finished", Level: 3, Hostname: "laptop"},
+		{Message: "deploy failed", Level: 5, Hostname: "ci", URL: "https://ci.example.com/42"},
+		{Message: "Build started", Level: 2, Hostname: "ci"},
+		{Message: "backup done", Level: 3, Hostname: "nas", IP: "192.0.2.7"},
+	}
+
+	tests := []struct {
+		name   string
+		filter pmb.NotificationFilter
+		want   []string
+	}{
+		{name: "everything", want: []string{"build finished", "deploy failed", "Build started", "backup done"}},
+		{name: "most recent", filter: pmb.NotificationFilter{Count: 2}, want: []string{"Build started", "backup done"}},
+		{name: "level", filter: pmb.NotificationFilter{Level: 3}, want: []string{"build finished", "deploy failed", "backup done"}},
+		{name: "search ignores case", filter: pmb.NotificationFilter{Search: "BUILD"}, want: []string{"build finished", "Build started"}},
+		{name: "search url", filter: pmb.NotificationFilter{Search: "example.com"}, want: []string{"deploy failed"}},
+		{name: "search hostname and ip", filter: pmb.NotificationFilter{Search: "192.0.2"}, want: []string{"backup done"}},
+		{name: "search, level and count", filter: pmb.NotificationFilter{Search: "ci", Level: 2, Count: 1}, want: []string{"Build started"}},
+		{name: "no match", filter: pmb.NotificationFilter{Search: "nothing"}, want: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			history := pmb.NewNotificationLog(filepath.Join(t.TempDir(), "notifications.jsonl"))
+			for _, entry := range entries {
+				if err := history.Add(entry); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := history.Query(test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if messages := entryMessages(got); strings.Join(messages, "|") != strings.Join(test.want, "|") {
+				t.Errorf("Query() = %q, want %q", messages, test.want)
+			}
+		})
+	}
+}
+
+func TestNotificationLogQuerySkipsBadLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifications.jsonl")
+	lines := []string{
+		`{"message":"first","level":3}`,
+		"not json",
+		// far over the limit of a message, which can only be garbage
+		`{"message":"` + strings.Repeat("x", 1024*1024) + `","level":3}`,
+		`{"message":"last","level":3}`,
+		// cut short by a crash
+		`{"message":"trunc`,
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := pmb.NewNotificationLog(path).Query(pmb.NotificationFilter{})
+	if err != nil {
+		t.Fatalf("Query() = %v, want the bad lines skipped", err)
+	}
+	if messages := entryMessages(got); strings.Join(messages, "|") != "first|last" {
+		t.Errorf("Query() = %q, want first and last", messages)
+	}
+}
+
+func TestNotificationLogQueryMissing(t *testing.T) {
+	got, err := pmb.NewNotificationLog(filepath.Join(t.TempDir(), "none.jsonl")).Query(pmb.NotificationFilter{})
+	if err != nil || len(got) != 0 {
+		t.Errorf("Query() = %v, %v, want nothing", got, err)
+	}
+}
+
+func entryMessages(entries []pmb.NotificationEntry) []string {
+	var messages []string
+	for _, entry := range entries {
+		messages = append(messages, entry.Message)
+	}
+
+	return messages
+}
+
+func TestNotificationLogKeep(t *testing.T) {
+	tests := []struct {
+		name  string
+		added int
+		// lines already in the file, from an earlier introducer
+		existing  int
+		wantFirst int
+		wantLines int
+	}{
+		{name: "under", added: 5, wantFirst: 0, wantLines: 5},
+		{name: "twice over", added: 6, wantFirst: 0, wantLines: 6},
+		{name: "trimmed", added: 7, wantFirst: 4, wantLines: 3},
+		{name: "growing again", added: 9, wantFirst: 4, wantLines: 5},
+		{name: "existing file", existing: 6, added: 1, wantFirst: 4, wantLines: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "notifications.jsonl")
+			history := pmb.NewNotificationLog(path).Keep(3)
+
+			var lines []string
+			for i := 0; i < test.existing; i++ {
+				lines = append(lines, fmt.Sprintf(`{"message":"%d","level":3}`, i))
+			}
+			if len(lines) > 0 {
+				if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for i := test.existing; i < test.existing+test.added; i++ {
+				if err := history.Add(pmb.NotificationEntry{Message: fmt.Sprintf("%d", i), Level: 3}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := history.Query(pmb.NotificationFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != test.wantLines || got[0].Message != fmt.Sprintf("%d", test.wantFirst) {
+				t.Errorf("Query() = %q, want %d entries from %d", entryMessages(got), test.wantLines, test.wantFirst)
+			}
+			if last := got[len(got)-1].Message; last != fmt.Sprintf("%d", test.existing+test.added-1) {
+				t.Errorf("last entry is %s, want the most recent", last)
+			}
+		})
+	}
+}
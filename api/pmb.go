@@ -1,13 +1,18 @@
 package pmb
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"math/rand"
+	"net/http"
 	"os"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -17,7 +22,10 @@ import (
 type PMBConfig map[string]string
 
 type PMB struct {
-	config PMBConfig
+	config      PMBConfig
+	ctx         context.Context
+	bindings    []string
+	replaySince time.Time
 }
 
 type Message struct {
@@ -25,6 +33,14 @@ type Message struct {
 	Raw      string
 	Done     chan error
 	Internal bool
+
+	// Destination is who the message is sent to, such as ToClient(id),
+	// empty means Broadcast
+	Destination string
+
+	// Body is the message as it is on the wire, still encrypted, which
+	// is all that raw connections send and receive
+	Body []byte
 }
 
 type Connection struct {
@@ -32,20 +48,234 @@ type Connection struct {
 	In     chan Message
 	uri    string
 	prefix string
+	opts   connectOptions
+	seen   *replayCache
 	Keys   []string
 	Id     string
+
+	// sent to websocket and HTTP brokers that require a token
+	token string
+
+	tlsConfig  *tls.Config
+	httpClient *http.Client
+
+	// the broker's sequence number for the last message received, used
+	// to replay what was missed while reconnecting
+	lastSeq uint64
+
+	// the websocket brokers to fail over between, and when one was last
+	// heard from, in nanoseconds
+	brokers []brokerEndpoint
+	current int
+	lastAt  int64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	closed chan struct{}
+
+	// received messages pass through the dispatcher, which hands replies
+	// to pending requests and everything else to In
+	inbound     chan Message
+	pendingLock sync.Mutex
+	pending     []*pendingRequest
+
+	stateLock sync.Mutex
+	state     ConnectionState
+	states    chan ConnectionState
+}
+
+// ErrClosed is returned when using a connection that has been closed.
+var ErrClosed = errors.New("connection closed")
+
+// ErrNotDisplayed is returned by SendNotification when the notification was
+// sent, but no introducer confirmed that it was displayed.
+var ErrNotDisplayed = errors.New("Unable to determine if message was displayed...")
+
+// ErrNotSent is returned by SendNotification when the notification couldn't
+// be sent to the broker in time.
+var ErrNotSent = errors.New("Unable to send message to the broker")
+
+// connectOptions holds the per-connection settings derived from PMBConfig.
+type connectOptions struct {
+	// accept messages encrypted with the old, unauthenticated AES-CFB
+	// scheme, for use while clients are being upgraded.  Off unless
+	// crypto.accept-legacy is set, as legacy messages can be tampered with.
+	acceptLegacy bool
+
+	// discard messages sent longer ago than this (or this far in the
+	// future), zero disables the check
+	replayWindow time.Duration
+
+	// destinations received in addition to broadcasts and messages for
+	// this client
+	bindings []string
+
+	// how long to wait between attempts to reconnect, and how many
+	// attempts to make before giving up, zero to keep trying forever
+	reconnectMin      time.Duration
+	reconnectMax      time.Duration
+	reconnectAttempts int
+
+	// a CA file, or the SHA-256 fingerprint of the broker's certificate,
+	// to check the broker against instead of the system CAs
+	tlsCA          string
+	tlsFingerprint string
+
+	// ask the broker to replay messages sent since this time
+	replaySince time.Time
+
+	// pass bodies through untouched, see ConnectRaw
+	raw bool
+}
+
+func newConnection(ctx context.Context, uri string, prefix string, id string, opts connectOptions) *Connection {
+	ctx, cancel := context.WithCancel(ctx)
+
+	conn := &Connection{
+		In:      make(chan Message, 10),
+		Out:     make(chan Message, 10),
+		uri:     uri,
+		prefix:  prefix,
+		opts:    opts,
+		seen:    newReplayCache(),
+		Id:      id,
+		ctx:     ctx,
+		cancel:  cancel,
+		closed:  make(chan struct{}),
+		inbound: make(chan Message, 10),
+		state:   Connecting,
+		states:  make(chan ConnectionState, maxQueuedStates),
+	}
+	conn.states <- Connecting
+
+	conn.wg.Add(1)
+	go conn.dispatch()
+
+	return conn
+}
+
+// Close shuts the connection down, stopping its goroutines and closing the
+// underlying transport.  Messages still waiting in Out are dropped, with
+// ErrClosed sent on their Done channels, and then In is closed.
+func (conn *Connection) Close() error {
+	conn.cancel()
+	<-conn.closed
+
+	return nil
 }
 
-type Notification struct {
-	Message string
-	URL     string
-	Level   float64
+// Done returns a channel that is closed once the connection has shut down,
+// whether through Close or through the context it was connected with.
+func (conn *Connection) Done() <-chan struct{} {
+	return conn.closed
+}
+
+// closeWhenDone waits for the connection's context to end and then tears
+// down the connection.  It must be started only after all of the transport
+// goroutines have been added to the wait group.
+func (conn *Connection) closeWhenDone() {
+	<-conn.ctx.Done()
+	conn.wg.Wait()
+
+	for {
+		select {
+		case message := <-conn.Out:
+			if message.Done != nil {
+				go func(done chan error) {
+					done <- ErrClosed
+				}(message.Done)
+			}
+		default:
+			close(conn.In)
+			close(conn.closed)
+			return
+		}
+	}
+}
+
+// deliver hands a received message to the dispatcher, unless the connection
+// is closed first.
+func (conn *Connection) deliver(message Message) {
+	select {
+	case conn.inbound <- message:
+	case <-conn.ctx.Done():
+	}
+}
+
+// sent signals that a message has been sent, or failed to be, if the sender
+// asked to know.
+func (conn *Connection) sent(message Message, err error) {
+	if message.Done != nil {
+		logrus.Debugf("Done channel present, sending message")
+		select {
+		case message.Done <- err:
+		case <-conn.ctx.Done():
+		}
+	}
+}
+
+// sleep pauses between retries, returning false if the connection was
+// closed in the meantime.
+func (conn *Connection) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-conn.ctx.Done():
+		return false
+	}
 }
 
 func GetPMB(brokerURI string) *PMB {
 	config := getConfig(brokerURI)
 
-	return &PMB{config: config}
+	return &PMB{config: config, ctx: context.Background()}
+}
+
+// NewPMB returns a PMB using only the given config, rather than reading it
+// from the environment and config files.
+func NewPMB(config PMBConfig) *PMB {
+	return &PMB{config: config, ctx: context.Background()}
+}
+
+// WithContext returns a copy of the PMB whose connections are closed when
+// ctx is done.  Connecting also gives up once ctx is done.
+func (pmb *PMB) WithContext(ctx context.Context) *PMB {
+	copied := pmb.copy()
+	copied.ctx = ctx
+
+	return copied
+}
+
+// Replay returns a copy of the PMB whose connections start by receiving the
+// messages sent since the given time, as far as the broker remembers them.
+// Only the websocket and HTTP brokers keep history.
+func (pmb *PMB) Replay(since time.Time) *PMB {
+	copied := pmb.copy()
+	copied.replaySince = since
+
+	return copied
+}
+
+func (pmb *PMB) copy() *PMB {
+	copied := *pmb
+	return &copied
+}
+
+// settings are optional config values, which can be set in the environment
+// or in the config file, in that order of precedence
+var settings = []struct {
+	name    string
+	env     string
+	confKey string
+}{
+	{"accept-legacy", "PMB_ACCEPT_LEGACY", "crypto.accept-legacy"},
+	{"replay-window", "PMB_REPLAY_WINDOW", "crypto.replay-window"},
+	{"reconnect-min", "PMB_RECONNECT_MIN", "connection.reconnect-min"},
+	{"reconnect-max", "PMB_RECONNECT_MAX", "connection.reconnect-max"},
+	{"reconnect-attempts", "PMB_RECONNECT_ATTEMPTS", "connection.reconnect-attempts"},
+	{"tls-ca", "PMB_TLS_CA", "tls.ca"},
+	{"tls-fingerprint", "PMB_TLS_FINGERPRINT", "tls.fingerprint"},
 }
 
 func getConfig(brokerURI string) PMBConfig {
@@ -57,6 +287,16 @@ func getConfig(brokerURI string) PMBConfig {
 		confBrokerURI, _ = conf.Get("broker.uri")
 	}
 
+	for _, setting := range settings {
+		if value := os.Getenv(setting.env); len(value) > 0 {
+			config[setting.name] = value
+		} else if conf != nil {
+			if value, _ := conf.Get(setting.confKey); len(value) > 0 {
+				config[setting.name] = value
+			}
+		}
+	}
+
 	if len(brokerURI) > 0 {
 		logrus.Debugf("Broker URI retrieved from argument")
 		config["broker"] = brokerURI
@@ -80,11 +320,72 @@ func getConfig(brokerURI string) PMBConfig {
 	return config
 }
 
+func (config PMBConfig) connectOptions() connectOptions {
+	return connectOptions{
+		acceptLegacy: config.getBool("accept-legacy", false),
+		replayWindow: config.getDuration("replay-window", 5*time.Minute),
+
+		reconnectMin:      config.getDuration("reconnect-min", 1*time.Second),
+		reconnectMax:      config.getDuration("reconnect-max", 1*time.Minute),
+		reconnectAttempts: config.getInt("reconnect-attempts", 0),
+
+		tlsCA:          config["tls-ca"],
+		tlsFingerprint: config["tls-fingerprint"],
+	}
+}
+
+func (pmb *PMB) connectOptions(isIntroducer bool) connectOptions {
+	opts := pmb.config.connectOptions()
+	opts.bindings = pmb.bindings
+	opts.replaySince = pmb.replaySince
+	if isIntroducer {
+		opts.bindings = append(append([]string{}, opts.bindings...), ToRole(IntroducerRole))
+	}
+
+	return opts
+}
+
+func (config PMBConfig) getBool(name string, def bool) bool {
+	if value := config[name]; len(value) > 0 {
+		b, err := strconv.ParseBool(value)
+		if err == nil {
+			return b
+		}
+		logrus.Warningf("Invalid value for %s: %s", name, value)
+	}
+
+	return def
+}
+
+func (config PMBConfig) getInt(name string, def int) int {
+	if value := config[name]; len(value) > 0 {
+		i, err := strconv.Atoi(value)
+		if err == nil {
+			return i
+		}
+		logrus.Warningf("Invalid value for %s: %s", name, value)
+	}
+
+	return def
+}
+
+func (config PMBConfig) getDuration(name string, def time.Duration) time.Duration {
+	if value := config[name]; len(value) > 0 {
+		d, err := time.ParseDuration(value)
+		if err == nil {
+			return d
+		}
+		logrus.Warningf("Invalid value for %s: %s", name, value)
+	}
+
+	return def
+}
+
 func (pmb *PMB) ConnectIntroducer(id string) (*Connection, error) {
 
 	if len(pmb.config["broker"]) > 0 {
 		logrus.Debugf("calling connectWithKey")
-		return connectWithKey(pmb.config["broker"], id, "", pmb.config["key"], true, true)
+		return connectWithKey(pmb.ctx, pmb.config["broker"], id, "", pmb.config["key"], true, true, pmb.connectOptions(true))
 	}
 
 	return nil, errors.New("No URI found, use '-p' to specify one")
@@ -94,7 +395,7 @@ func (pmb *PMB) ConnectClient(id string, checkKey bool) (*Connection, error) {
 
 	if len(pmb.config["broker"]) > 0 {
 		logrus.Debugf("calling connectWithKey")
-		return connectWithKey(pmb.config["broker"], id, "", pmb.config["key"], false, checkKey)
+		return connectWithKey(pmb.ctx, pmb.config["broker"], id, "", pmb.config["key"], false, checkKey, pmb.connectOptions(false))
 	}
 
 	return nil, errors.New("No URI found, use '-p' to specify one")
@@ -104,7 +405,7 @@ func (pmb *PMB) ConnectSubClient(conn *Connection, sub string) (*Connection, err
 
 	if len(pmb.config["broker"]) > 0 {
 		logrus.Debugf("calling connectWithKey")
-		return connectWithKey(pmb.config["broker"], conn.Id, sub, strings.Join(conn.Keys, ","), false, false)
+		return connectWithKey(conn.ctx, pmb.config["broker"], conn.Id, sub, strings.Join(conn.Keys, ","), false, false, pmb.connectOptions(false))
 	}
 
 	return nil, errors.New("No URI found, use '-p' to specify one")
@@ -115,7 +416,7 @@ func (pmb *PMB) GetConnection(id string, isIntroducer bool) (*Connection, error)
 
 	if len(pmb.config["broker"]) > 0 {
 		logrus.Debugf("calling connectWithKey")
-		return connectWithKey(pmb.config["broker"], id, "", pmb.config["key"], isIntroducer, true)
+		return connectWithKey(pmb.ctx, pmb.config["broker"], id, "", pmb.config["key"], isIntroducer, true, pmb.connectOptions(isIntroducer))
 	}
 
 	return nil, errors.New("No URI found, use '-p' to specify one")
@@ -124,7 +425,7 @@ func (pmb *PMB) GetConnection(id string, isIntroducer bool) (*Connection, error)
 func (pmb *PMB) CopyKey(id string) (*Connection, error) {
 
 	if len(pmb.config["broker"]) > 0 {
-		return copyKey(pmb.config["broker"], id)
+		return copyKey(pmb.ctx, pmb.config["broker"], id, pmb.connectOptions(false))
 	}
 
 	return nil, errors.New("No URI found, use '-p' to specify one")
@@ -160,82 +461,112 @@ func GenerateRandomID(prefix string) string {
 }
 
 func SendNotification(conn *Connection, note Notification) error {
-	notificationId := GenerateRandomID("notify")
-	notifyData := map[string]interface{}{
-		"type":            "Notification",
-		"notification-id": notificationId,
-		"message":         note.Message,
-		"level":           note.Level,
-		"url":             note.URL,
+	if len(note.NotificationID) == 0 {
+		note.NotificationID = GenerateRandomID("notify")
 	}
-	conn.Out <- Message{Contents: notifyData}
 
-	timeout := time.After(2 * time.Second)
-	for {
-		select {
-		case message := <-conn.In:
-			data := message.Contents
-			if data["type"].(string) == "NotificationDisplayed" && data["origin"].(string) == conn.Id {
-				return nil
-			}
-		case _ = <-timeout:
-			return fmt.Errorf("Unable to determine if message was displayed...")
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	message := EncodeTo(ToRole(IntroducerRole), &note)
+	message.Done = make(chan error, 1)
+
+	_, err := conn.Request(ctx, message, "NotificationDisplayed")
+	if err != context.DeadlineExceeded {
+		return err
+	}
+
+	// whether it was sent decides if it's worth sending again, as sending
+	// it again after it was sent would show it twice
+	select {
+	case err := <-message.Done:
+		if err != nil {
+			return ErrNotSent
 		}
+		return ErrNotDisplayed
+	default:
+		return ErrNotSent
 	}
 }
 
-func connect(URI string, id string, sub string) (*Connection, error) {
+func connect(ctx context.Context, URI string, id string, sub string, opts connectOptions) (*Connection, error) {
+	var conn *Connection
+	var err error
+
 	if strings.HasPrefix(URI, "ws") {
-		return connectWS(URI, id, sub)
+		conn, err = connectWS(ctx, URI, id, sub, opts)
 	} else if strings.HasPrefix(URI, "amqp") {
-		return connectAMQP(URI, id, sub)
+		conn, err = connectAMQP(ctx, URI, id, sub, opts)
+	} else if strings.HasPrefix(URI, "http") {
+		conn, err = connectHTTP(ctx, URI, id, sub, opts)
+	} else if strings.HasPrefix(URI, "mem") {
+		conn, err = connectMem(ctx, URI, id, sub, opts)
+	} else {
+		return nil, fmt.Errorf("Unknown PMB URI")
 	}
-	return nil, fmt.Errorf("Unknown PMB URI")
-}
 
-func copyKey(URI string, id string) (*Connection, error) {
-	conn, err := connect(URI, id, "")
 	if err != nil {
 		return nil, err
 	}
 
-	data := map[string]interface{}{
-		"type": "RequestAuth",
-	}
-	mess := Message{
-		Contents: data,
-		Done:     make(chan error),
+	conn.setState(Connected)
+	go conn.closeWhenDone()
+
+	return conn, nil
+}
+
+func copyKey(ctx context.Context, URI string, id string, opts connectOptions) (*Connection, error) {
+	conn, err := connect(ctx, URI, id, "", opts)
+	if err != nil {
+		return nil, err
 	}
+
+	mess := Encode(&RequestAuth{})
+	mess.Done = make(chan error)
 	conn.Out <- mess
 
-	<-mess.Done
+	if err := <-mess.Done; err != nil {
+		return nil, err
+	}
 
 	return conn, nil
 }
 
-func connectWithKey(URI string, id string, sub string, key string, isIntroducer bool, checkKey bool) (*Connection, error) {
+func connectWithKey(ctx context.Context, URI string, id string, sub string, key string, isIntroducer bool, checkKey bool, opts connectOptions) (*Connection, error) {
 	logrus.Debugf("calling connect")
-	conn, err := connect(URI, id, sub)
+	conn, err := connect(ctx, URI, id, sub, opts)
 	if err != nil {
 		return nil, err
 	}
 
+	err = authenticate(conn, id, key, isIntroducer, checkKey)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func authenticate(conn *Connection, id string, key string, isIntroducer bool, checkKey bool) error {
+	var err error
+
 	if len(key) > 0 {
 		// convert keys
 		conn.Keys, err = parseKeys(key)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		// if we're not the introducer, check if the auth is valid
 		if !isIntroducer && checkKey {
 			err = testAuth(conn, id)
 			if err != nil {
-				return nil, err
+				return err
 			}
 		}
 
-		return conn, nil
+		return nil
 
 	} else {
 
@@ -244,13 +575,13 @@ func connectWithKey(URI string, id string, sub string, key string, isIntroducer
 			conn.Keys = []string{}
 			inkeys, err := requestKey(conn)
 			if err != nil {
-				return nil, err
+				return err
 			}
 
 			// convert keys
 			conn.Keys, err = parseKeys(inkeys)
 			if err != nil {
-				return nil, err
+				return err
 			}
 
 			if !checkKey {
@@ -258,7 +589,9 @@ func connectWithKey(URI string, id string, sub string, key string, isIntroducer
 			}
 
 			err = testAuth(conn, id)
-			if err != nil {
+			if err == ErrClosed {
+				return err
+			} else if err != nil {
 				logrus.Warningf("Error with key: %s", err)
 			} else {
 				if StoreCredHelperKey(inkeys) != nil {
@@ -269,7 +602,7 @@ func connectWithKey(URI string, id string, sub string, key string, isIntroducer
 		}
 	}
 
-	return conn, nil
+	return nil
 }
 
 func parseKeys(keystring string) ([]string, error) {
@@ -287,29 +620,19 @@ func parseKeys(keystring string) ([]string, error) {
 
 func testAuth(conn *Connection, id string) error {
 
-	conn.Out <- Message{Contents: map[string]interface{}{
-		"type": "TestAuth",
-	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	timeout := time.After(10 * time.Second)
-	for {
-		select {
-		case message := <-conn.In:
-			data := message.Contents
-			if data["type"].(string) == "AuthValid" && data["origin"].(string) == id {
-				return nil
-			}
-		case _ = <-timeout:
-			return fmt.Errorf("Auth key was invalid.")
-		}
+	_, err := conn.Request(ctx, EncodeTo(ToRole(IntroducerRole), &TestAuth{}), "AuthValid")
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("Auth key was invalid.")
 	}
+
+	return err
 }
 
 func requestKey(conn *Connection) (string, error) {
-	data := map[string]interface{}{
-		"type": "RequestAuth",
-	}
-	conn.Out <- Message{Contents: data}
+	conn.Out <- Encode(&RequestAuth{})
 
 	time.Sleep(200 * time.Millisecond)
 
@@ -329,7 +652,7 @@ func requestKey(conn *Connection) (string, error) {
 	} else {
 		tty, errt := os.OpenFile("/dev/tty", os.O_RDWR, 0)
 		if errt != nil {
-			fmt.Errorf("failed to open /dev/tty", err)
+			return "", fmt.Errorf("failed to open /dev/tty: %s", errt)
 		}
 
 		key, err = gopass.GetPasswdPrompt("Enter key: ", true, tty, tty)
@@ -0,0 +1,251 @@
+// Package pmbtest runs a bus in memory, with a fake introducer, so that
+// clients can be tested without a broker.
+package pmbtest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/justone/pmb/api"
+)
+
+// A Harness is an in-memory bus with an introducer connected to it.
+type Harness struct {
+	URI        string
+	Key        string
+	Introducer *Introducer
+
+	bus    *pmb.PMB
+	cancel context.CancelFunc
+}
+
+// New starts a harness on a new mem:// bus, which isn't shared with any
+// other harness.
+func New() (*Harness, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	h := &Harness{
+		URI:    fmt.Sprintf("mem://%s", pmb.GenerateRandomID("pmbtest")),
+		Key:    pmb.GenerateRandomString(32),
+		cancel: cancel,
+	}
+	h.bus = pmb.NewPMB(pmb.PMBConfig{"broker": h.URI, "key": h.Key}).WithContext(ctx)
+
+	conn, err := h.bus.ConnectIntroducer("introducer-pmbtest")
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	h.Introducer = newIntroducer(conn)
+	go h.Introducer.run()
+
+	return h, nil
+}
+
+// NewHarness starts a harness for a test, closing it when the test ends.
+// HOME is pointed at a temporary directory for the test, so that the config
+// and queue of the test are kept away from the real ones.
+func NewHarness(t testing.TB) *Harness {
+	t.Helper()
+
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+
+	h, err := New()
+	if err != nil {
+		t.Fatalf("unable to start harness: %s", err)
+	}
+	t.Cleanup(h.Close)
+
+	return h
+}
+
+// ConnectClient connects a client for a test, failing the test if it can't.
+func ConnectClient(t testing.TB, h *Harness, id string) *pmb.Connection {
+	t.Helper()
+
+	conn, err := h.Connect(id)
+	if err != nil {
+		t.Fatalf("unable to connect %s: %s", id, err)
+	}
+
+	return conn
+}
+
+// Bus returns a PMB connected to the harness, for passing to code that
+// connects for itself.
+func (h *Harness) Bus() *pmb.PMB {
+	return h.bus
+}
+
+// Connect connects a client, checking its key with the introducer as
+// clients normally do.
+func (h *Harness) Connect(id string) (*pmb.Connection, error) {
+	return h.bus.ConnectClient(id, true)
+}
+
+// Close closes the introducer and every connection made through the
+// harness.
+func (h *Harness) Close() {
+	h.cancel()
+	<-h.Introducer.conn.Done()
+}
+
+// Introducer is a fake introducer, which records what it receives and
+// replies as a real introducer would, without touching the desktop.
+type Introducer struct {
+	conn *pmb.Connection
+
+	lock     sync.Mutex
+	received []pmb.Body
+	changed  chan struct{}
+	silent   bool
+	state    state
+}
+
+// state is what the introducer replies with, for the messages whose reply
+// depends on the desktop.
+type state struct {
+	clipboard   string
+	copyFailure string
+	screenSaver bool
+}
+
+func newIntroducer(conn *pmb.Connection) *Introducer {
+	return &Introducer{
+		conn:    conn,
+		changed: make(chan struct{}),
+	}
+}
+
+// SetSilent stops the introducer replying, so that clients see what
+// happens when no introducer is running.  Messages are still recorded.
+func (i *Introducer) SetSilent(silent bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.silent = silent
+}
+
+// SetClipboard sets what the introducer replies with when a client asks to
+// paste from the clipboard.
+func (i *Introducer) SetClipboard(data string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.state.clipboard = data
+}
+
+// SetCopyFailure makes the introducer reply to remote copies with
+// CopyFailed, giving reason.  An empty reason makes copies succeed again.
+func (i *Introducer) SetCopyFailure(reason string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.state.copyFailure = reason
+}
+
+// SetScreenSaver sets whether the introducer reports notifications as
+// displayed while the screen saver is on, and so unseen.
+func (i *Introducer) SetScreenSaver(on bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.state.screenSaver = on
+}
+
+// Received returns everything the introducer has received, oldest first.
+func (i *Introducer) Received() []pmb.Body {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return append([]pmb.Body{}, i.received...)
+}
+
+// WaitFor returns the first message of the given type that the introducer
+// received, waiting up to timeout for one to arrive.
+func (i *Introducer) WaitFor(messageType string, timeout time.Duration) (pmb.Body, error) {
+	deadline := time.After(timeout)
+
+	for {
+		i.lock.Lock()
+		changed := i.changed
+		for _, body := range i.received {
+			if body.MessageType() == messageType {
+				i.lock.Unlock()
+				return body, nil
+			}
+		}
+		i.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil, fmt.Errorf("No %s message received within %s", messageType, timeout)
+		}
+	}
+}
+
+// record records body, and returns whether to reply to it, and the state
+// to reply with.
+func (i *Introducer) record(body pmb.Body) (bool, state) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.received = append(i.received, body)
+	close(i.changed)
+	i.changed = make(chan struct{})
+
+	return !i.silent, i.state
+}
+
+func (i *Introducer) run() {
+	for message := range i.conn.In {
+		body, err := pmb.Decode(message)
+		if err != nil {
+			continue
+		}
+
+		replying, state := i.record(body)
+		if !replying {
+			continue
+		}
+
+		if reply, ok := reply(body, state); ok {
+			i.conn.Out <- reply
+		}
+	}
+}
+
+// reply returns what a real introducer would send in response to body.
+func reply(body pmb.Body, state state) (pmb.Message, bool) {
+	switch body := body.(type) {
+	case *pmb.TestAuth:
+		return pmb.Reply(body.Header, &pmb.AuthValid{Origin: body.ID}), true
+	case *pmb.CopyData:
+		if len(state.copyFailure) > 0 {
+			return pmb.Reply(body.Header, &pmb.CopyFailed{Origin: body.ID, Reason: state.copyFailure}), true
+		}
+		return pmb.Reply(body.Header, &pmb.DataCopied{Origin: body.ID}), true
+	case *pmb.OpenURL:
+		return pmb.Reply(body.Header, &pmb.URLOpened{Origin: body.ID}), true
+	case *pmb.Notification:
+		return pmb.Reply(body.Header, &pmb.NotificationDisplayed{
+			Origin:         body.ID,
+			NotificationID: body.NotificationID,
+			Level:          body.Level,
+			Message:        body.Message,
+			ScreenSaverOn:  state.screenSaver,
+		}), true
+	case *pmb.RequestClipboard:
+		return pmb.Reply(body.Header, &pmb.ClipboardData{Origin: body.ID, Data: state.clipboard}), true
+	case *pmb.IntroducerRollCall:
+		return pmb.Encode(&pmb.IntroducerPresent{}), true
+	}
+
+	return pmb.Message{}, false
+}
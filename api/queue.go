@@ -0,0 +1,243 @@
+package pmb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// A Queue holds notifications that couldn't be sent, on disk, so that they
+// can be sent once the broker is reachable again.  Each entry is a JSON
+// file, which is claimed by renaming it while it is being sent so that two
+// processes flushing at once don't both send it.  Claims left behind by a
+// process that died while sending are returned to the queue by the next
+// flush.
+type Queue struct {
+	dir string
+}
+
+type QueueEntry struct {
+	ID           string       `json:"id"`
+	Queued       time.Time    `json:"queued"`
+	Attempts     int          `json:"attempts"`
+	LastError    string       `json:"last-error,omitempty"`
+	Notification Notification `json:"notification"`
+}
+
+const (
+	queueSuffix   = ".json"
+	sendingSuffix = ".sending"
+
+	// how long an entry can be claimed before it's taken to be abandoned,
+	// well beyond how long sending one takes
+	staleClaim = time.Minute
+)
+
+// NewDefaultQueue returns the queue in the user's config directory.
+func NewDefaultQueue() (*Queue, error) {
+	baseDir, err := ConfigDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewQueue(filepath.Join(baseDir, "queue")), nil
+}
+
+func NewQueue(dir string) *Queue {
+	return &Queue{dir: dir}
+}
+
+// Add queues a notification, recording why it couldn't be sent.
+func (q *Queue) Add(note Notification, reason error) (*QueueEntry, error) {
+	if len(note.NotificationID) == 0 {
+		note.NotificationID = GenerateRandomID("notify")
+	}
+
+	entry := &QueueEntry{
+		ID:           fmt.Sprintf("%d-%s", time.Now().UnixNano(), GenerateRandomString(6)),
+		Queued:       time.Now(),
+		Notification: note,
+	}
+	if reason != nil {
+		entry.LastError = reason.Error()
+	}
+
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return entry, q.save(entry, q.path(entry.ID))
+}
+
+// List returns the queued entries, oldest first.
+func (q *Queue) List() ([]*QueueEntry, error) {
+	files, err := ioutil.ReadDir(q.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries []*QueueEntry
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), queueSuffix) {
+			continue
+		}
+
+		entry, err := q.load(filepath.Join(q.dir, file.Name()))
+		if err != nil {
+			logrus.Warningf("Skipping unreadable queue entry %s: %s", file.Name(), err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Queued.Before(entries[j].Queued)
+	})
+
+	return entries, nil
+}
+
+// Remove deletes a queued entry.
+func (q *Queue) Remove(id string) error {
+	err := os.Remove(q.path(id))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("No queued entry with id %s", id)
+	}
+
+	return err
+}
+
+// Purge deletes all queued entries, returning how many there were.
+func (q *Queue) Purge() (int, error) {
+	entries, err := q.List()
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, entry := range entries {
+		if err := q.Remove(entry.ID); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+// Flush sends the queued entries over conn, oldest first, removing each once
+// it has been sent.  It stops at the first failure to send, as the rest are
+// likely to fail too, and returns how many were sent.
+func (q *Queue) Flush(conn *Connection) (int, error) {
+	q.reclaim()
+
+	entries, err := q.List()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, entry := range entries {
+		path := q.path(entry.ID)
+		claimed := path + sendingSuffix
+		if err := os.Rename(path, claimed); err != nil {
+			// another process got to it first
+			logrus.Debugf("Unable to claim queue entry %s: %s", entry.ID, err)
+			continue
+		}
+		// renaming keeps the modification time, which is what tells an
+		// abandoned claim from one in progress
+		now := time.Now()
+		os.Chtimes(claimed, now, now)
+
+		logrus.Debugf("Sending queued notification %s", entry.ID)
+		err := SendNotification(conn, entry.Notification)
+		if err == nil || err == ErrNotDisplayed {
+			// sending it again would show it twice if an introducer
+			// displays it late
+			if err == ErrNotDisplayed {
+				logrus.Warningf("Queued notification %s sent, but not confirmed as displayed.", entry.ID)
+			}
+			os.Remove(claimed)
+			sent++
+			continue
+		}
+
+		entry.Attempts++
+		entry.LastError = err.Error()
+		if serr := q.save(entry, claimed); serr != nil {
+			logrus.Warningf("Unable to update queue entry %s: %s", entry.ID, serr)
+		}
+		if rerr := os.Rename(claimed, path); rerr != nil {
+			logrus.Warningf("Unable to return entry %s to the queue: %s", entry.ID, rerr)
+		}
+
+		return sent, err
+	}
+
+	return sent, nil
+}
+
+// reclaim returns entries to the queue that were claimed for sending by a
+// process that never finished.
+func (q *Queue) reclaim() {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), queueSuffix+sendingSuffix) || time.Since(file.ModTime()) < staleClaim {
+			continue
+		}
+
+		claimed := filepath.Join(q.dir, file.Name())
+		logrus.Infof("Returning abandoned queue entry %s to the queue", file.Name())
+		if err := os.Rename(claimed, strings.TrimSuffix(claimed, sendingSuffix)); err != nil {
+			logrus.Warningf("Unable to return entry %s to the queue: %s", file.Name(), err)
+		}
+	}
+}
+
+func (q *Queue) path(id string) string {
+	return filepath.Join(q.dir, id+queueSuffix)
+}
+
+func (q *Queue) load(path string) (*QueueEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entry QueueEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// save writes the entry to a temporary file first, so that a reader never
+// sees a partial entry.
+func (q *Queue) save(entry *QueueEntry, path string) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,128 @@
+package pmb_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/justone/pmb/api"
+	"github.com/justone/pmb/api/pmbtest"
+)
+
+func TestQueueFlush(t *testing.T) {
+	tests := []struct {
+		name      string
+		silent    bool
+		closed    bool
+		wantSent  int
+		wantLeft  int
+		wantError error
+	}{
+		{name: "introducer running", wantSent: 2},
+		// sent, so not kept, as an introducer may still show them
+		{name: "no introducer", silent: true, wantSent: 2},
+		// the first failure stops the flush, so only it is retried
+		{name: "not sent", closed: true, wantLeft: 2, wantError: pmb.ErrClosed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := pmbtest.NewHarness(t)
+			conn := pmbtest.ConnectClient(t, h, "queue-test")
+			h.Introducer.SetSilent(test.silent)
+			if test.closed {
+				conn.Close()
+			}
+
+			queue := pmb.NewQueue(t.TempDir())
+			for _, message := range []string{"first", "second"} {
+				if _, err := queue.Add(pmb.Notification{Message: message, Level: 3}, errors.New("not connected")); err != nil {
+					t.Fatal(err)
+				}
+				// entries are ordered by when they were queued
+				time.Sleep(time.Millisecond)
+			}
+
+			sent, err := queue.Flush(conn)
+			if sent != test.wantSent || err != test.wantError {
+				t.Fatalf("Flush() = %d, %v, want %d, %v", sent, err, test.wantSent, test.wantError)
+			}
+
+			var received []string
+			for _, body := range h.Introducer.Received() {
+				if note, ok := body.(*pmb.Notification); ok {
+					received = append(received, note.Message)
+				}
+			}
+			if test.closed && len(received) != 0 {
+				t.Errorf("introducer received %q, want nothing", received)
+			} else if !test.closed && (len(received) != 2 || received[0] != "first" || received[1] != "second") {
+				t.Errorf("introducer received %q, want them oldest first", received)
+			}
+
+			entries, err := queue.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != test.wantLeft {
+				t.Fatalf("%d entries left in the queue, want %d", len(entries), test.wantLeft)
+			}
+			if test.wantLeft > 0 {
+				if entries[0].Attempts != 1 || entries[0].LastError != test.wantError.Error() {
+					t.Errorf("failed entry has %d attempt(s) and error %q, want 1 and %q", entries[0].Attempts, entries[0].LastError, test.wantError)
+				}
+				if entries[1].Attempts != 0 {
+					t.Errorf("entry after the failure has %d attempt(s), want 0", entries[1].Attempts)
+				}
+			}
+		})
+	}
+}
+
+func TestQueueFlushReclaims(t *testing.T) {
+	tests := []struct {
+		name     string
+		age      time.Duration
+		wantSent int
+	}{
+		// the process that claimed it died while sending
+		{name: "abandoned", age: 2 * time.Minute, wantSent: 1},
+		// another process is sending it
+		{name: "in progress", age: time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := pmbtest.NewHarness(t)
+			conn := pmbtest.ConnectClient(t, h, "queue-test")
+
+			dir := t.TempDir()
+			queue := pmb.NewQueue(dir)
+			entry, err := queue.Add(pmb.Notification{Message: "claimed", Level: 3}, errors.New("not connected"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(dir, entry.ID+".json")
+			claimed := path + ".sending"
+			if err := os.Rename(path, claimed); err != nil {
+				t.Fatal(err)
+			}
+			then := time.Now().Add(-test.age)
+			if err := os.Chtimes(claimed, then, then); err != nil {
+				t.Fatal(err)
+			}
+
+			sent, err := queue.Flush(conn)
+			if sent != test.wantSent || err != nil {
+				t.Fatalf("Flush() = %d, %v, want %d, <nil>", sent, err, test.wantSent)
+			}
+
+			if _, err := os.Stat(claimed); (err == nil) == (test.wantSent > 0) {
+				t.Errorf("claim left in place: %t, want %t", err == nil, test.wantSent == 0)
+			}
+		})
+	}
+}
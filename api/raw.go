@@ -0,0 +1,45 @@
+package pmb
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ConnectRaw connects without a key, for forwarding messages between
+// brokers.  A raw connection receives everything sent on the broker, with
+// each message's Body and Destination set, and sends the Body of each
+// message as it is.  Nothing is decrypted or checked, so messages from the
+// connection itself are received too.
+func (pmb *PMB) ConnectRaw(id string) (*Connection, error) {
+	if len(pmb.config["broker"]) == 0 {
+		return nil, errors.New("No URI found, use '-p' to specify one")
+	}
+
+	opts := pmb.connectOptions(false)
+	opts.raw = true
+	opts.bindings = []string{Everything}
+
+	return connect(pmb.ctx, pmb.config["broker"], id, "", opts)
+}
+
+// receive handles a message body from the broker.
+func (conn *Connection) receive(destination string, body []byte) {
+	if conn.opts.raw {
+		conn.deliver(Message{Body: body, Destination: destination})
+		return
+	}
+
+	parseMessage(body, conn)
+}
+
+// bodies returns what to send to the broker for a message.
+func (conn *Connection) bodies(message Message, id string) ([][]byte, error) {
+	if conn.opts.raw {
+		if len(message.Body) == 0 {
+			return nil, fmt.Errorf("Raw connections can only send message bodies")
+		}
+		return [][]byte{message.Body}, nil
+	}
+
+	return prepareMessage(message, conn.Keys, id)
+}
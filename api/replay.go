@@ -0,0 +1,78 @@
+package pmb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// how long to remember message ids when the replay window is disabled
+const defaultReplayRetention = time.Hour
+
+// replayCache remembers the ids of recently received messages, so that a
+// message captured off the bus and re-published can be dropped.  The ids are
+// also kept in the order they expire, so forgetting them doesn't mean
+// looking through them all.
+type replayCache struct {
+	sync.Mutex
+	seen   map[string]time.Time
+	expiry []seenID
+}
+
+type seenID struct {
+	id      string
+	expires time.Time
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{seen: make(map[string]time.Time)}
+}
+
+// checkFresh returns an error if the message was sent outside of the replay
+// window, or is older than its own "ttl" (in seconds).
+func checkFresh(data map[string]interface{}, window time.Duration) error {
+	sentRaw, _ := data["sent"].(string)
+	sent, err := time.Parse(time.RFC3339, sentRaw)
+	if err != nil {
+		return fmt.Errorf("missing or invalid sent time '%s'", sentRaw)
+	}
+
+	age := time.Since(sent)
+	if window > 0 && (age > window || age < -window) {
+		return fmt.Errorf("sent at %s, outside of the %s replay window", sentRaw, window)
+	}
+
+	if ttl, ok := data["ttl"].(float64); ok && age > time.Duration(ttl*float64(time.Second)) {
+		return fmt.Errorf("sent at %s, expired after %0.0f seconds", sentRaw, ttl)
+	}
+
+	return nil
+}
+
+// seenBefore records the message id and reports whether it was already
+// recorded. Ids are forgotten once they would be outside of the window.
+func (rc *replayCache) seenBefore(messageID string, window time.Duration) bool {
+	rc.Lock()
+	defer rc.Unlock()
+
+	now := time.Now()
+	for len(rc.expiry) > 0 && now.After(rc.expiry[0].expires) {
+		delete(rc.seen, rc.expiry[0].id)
+		rc.expiry = rc.expiry[1:]
+	}
+
+	if _, ok := rc.seen[messageID]; ok {
+		return true
+	}
+
+	if window <= 0 {
+		window = defaultReplayRetention
+	}
+	// allow for the window on both sides, since the sent time can be
+	// up to a window in the future
+	expires := now.Add(2 * window)
+	rc.seen[messageID] = expires
+	rc.expiry = append(rc.expiry, seenID{id: messageID, expires: expires})
+
+	return false
+}
@@ -0,0 +1,32 @@
+package pmb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReplayCacheForgets(t *testing.T) {
+	rc := newReplayCache()
+
+	for i := 0; i < 3; i++ {
+		if rc.seenBefore(fmt.Sprintf("message-%d", i), 10*time.Millisecond) {
+			t.Fatalf("message-%d seen before it was sent", i)
+		}
+	}
+	if !rc.seenBefore("message-1", 10*time.Millisecond) {
+		t.Errorf("message-1 not remembered")
+	}
+
+	// ids are kept for twice the window
+	time.Sleep(30 * time.Millisecond)
+	if rc.seenBefore("message-3", 10*time.Millisecond) {
+		t.Fatalf("message-3 seen before it was sent")
+	}
+	if len(rc.seen) != 1 || len(rc.expiry) != 1 {
+		t.Errorf("%d ids remembered (%d by expiry), want 1", len(rc.seen), len(rc.expiry))
+	}
+	if rc.seenBefore("message-0", 10*time.Millisecond) {
+		t.Errorf("message-0 still remembered after the window")
+	}
+}
@@ -0,0 +1,70 @@
+package pmb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/justone/pmb/api"
+	"github.com/justone/pmb/api/pmbtest"
+)
+
+func TestTTL(t *testing.T) {
+	tests := []struct {
+		name      string
+		ttl       float64
+		delivered bool
+	}{
+		{name: "no ttl", delivered: true},
+		{name: "within ttl", ttl: 60, delivered: true},
+		{name: "expired", ttl: 0.000001, delivered: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := pmbtest.NewHarness(t)
+			sender := pmbtest.ConnectClient(t, h, "ttl-sender")
+			receiver := pmbtest.ConnectClient(t, h, "ttl-receiver")
+
+			send(t, sender, pmb.EncodeTo(pmb.ToClient("ttl-receiver"), &pmb.Trigger{
+				Header:  pmb.Header{TTL: test.ttl},
+				Trigger: "ttl",
+			}))
+
+			if _, ok := receive(receiver, "Trigger", 500*time.Millisecond); ok != test.delivered {
+				t.Errorf("delivered: %t, want %t", ok, test.delivered)
+			}
+		})
+	}
+}
+
+func TestReplayedMessageDropped(t *testing.T) {
+	h := pmbtest.NewHarness(t)
+	sender := pmbtest.ConnectClient(t, h, "replay-sender")
+	receiver := pmbtest.ConnectClient(t, h, "replay-receiver")
+
+	// a raw connection sees the message as it went over the bus, and can
+	// publish it again unchanged
+	raw, err := h.Bus().ConnectRaw("replay-attacker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send(t, sender, pmb.EncodeTo(pmb.ToClient("replay-receiver"), &pmb.Trigger{Trigger: "replay"}))
+	if _, ok := receive(receiver, "Trigger", time.Second); !ok {
+		t.Fatal("original message wasn't delivered")
+	}
+
+	var captured pmb.Message
+	for captured.Destination != pmb.ToClient("replay-receiver") {
+		select {
+		case captured = <-raw.In:
+		case <-time.After(time.Second):
+			t.Fatal("raw connection didn't see the message")
+		}
+	}
+
+	send(t, raw, pmb.Message{Body: captured.Body, Destination: captured.Destination})
+	if _, ok := receive(receiver, "Trigger", 500*time.Millisecond); ok {
+		t.Error("replayed message was delivered")
+	}
+}
@@ -0,0 +1,148 @@
+package pmb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// how many received messages to hold for a consumer that isn't reading In,
+// beyond this the transport is held up until the consumer catches up
+const maxQueuedIn = 1000
+
+type pendingRequest struct {
+	id        string
+	replyType string
+	reply     chan Message
+}
+
+// Request sends message and waits for the reply to it, which should be of
+// replyType.  Replies are matched up by a request id that is added to the
+// message, so several requests can be outstanding on one connection, and
+// replies to them are not delivered on In.
+//
+// Replies from peers that don't echo request ids are matched by type and
+// origin, oldest request first.  If the reply is of a different type, it is
+// returned along with an error.
+func (conn *Connection) Request(ctx context.Context, message Message, replyType string) (Message, error) {
+	pending := &pendingRequest{
+		id:        GenerateRandomID("request"),
+		replyType: replyType,
+		reply:     make(chan Message, 1),
+	}
+
+	// the caller's message is left as it was
+	contents := make(map[string]interface{}, len(message.Contents)+1)
+	for k, v := range message.Contents {
+		contents[k] = v
+	}
+	contents["request-id"] = pending.id
+	message.Contents = contents
+
+	conn.addPending(pending)
+	defer conn.removePending(pending)
+
+	select {
+	case conn.Out <- message:
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	case <-conn.ctx.Done():
+		return Message{}, ErrClosed
+	}
+
+	select {
+	case reply := <-pending.reply:
+		if reply.Type() != replyType {
+			return reply, fmt.Errorf("Expected %s reply, received %s", replyType, reply.Type())
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	case <-conn.ctx.Done():
+		return Message{}, ErrClosed
+	}
+}
+
+func (conn *Connection) addPending(pending *pendingRequest) {
+	conn.pendingLock.Lock()
+	defer conn.pendingLock.Unlock()
+
+	conn.pending = append(conn.pending, pending)
+}
+
+func (conn *Connection) removePending(pending *pendingRequest) {
+	conn.pendingLock.Lock()
+	defer conn.pendingLock.Unlock()
+
+	for i, p := range conn.pending {
+		if p == pending {
+			conn.pending = append(conn.pending[:i], conn.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// claim hands message to the pending request it replies to, if any.
+func (conn *Connection) claim(message Message) bool {
+	requestID, _ := message.Contents["request-id"].(string)
+	origin, _ := message.Contents["origin"].(string)
+
+	conn.pendingLock.Lock()
+	defer conn.pendingLock.Unlock()
+
+	for i, pending := range conn.pending {
+		if (len(requestID) > 0 && requestID == pending.id) ||
+			(len(requestID) == 0 && origin == conn.Id && message.Type() == pending.replyType) {
+
+			// only the first reply counts, there may be more than one
+			// introducer answering
+			conn.pending = append(conn.pending[:i], conn.pending[i+1:]...)
+			pending.reply <- message
+			return true
+		}
+	}
+
+	return false
+}
+
+// dispatch routes received messages to pending requests or on to In.  It
+// queues messages for In, so that a consumer that is slow to read (or not
+// reading at all) can't hold up replies to requests.  Once the queue is
+// full, it stops receiving until the consumer reads, as the transports did
+// before, rather than lose messages.
+func (conn *Connection) dispatch() {
+	defer conn.wg.Done()
+
+	var queue []Message
+	for {
+		var in chan Message
+		var next Message
+		if len(queue) > 0 {
+			in = conn.In
+			next = queue[0]
+		}
+
+		inbound := conn.inbound
+		if len(queue) >= maxQueuedIn {
+			inbound = nil
+		}
+
+		select {
+		case message := <-inbound:
+			if conn.claim(message) {
+				logrus.Debugf("%s reply matched to request", message.Type())
+				continue
+			}
+
+			queue = append(queue, message)
+			if len(queue) == maxQueuedIn {
+				logrus.Warningf("%d messages waiting to be read, holding up the connection", maxQueuedIn)
+			}
+		case in <- next:
+			queue = queue[1:]
+		case <-conn.ctx.Done():
+			return
+		}
+	}
+}
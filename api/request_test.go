@@ -0,0 +1,54 @@
+package pmb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDispatchHoldsUpWhenFull(t *testing.T) {
+	conn := newConnection(context.Background(), "mem://test", "", "test", connectOptions{})
+	defer conn.cancel()
+
+	// nothing reads In, so once the queue is full the next message can't
+	// be handed over
+	for i := 0; i < maxQueuedIn+cap(conn.In)+cap(conn.inbound); i++ {
+		select {
+		case conn.inbound <- Message{Contents: map[string]interface{}{"type": "Test", "n": i}}:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d held up before the queue was full", i)
+		}
+	}
+
+	select {
+	case conn.inbound <- Message{Contents: map[string]interface{}{"type": "Test"}}:
+		t.Fatalf("message accepted with the queue full")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// and nothing was dropped
+	for i := 0; i < maxQueuedIn+cap(conn.In)+cap(conn.inbound); i++ {
+		message := <-conn.In
+		if n := message.Contents["n"]; n != i {
+			t.Fatalf("message %d: received %v", i, n)
+		}
+	}
+}
+
+func TestRequestLeavesMessageAlone(t *testing.T) {
+	conn := newConnection(context.Background(), "mem://test", "", "test", connectOptions{})
+	defer conn.cancel()
+
+	contents := map[string]interface{}{"type": "TestAuth"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	go func() {
+		<-conn.Out
+	}()
+	conn.Request(ctx, Message{Contents: contents}, "AuthValid")
+
+	if _, ok := contents["request-id"]; ok {
+		t.Errorf("request id added to the caller's message")
+	}
+}
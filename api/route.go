@@ -0,0 +1,199 @@
+package pmb
+
+import (
+	"bytes"
+	"fmt"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Destinations say who a message is for.  They are used as the routing key
+// on AMQP, and are visible to the websocket broker so it only forwards
+// messages to the clients that want them.
+const (
+	// Broadcast messages go to every client, this is the default.
+	Broadcast = "broadcast"
+
+	// Everything can be bound to receive all messages, regardless of
+	// destination.
+	Everything = "#"
+
+	// the routing key used by clients from before destinations existed
+	legacyBroadcast = "test"
+
+	IntroducerRole = "introducer"
+)
+
+// ToClient returns the destination for a single client.
+func ToClient(id string) string {
+	return fmt.Sprintf("client.%s", id)
+}
+
+// ToRole returns the destination for all clients with a role, such as
+// IntroducerRole.
+func ToRole(role string) string {
+	return fmt.Sprintf("role.%s", role)
+}
+
+// ToTopic returns the destination for all clients subscribed to a topic.
+func ToTopic(topic string) string {
+	return fmt.Sprintf("topic.%s", topic)
+}
+
+// EncodeTo is Encode for a message that isn't a broadcast.
+func EncodeTo(destination string, body Body) Message {
+	message := Encode(body)
+	message.Destination = destination
+
+	return message
+}
+
+// Subscribe returns a copy of the PMB whose connections also receive
+// messages sent to the given destinations.  Every connection receives
+// broadcasts and messages sent to its own id.
+func (pmb *PMB) Subscribe(destinations ...string) *PMB {
+	copied := pmb.copy()
+	copied.bindings = append(append([]string{}, pmb.bindings...), destinations...)
+
+	return copied
+}
+
+// bindings returns all of the destinations that the connection receives.
+func (conn *Connection) bindings() []string {
+	return append([]string{Broadcast, legacyBroadcast, ToClient(conn.Id)}, conn.opts.bindings...)
+}
+
+func destination(message Message) string {
+	if len(message.Destination) > 0 {
+		return message.Destination
+	}
+
+	return Broadcast
+}
+
+// brokerURI adds the connection's bindings and replay request to a
+// websocket or HTTP broker URI.
+func (conn *Connection) brokerURI(uri string) (string, error) {
+	u, err := neturl.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	for _, binding := range conn.bindings() {
+		query.Add("bind", binding)
+	}
+
+	// ask for sequence numbers, so that after reconnecting we can ask for
+	// whatever was missed in between
+	query.Set("seq", "true")
+	if seq := atomic.LoadUint64(&conn.lastSeq); seq > 0 {
+		query.Set("since-seq", strconv.FormatUint(seq, 10))
+	} else if !conn.opts.replaySince.IsZero() {
+		query.Set("since", conn.opts.replaySince.UTC().Format(time.RFC3339Nano))
+	}
+
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// received records the sequence number of a message from the broker.
+func (conn *Connection) received(seq uint64) {
+	if seq > 0 {
+		atomic.StoreUint64(&conn.lastSeq, seq)
+	}
+}
+
+// RouteFrame prepares a message body to be sent to the websocket broker.
+// Broadcasts are sent as is, so that brokers and clients from before
+// destinations existed still understand them, everything else is prefixed
+// with "@destination ".
+func RouteFrame(destination string, body []byte) []byte {
+	if destination == Broadcast || len(destination) == 0 {
+		return body
+	}
+
+	return append([]byte(fmt.Sprintf("@%s ", destination)), body...)
+}
+
+// SplitFrame is the reverse of RouteFrame.
+func SplitFrame(frame []byte) (string, []byte) {
+	if len(frame) == 0 || frame[0] != '@' {
+		return Broadcast, frame
+	}
+
+	space := bytes.IndexByte(frame, ' ')
+	if space < 0 {
+		return Broadcast, frame
+	}
+
+	return string(frame[1:space]), frame[space+1:]
+}
+
+// SequenceHeader carries the broker's sequence number for a message in
+// replies to HTTP polls.
+const SequenceHeader = "X-PMB-Sequence"
+
+// SequenceFrame prefixes a message with its sequence number in the realm,
+// as "#seq ", for clients that asked for sequence numbers.
+func SequenceFrame(seq uint64, body []byte) []byte {
+	return append([]byte(fmt.Sprintf("#%d ", seq)), body...)
+}
+
+// SplitSequence is the reverse of SequenceFrame, returning zero if the
+// frame has no sequence number.
+func SplitSequence(frame []byte) (uint64, []byte) {
+	if len(frame) == 0 || frame[0] != '#' {
+		return 0, frame
+	}
+
+	space := bytes.IndexByte(frame, ' ')
+	if space < 0 {
+		return 0, frame
+	}
+
+	seq, err := strconv.ParseUint(string(frame[1:space]), 10, 64)
+	if err != nil {
+		return 0, frame
+	}
+
+	return seq, frame[space+1:]
+}
+
+// Wants reports whether a client with the given bindings should receive a
+// message sent to destination.  No bindings at all means a client from
+// before destinations existed, which receives everything.
+func Wants(bindings []string, destination string) bool {
+	if len(bindings) == 0 {
+		return true
+	}
+
+	for _, binding := range bindings {
+		if binding == Everything || binding == destination {
+			return true
+		}
+
+		// legacy clients send broadcasts with their own routing key
+		if destination == legacyBroadcast && binding == Broadcast {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseBindings returns the bindings requested in a broker URI query.
+func ParseBindings(query neturl.Values) []string {
+	var bindings []string
+	for _, binding := range query["bind"] {
+		if binding = strings.TrimSpace(binding); len(binding) > 0 {
+			bindings = append(bindings, binding)
+		}
+	}
+
+	return bindings
+}
@@ -0,0 +1,139 @@
+package pmb
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ConnectionState is the state of a connection's link to the broker, as
+// reported on Connection.State.
+type ConnectionState int
+
+const (
+	Connecting ConnectionState = iota
+	Connected
+	Disconnected
+
+	// GaveUp means reconnecting failed too many times, and the connection
+	// has been closed.
+	GaveUp
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	case GaveUp:
+		return "gave up"
+	}
+
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+// how many state changes to hold for a consumer that isn't reading State,
+// beyond this the oldest are dropped
+const maxQueuedStates = 10
+
+// State returns a channel of changes to the connection's state.  Changes
+// are never blocked on a slow reader, if it falls behind the oldest are
+// dropped.
+func (conn *Connection) State() <-chan ConnectionState {
+	return conn.states
+}
+
+// setState reports a change of state, repeats of the current state are
+// ignored.
+func (conn *Connection) setState(state ConnectionState) {
+	conn.stateLock.Lock()
+	defer conn.stateLock.Unlock()
+
+	if conn.state == state {
+		return
+	}
+	conn.state = state
+	logrus.Debugf("Connection is %s", state)
+
+	for {
+		select {
+		case conn.states <- state:
+			return
+		default:
+			select {
+			case <-conn.states:
+			default:
+			}
+		}
+	}
+}
+
+// backoff computes the delays between reconnection attempts, doubling each
+// time up to a maximum.  Half of each delay is random, so that clients that
+// lost the broker together don't all come back at once.
+type backoff struct {
+	min         time.Duration
+	max         time.Duration
+	maxAttempts int
+	attempts    int
+}
+
+// next returns how long to wait before the next attempt, or false if there
+// have been too many already.
+func (b *backoff) next() (time.Duration, bool) {
+	b.attempts++
+	if b.maxAttempts > 0 && b.attempts >= b.maxAttempts {
+		return 0, false
+	}
+
+	ceiling := b.max
+	if shift := uint(b.attempts - 1); shift < 32 {
+		if d := b.min << shift; d > 0 && d < b.max {
+			ceiling = d
+		}
+	}
+
+	ensureRandSeeded()
+	half := ceiling / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1)), true
+}
+
+// retry calls setup until it succeeds, backing off in between.  It returns
+// ErrClosed if the connection is closed while retrying.  If the configured
+// number of attempts is used up, the connection is closed and the last
+// error returned.
+func (conn *Connection) retry(what string, setup func() error) error {
+	b := &backoff{
+		min:         conn.opts.reconnectMin,
+		max:         conn.opts.reconnectMax,
+		maxAttempts: conn.opts.reconnectAttempts,
+	}
+
+	for {
+		conn.setState(Connecting)
+
+		err := setup()
+		if err == nil {
+			conn.setState(Connected)
+			return nil
+		}
+
+		delay, ok := b.next()
+		if !ok {
+			logrus.Errorf("%s failed %d times, giving up: %s", what, b.attempts, err)
+			conn.setState(GaveUp)
+			conn.cancel()
+			return err
+		}
+
+		logrus.Warningf("%s failed, retrying in %s: %s", what, delay.Round(time.Millisecond), err)
+		if !conn.sleep(delay) {
+			return ErrClosed
+		}
+	}
+}
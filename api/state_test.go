@@ -0,0 +1,114 @@
+package pmb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxAttempts int
+		// the largest delay for each attempt, which is doubled each
+		// time up to the max
+		ceilings []time.Duration
+	}{
+		{
+			name:     "unlimited",
+			ceilings: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second},
+		},
+		{
+			name:        "limited",
+			maxAttempts: 3,
+			ceilings:    []time.Duration{time.Second, 2 * time.Second},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &backoff{min: time.Second, max: 8 * time.Second, maxAttempts: test.maxAttempts}
+
+			for attempt, ceiling := range test.ceilings {
+				delay, ok := b.next()
+				if !ok {
+					t.Fatalf("attempt %d: gave up early", attempt+1)
+				}
+				if delay < ceiling/2 || delay > ceiling {
+					t.Errorf("attempt %d: delay %s, want between %s and %s", attempt+1, delay, ceiling/2, ceiling)
+				}
+			}
+
+			if _, ok := b.next(); test.maxAttempts > 0 && ok {
+				t.Errorf("attempt %d: didn't give up", len(test.ceilings)+1)
+			}
+		})
+	}
+}
+
+func TestBackoffDoesntOverflow(t *testing.T) {
+	b := &backoff{min: time.Second, max: time.Minute, attempts: 100}
+
+	if delay, ok := b.next(); !ok || delay < 30*time.Second || delay > time.Minute {
+		t.Errorf("next() = %s, %t, want between 30s and 1m", delay, ok)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   int
+		attempts   int
+		wantStates []ConnectionState
+		wantErr    bool
+	}{
+		{name: "first try", wantStates: []ConnectionState{Connecting, Connected}},
+		{name: "after failures", failures: 2, wantStates: []ConnectionState{Connecting, Connected}},
+		{name: "gives up", failures: 5, attempts: 3, wantStates: []ConnectionState{Connecting, GaveUp}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := newConnection(context.Background(), "test://", "", "retry-test", connectOptions{
+				reconnectMin:      time.Millisecond,
+				reconnectMax:      4 * time.Millisecond,
+				reconnectAttempts: test.attempts,
+			})
+			defer conn.cancel()
+
+			calls := 0
+			err := conn.retry("Test", func() error {
+				calls++
+				if calls <= test.failures {
+					return errors.New("broker unreachable")
+				}
+				return nil
+			})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("retry() = %v, want error: %t", err, test.wantErr)
+			}
+
+			wantCalls := test.failures + 1
+			if test.wantErr {
+				wantCalls = test.attempts
+			}
+			if calls != wantCalls {
+				t.Errorf("setup called %d times, want %d", calls, wantCalls)
+			}
+
+			var states []ConnectionState
+			for len(conn.State()) > 0 {
+				states = append(states, <-conn.State())
+			}
+			if len(states) != len(test.wantStates) {
+				t.Fatalf("states %v, want %v", states, test.wantStates)
+			}
+			for i := range states {
+				if states[i] != test.wantStates[i] {
+					t.Fatalf("states %v, want %v", states, test.wantStates)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package pmb
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var throttlePrefix = []byte("!throttled ")
+
+// ThrottleFrame is the notice a websocket broker sends a client in place of
+// a message it refused, as "!throttled millis reason".  Brokers only send
+// it to clients that asked for sequence numbers, as older clients don't
+// know what to do with it.
+func ThrottleFrame(retryAfter time.Duration, reason string) []byte {
+	return []byte(fmt.Sprintf("%s%d %s", throttlePrefix, retryAfter/time.Millisecond, reason))
+}
+
+// SplitThrottle is the reverse of ThrottleFrame, returning false if the
+// frame isn't a throttle notice.
+func SplitThrottle(frame []byte) (time.Duration, string, bool) {
+	if !bytes.HasPrefix(frame, throttlePrefix) {
+		return 0, "", false
+	}
+
+	rest := frame[len(throttlePrefix):]
+	reason := ""
+	if space := bytes.IndexByte(rest, ' '); space >= 0 {
+		rest, reason = rest[:space], string(rest[space+1:])
+	}
+
+	millis, err := strconv.ParseInt(string(rest), 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+
+	return time.Duration(millis) * time.Millisecond, reason, true
+}
+
+// RetryAfter sets the Retry-After header, in whole seconds rounded up, for
+// HTTP brokers refusing a message.
+func RetryAfter(header http.Header, retryAfter time.Duration) {
+	header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+}
+
+func retryAfter(header http.Header) time.Duration {
+	seconds, err := strconv.Atoi(header.Get("Retry-After"))
+	if err != nil {
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// throttled tells the user of the connection that the broker refused a
+// message.
+func (conn *Connection) throttled(retryAfter time.Duration, reason string) {
+	logrus.Warningf("Broker throttled a message (%s), retry after %s", reason, retryAfter)
+
+	message := Encode(&Throttled{Reason: reason, RetryAfter: retryAfter.Seconds()})
+	message.Internal = true
+	conn.deliver(message)
+}
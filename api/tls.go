@@ -0,0 +1,107 @@
+package pmb
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// tlsConfig returns the TLS settings for connecting to the broker.
+func (opts connectOptions) tlsConfig() (*tls.Config, error) {
+	return ClientTLSConfig(opts.tlsCA, opts.tlsFingerprint)
+}
+
+// ClientTLSConfig returns the TLS settings for connecting to a broker.  The
+// broker's certificate can be checked against a CA other than the system
+// ones (ca is a PEM file), or pinned by its SHA-256 fingerprint, which is
+// how self-signed certificates are trusted.  Several fingerprints can be
+// given, separated by commas, any of which is accepted.
+// PMB_SSL_INSECURE_SKIP_VERIFY turns checking off altogether.
+func ClientTLSConfig(ca string, fingerprint string) (*tls.Config, error) {
+	cfg := new(tls.Config)
+
+	if len(os.Getenv("PMB_SSL_INSECURE_SKIP_VERIFY")) > 0 {
+		cfg.InsecureSkipVerify = true
+		return cfg, nil
+	}
+
+	if len(ca) > 0 {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read CA: %s", err)
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA file %s", ca)
+		}
+	}
+
+	if len(fingerprint) > 0 {
+		var pins [][]byte
+		for _, f := range strings.Split(fingerprint, ",") {
+			pinned, err := parseFingerprint(strings.TrimSpace(f))
+			if err != nil {
+				return nil, err
+			}
+			pins = append(pins, pinned)
+		}
+
+		// the pin replaces the usual chain checks, so that self-signed
+		// certificates can be used
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("Broker sent no certificate")
+			}
+
+			sum := sha256.Sum256(rawCerts[0])
+			for _, pinned := range pins {
+				if string(sum[:]) == string(pinned) {
+					return nil
+				}
+			}
+
+			return fmt.Errorf("Broker certificate fingerprint %s doesn't match", Fingerprint(rawCerts[0]))
+		}
+	}
+
+	return cfg, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a DER encoded certificate,
+// as colon separated hex.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(parts, ":")
+}
+
+func parseFingerprint(fingerprint string) ([]byte, error) {
+	pinned, err := hex.DecodeString(strings.Replace(fingerprint, ":", "", -1))
+	if err != nil || len(pinned) != sha256.Size {
+		return nil, fmt.Errorf("Invalid SHA-256 fingerprint: %s", fingerprint)
+	}
+
+	return pinned, nil
+}
+
+// httpClient returns a client for talking to an HTTP broker with the given
+// TLS settings.
+func httpClient(cfg *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+
+	return &http.Client{Transport: transport}
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -15,7 +16,16 @@ import (
 	"github.com/Sirupsen/logrus"
 )
 
-// encrypt string to base64'd AES
+// Encrypted messages are sent as a base64'd envelope, which starts with a
+// single header byte that identifies the scheme used to seal the rest.
+const (
+	// AES-GCM, followed by the nonce and then the sealed message
+	envelopeAESGCM byte = 0x02
+)
+
+var errLegacyRejected = errors.New("legacy (unauthenticated) message rejected")
+
+// encrypt string to base64'd AES-GCM envelope
 func encrypt(key []byte, text string) (string, error) {
 	plaintext := []byte(text)
 
@@ -24,27 +34,72 @@ func encrypt(key []byte, text string) (string, error) {
 		return "", err
 	}
 
-	ciphertext := make([]byte, aes.BlockSize+len(plaintext))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
 		return "", err
 	}
 
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(ciphertext[aes.BlockSize:], plaintext)
+	envelope := make([]byte, 1+gcm.NonceSize(), 1+gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	envelope[0] = envelopeAESGCM
+	nonce := envelope[1:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	// the header byte is authenticated too, so it can't be swapped out
+	envelope = gcm.Seal(envelope, nonce, plaintext, envelope[:1])
 
-	return base64.URLEncoding.EncodeToString(ciphertext), nil
+	return base64.URLEncoding.EncodeToString(envelope), nil
 }
 
-// decrypt from base64'd AES
-func decrypt(key []byte, cryptoText string) (string, error) {
-	ciphertext, _ := base64.URLEncoding.DecodeString(cryptoText)
+// decrypt from base64'd envelope, falling back to the legacy AES-CFB scheme
+// if acceptLegacy is set
+func decrypt(key []byte, cryptoText string, acceptLegacy bool) (string, error) {
+	ciphertext, err := base64.URLEncoding.DecodeString(cryptoText)
+	if err != nil {
+		return "", err
+	}
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
 	}
 
+	if len(ciphertext) > 0 && ciphertext[0] == envelopeAESGCM {
+		plaintext, err := decryptGCM(block, ciphertext)
+		if err == nil {
+			return string(plaintext), nil
+		} else if !acceptLegacy {
+			return "", err
+		}
+
+		// a legacy message starts with a random IV, so it can begin
+		// with the header byte by chance
+	}
+
+	if !acceptLegacy {
+		return "", errLegacyRejected
+	}
+
+	return decryptCFB(block, ciphertext)
+}
+
+func decryptGCM(block cipher.Block, envelope []byte) ([]byte, error) {
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(envelope) < 1+gcm.NonceSize()+gcm.Overhead() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce := envelope[1 : 1+gcm.NonceSize()]
+
+	return gcm.Open(nil, nonce, envelope[1+gcm.NonceSize():], envelope[:1])
+}
+
+// decrypt from the legacy AES-CFB scheme, which has no header and no MAC
+func decryptCFB(block cipher.Block, ciphertext []byte) (string, error) {
 	if len(ciphertext) < aes.BlockSize {
 		return "", fmt.Errorf("ciphertext too short")
 	}
@@ -90,6 +145,9 @@ func prepareMessage(message Message, keys []string, id string) ([][]byte, error)
 	message.Contents["ip"] = ip
 	message.Contents["sent"] = time.Now().Format(time.RFC3339)
 
+	// unique per message, so receivers can drop replayed copies
+	message.Contents["message-id"] = GenerateRandomID("message")
+
 	logrus.Debugf("Sending message: %s", message.Contents)
 
 	json, err := json.Marshal(message.Contents)
@@ -118,7 +176,10 @@ func prepareMessage(message Message, keys []string, id string) ([][]byte, error)
 	return bodies, nil
 }
 
-func parseMessage(body []byte, keys []string, ch chan Message, id string) {
+func parseMessage(body []byte, pmbConn *Connection) {
+	keys := pmbConn.Keys
+	id := pmbConn.Id
+
 	var message []byte
 	var rawData interface{}
 	messageWasEncrypted := false
@@ -128,9 +189,11 @@ func parseMessage(body []byte, keys []string, ch chan Message, id string) {
 			logrus.Debugf("Attemping to decrypt with %d keys...", len(keys))
 			decryptedOk := false
 			for _, key := range keys {
-				decrypted, err := decrypt([]byte(key), string(body))
+				decrypted, err := decrypt([]byte(key), string(body), pmbConn.opts.acceptLegacy)
 				if err != nil {
-					logrus.Warningf("Unable to decrypt message!")
+					// as below, a failure is expected for all but
+					// one key when multiple keys exist
+					logrus.Debugf("Unable to decrypt message: %s", err)
 					continue
 				}
 
@@ -171,21 +234,42 @@ func parseMessage(body []byte, keys []string, ch chan Message, id string) {
 		}
 	}
 
-	data := rawData.(map[string]interface{})
+	data, ok := rawData.(map[string]interface{})
+	if !ok {
+		logrus.Debugf("Message isn't a JSON object, skipping.")
+		return
+	}
 
-	senderId := data["id"].(string)
+	senderId, _ := data["id"].(string)
+	if len(senderId) == 0 {
+		logrus.Warningf("Message without a sender id detected, discarding...")
+		return
+	}
 
 	// only RequestAuth messages are allowed to be unencrypted
-	if !messageWasEncrypted && data["type"].(string) != "RequestAuth" {
+	if messageType, _ := data["type"].(string); !messageWasEncrypted && messageType != "RequestAuth" {
 		logrus.Warningf("Unencrypted message that wasn't RequestAuth detected, discarding...")
 		return
 	}
 
 	// hide messages from ourselves
-	if senderId != id {
-		logrus.Debugf("Message received: %s", data)
-		ch <- Message{Contents: data, Raw: string(message)}
-	} else {
+	if senderId == id {
 		logrus.Debugf("Message received but ignored: %s", data)
+		return
+	}
+
+	if err := checkFresh(data, pmbConn.opts.replayWindow); err != nil {
+		logrus.Warningf("Stale message detected (%s), discarding...", err)
+		return
 	}
+
+	// the same message arrives once per key when multiple keys are in use,
+	// so a repeated id isn't necessarily an attack
+	if messageID, ok := data["message-id"].(string); ok && pmbConn.seen.seenBefore(messageID, pmbConn.opts.replayWindow) {
+		logrus.Debugf("Duplicate message %s received, discarding...", messageID)
+		return
+	}
+
+	logrus.Debugf("Message received: %s", data)
+	pmbConn.deliver(Message{Contents: data, Raw: string(message)})
 }
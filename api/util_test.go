@@ -0,0 +1,131 @@
+package pmb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"testing"
+)
+
+const (
+	testKey  = "0123456789abcdef0123456789abcdef"
+	otherKey = "fedcba9876543210fedcba9876543210"
+	testText = `{"type":"Notification","message":"hello"}`
+)
+
+// encryptCFB seals text as clients did before AES-GCM, with a random-looking
+// IV and no MAC.
+func encryptCFB(t *testing.T, key []byte, text string) string {
+	t.Helper()
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext := make([]byte, aes.BlockSize+len(text))
+	copy(ciphertext, "an iv, not 0x02.")
+	cipher.NewCFBEncrypter(block, ciphertext[:aes.BlockSize]).XORKeyStream(ciphertext[aes.BlockSize:], []byte(text))
+
+	return base64.URLEncoding.EncodeToString(ciphertext)
+}
+
+// tamper flips a bit in the sealed message, past the header and nonce.
+func tamper(t *testing.T, cryptoText string) string {
+	t.Helper()
+
+	envelope, err := base64.URLEncoding.DecodeString(cryptoText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope[len(envelope)-20] ^= 0x01
+
+	return base64.URLEncoding.EncodeToString(envelope)
+}
+
+func TestDecrypt(t *testing.T) {
+	sealed, err := encrypt([]byte(testKey), testText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := encryptCFB(t, []byte(testKey), testText)
+
+	tests := []struct {
+		name         string
+		cryptoText   string
+		key          string
+		acceptLegacy bool
+		// whether the original text comes back, and whether an error
+		// does, which aren't opposites: a legacy message decrypted
+		// with the wrong key comes back as garbage, without an error
+		wantText bool
+		wantErr  bool
+	}{
+		{name: "sealed", cryptoText: sealed, key: testKey, wantText: true},
+		{name: "sealed, legacy accepted", cryptoText: sealed, key: testKey, acceptLegacy: true, wantText: true},
+		{name: "tampered", cryptoText: tamper(t, sealed), key: testKey, wantErr: true},
+		{name: "tampered, legacy accepted", cryptoText: tamper(t, sealed), key: testKey, acceptLegacy: true},
+		{name: "wrong key", cryptoText: sealed, key: otherKey, wantErr: true},
+		{name: "wrong key, legacy accepted", cryptoText: sealed, key: otherKey, acceptLegacy: true},
+		{name: "truncated", cryptoText: sealed[:16], key: testKey, wantErr: true},
+		{name: "legacy", cryptoText: legacy, key: testKey, wantErr: true},
+		{name: "legacy, accepted", cryptoText: legacy, key: testKey, acceptLegacy: true, wantText: true},
+		{name: "legacy, accepted, wrong key", cryptoText: legacy, key: otherKey, acceptLegacy: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text, err := decrypt([]byte(test.key), test.cryptoText, test.acceptLegacy)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("decrypt() error = %v, want error: %t", err, test.wantErr)
+			}
+			if (text == testText) != test.wantText {
+				t.Errorf("decrypt() = %q, want the original text: %t", text, test.wantText)
+			}
+		})
+	}
+}
+
+func TestDecryptRejectsLegacyByDefault(t *testing.T) {
+	legacy := encryptCFB(t, []byte(testKey), testText)
+
+	if _, err := decrypt([]byte(testKey), legacy, false); err != errLegacyRejected {
+		t.Errorf("decrypt() error = %v, want %v", err, errLegacyRejected)
+	}
+}
+
+func TestEncryptUsesFreshNonces(t *testing.T) {
+	first, err := encrypt([]byte(testKey), testText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := encrypt([]byte(testKey), testText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first == second {
+		t.Errorf("the same text encrypted twice gave the same envelope")
+	}
+}
+
+func TestAcceptLegacyConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config PMBConfig
+		want   bool
+	}{
+		{name: "unset", config: PMBConfig{}, want: false},
+		{name: "on", config: PMBConfig{"accept-legacy": "true"}, want: true},
+		{name: "off", config: PMBConfig{"accept-legacy": "false"}, want: false},
+		{name: "invalid", config: PMBConfig{"accept-legacy": "sometimes"}, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.config.connectOptions().acceptLegacy; got != test.want {
+				t.Errorf("acceptLegacy = %t, want %t", got, test.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package pmb
 
 import (
+	"context"
+	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -14,20 +17,35 @@ const (
 	maxMessageSize = 256 * 1024
 )
 
-func connectWS(URI string, id string, sub string) (*Connection, error) {
-
-	in := make(chan Message, 10)
-	out := make(chan Message, 10)
+func connectWS(ctx context.Context, URI string, id string, sub string, opts connectOptions) (*Connection, error) {
 
 	done := make(chan error)
 
-	conn := &Connection{In: in, Out: out, uri: URI, prefix: "", Id: id}
+	brokers, err := parseBrokers(URI)
+	if err != nil {
+		return nil, err
+	}
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("No broker URI given")
+	}
+
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := newConnection(ctx, brokers[0].uri, "", id, opts)
+	conn.brokers = brokers
+	conn.useBroker(0)
+	conn.tlsConfig = tlsConfig
 
 	logrus.Debugf("calling listen/send WS")
+	conn.wg.Add(1)
 	go openWS(conn, done, id)
 
-	err := <-done
+	err = <-done
 	if err != nil {
+		conn.cancel()
 		return nil, err
 	}
 
@@ -35,9 +53,16 @@ func connectWS(URI string, id string, sub string) (*Connection, error) {
 }
 
 func openWS(pmbConn *Connection, done chan error, id string) {
+	defer pmbConn.wg.Done()
 
+	// try each broker once, before giving up
 	logrus.Debugf("calling connectSocket")
-	conn, err := connectSocket(pmbConn.uri)
+	conn, err := connectSocket(pmbConn)
+	for i := 1; err != nil && i < len(pmbConn.brokers); i++ {
+		logrus.Warningf("Unable to connect to broker %s: %s", pmbConn.uri, err)
+		pmbConn.failover()
+		conn, err = connectSocket(pmbConn)
+	}
 
 	if err != nil {
 		done <- err
@@ -49,42 +74,61 @@ func openWS(pmbConn *Connection, done chan error, id string) {
 	for {
 		processSocket(pmbConn, conn, id)
 
-		conn, err = connectSocketForever(pmbConn.uri)
+		if pmbConn.ctx.Err() != nil {
+			logrus.Debugf("websocket closed")
+			return
+		}
+
+		pmbConn.setState(Disconnected)
+		conn, err = connectSocketWithRetry(pmbConn)
 
 		if err != nil {
 			logrus.Errorf("Unable to reconnect, exiting... %s", err)
 			return
 		} else {
-			pmbConn.In <- Message{
-				Contents: map[string]interface{}{"type": "Reconnected"},
-				Internal: true,
-			}
+			pmbConn.deliver(reconnectedMessage())
 			logrus.Infof("Reconnected.")
 		}
 	}
 
 }
 
-func connectSocketForever(uri string) (*websocket.Conn, error) {
-
-	for {
-		conn, err := connectSocket(uri)
+func connectSocketWithRetry(pmbConn *Connection) (*websocket.Conn, error) {
+	var conn *websocket.Conn
 
-		if err == nil {
-			return conn, nil
+	err := pmbConn.retry("Listen setup", func() error {
+		var err error
+		conn, err = connectSocket(pmbConn)
+		if err != nil {
+			pmbConn.failover()
 		}
+		return err
+	})
 
-		logrus.Warningf("Listen setup failed, sleeping and then re-trying")
-		time.Sleep(1 * time.Second)
-	}
+	return conn, err
 }
 
-func connectSocket(uri string) (*websocket.Conn, error) {
-	c, _, err := websocket.DefaultDialer.Dial(uri, nil)
+func connectSocket(pmbConn *Connection) (*websocket.Conn, error) {
+	// the broker only forwards messages for the destinations we bind, and
+	// replays what we missed
+	uri, err := pmbConn.brokerURI(pmbConn.uri)
 	if err != nil {
 		return nil, err
 	}
 
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = pmbConn.tlsConfig
+
+	c, res, err := dialer.Dial(uri, pmbConn.authorize(nil))
+	if err != nil {
+		if res != nil && (res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden) {
+			return nil, fmt.Errorf("Broker refused access: %s", res.Status)
+		}
+		return nil, err
+	}
+
+	pmbConn.heard()
+
 	c.SetReadLimit(maxMessageSize)
 	c.SetReadDeadline(time.Now().Add(pongWait))
 	c.SetPongHandler(func(string) error {
@@ -100,6 +144,7 @@ func processSocket(pmbConn *Connection, conn *websocket.Conn, id string) {
 	logrus.Debugf("start of processSocket")
 
 	done := make(chan struct{})
+	writerDone := make(chan struct{})
 
 	// Start up reader side of socket
 	go func() {
@@ -107,14 +152,24 @@ func processSocket(pmbConn *Connection, conn *websocket.Conn, id string) {
 		for {
 			messageType, message, err := conn.ReadMessage()
 			if err != nil {
-				logrus.Errorf("error reading: %v", err)
+				if pmbConn.ctx.Err() == nil {
+					logrus.Errorf("error reading: %v", err)
+				}
 				return
 			}
 
 			logrus.Debugf("WS received message of type: %d", messageType)
 			if messageType == websocket.TextMessage {
 				logrus.Debugf("message: %s", string(message))
-				parseMessage(message, pmbConn.Keys, pmbConn.In, id)
+				if retryAfter, reason, ok := SplitThrottle(message); ok {
+					pmbConn.throttled(retryAfter, reason)
+					continue
+				}
+
+				seq, body := SplitSequence(message)
+				pmbConn.received(seq)
+				pmbConn.heard()
+				pmbConn.receive(SplitFrame(body))
 			}
 		}
 	}()
@@ -125,14 +180,20 @@ func processSocket(pmbConn *Connection, conn *websocket.Conn, id string) {
 		defer func() {
 			ticker.Stop()
 			conn.Close()
+			close(writerDone)
 		}()
 		for {
 			select {
 			case <-done:
 				logrus.Infof("exiting writer side of socket")
 				return
+			case <-pmbConn.ctx.Done():
+				logrus.Debugf("closing websocket")
+				conn.SetWriteDeadline(time.Now().Add(writeWait))
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
 			case message := <-pmbConn.Out:
-				bodies, err := prepareMessage(message, pmbConn.Keys, id)
+				bodies, err := pmbConn.bodies(message, id)
 				if err != nil {
 					logrus.Warningf("Error preparing message: %s", err)
 					continue
@@ -140,17 +201,14 @@ func processSocket(pmbConn *Connection, conn *websocket.Conn, id string) {
 
 				for _, body := range bodies {
 					conn.SetWriteDeadline(time.Now().Add(writeWait))
-					err = conn.WriteMessage(websocket.TextMessage, body)
+					err = conn.WriteMessage(websocket.TextMessage, RouteFrame(destination(message), body))
 					if err != nil {
-						logrus.Errorf("error writing:", err)
+						logrus.Errorf("error writing: %s", err)
 						return
 					}
 				}
 
-				if message.Done != nil {
-					logrus.Debugf("Done channel present, sending message")
-					message.Done <- nil
-				}
+				pmbConn.sent(message, nil)
 			case <-ticker.C:
 				conn.SetWriteDeadline(time.Now().Add(writeWait))
 				logrus.Debugf("sending ping")
@@ -162,4 +220,5 @@ func processSocket(pmbConn *Connection, conn *websocket.Conn, id string) {
 	}()
 
 	<-done
+	<-writerDone
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/justone/pmb/api"
+)
+
+type BridgeCommand struct {
+	WS     string        `long:"ws" description:"Websocket (or HTTP) broker URI to bridge." required:"true"`
+	AMQP   string        `long:"amqp" description:"AMQP URI to bridge." required:"true"`
+	Routes []string      `long:"route" description:"Map a destination on the websocket side to a routing key on the AMQP side, as destination=key.  May be given more than once."`
+	Window time.Duration `long:"dedupe-window" description:"How long to remember forwarded messages, to stop them coming back." default:"5m"`
+}
+
+var bridgeCommand BridgeCommand
+
+func (x *BridgeCommand) Execute(args []string) error {
+	toAMQP, toWS, err := parseRoutes(bridgeCommand.Routes)
+	if err != nil {
+		return err
+	}
+
+	id := pmb.GenerateRandomID("bridge")
+
+	wsConn, err := pmb.GetPMB(bridgeCommand.WS).ConnectRaw(id)
+	if err != nil {
+		return err
+	}
+
+	amqpConn, err := pmb.GetPMB(bridgeCommand.AMQP).ConnectRaw(id)
+	if err != nil {
+		wsConn.Close()
+		return err
+	}
+
+	return runBridge(wsConn, amqpConn, toAMQP, toWS, newBodyCache(bridgeCommand.Window))
+}
+
+func init() {
+	parser.AddCommand("bridge",
+		"Forward messages between a websocket broker and AMQP.",
+		"Joins a websocket realm and an AMQP exchange, and forwards messages both ways without decrypting them, so no key is needed.  Messages are remembered for the dedupe window, and not forwarded again if they come back, so bridges can't loop.  Only the main channel is bridged, not those of sub-clients such as streams.",
+		&bridgeCommand)
+}
+
+// parseRoutes returns the destination mappings in each direction.
+func parseRoutes(routes []string) (map[string]string, map[string]string, error) {
+	toAMQP := make(map[string]string)
+	toWS := make(map[string]string)
+
+	for _, route := range routes {
+		parts := strings.SplitN(route, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, nil, fmt.Errorf("Bad route %s, expected destination=key", route)
+		}
+
+		toAMQP[parts[0]] = parts[1]
+		toWS[parts[1]] = parts[0]
+	}
+
+	return toAMQP, toWS, nil
+}
+
+func runBridge(wsConn, amqpConn *pmb.Connection, toAMQP, toWS map[string]string, seen *bodyCache) error {
+	defer wsConn.Close()
+	defer amqpConn.Close()
+
+	logrus.Infof("Bridging messages")
+
+	for {
+		select {
+		case message := <-wsConn.In:
+			forward(message, amqpConn, toAMQP, seen, "AMQP")
+		case message := <-amqpConn.In:
+			forward(message, wsConn, toWS, seen, "websocket")
+		case <-wsConn.Done():
+			return fmt.Errorf("Websocket connection closed")
+		case <-amqpConn.Done():
+			return fmt.Errorf("AMQP connection closed")
+		}
+	}
+}
+
+func forward(message pmb.Message, to *pmb.Connection, routes map[string]string, seen *bodyCache, name string) {
+	if message.Internal {
+		logrus.Debugf("Skipping %s message", message.Type())
+		return
+	}
+
+	// anything forwarded comes back from the other side, as the bridge
+	// receives everything, including what it sends
+	if !seen.first(message.Body) {
+		logrus.Debugf("Already forwarded message to %s, skipping", message.Destination)
+		return
+	}
+
+	destination := message.Destination
+	if mapped, ok := routes[destination]; ok {
+		destination = mapped
+	}
+
+	logrus.Debugf("Forwarding message to %s on %s", destination, name)
+	to.Out <- pmb.Message{Body: message.Body, Destination: destination}
+}
+
+// bodyCache remembers the hashes of message bodies for a while.
+type bodyCache struct {
+	sync.Mutex
+	window time.Duration
+	seen   map[[sha256.Size]byte]time.Time
+	pruned time.Time
+}
+
+func newBodyCache(window time.Duration) *bodyCache {
+	return &bodyCache{
+		window: window,
+		seen:   make(map[[sha256.Size]byte]time.Time),
+		pruned: time.Now(),
+	}
+}
+
+// first reports whether the body hasn't been seen within the window, and
+// remembers it.
+func (c *bodyCache) first(body []byte) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.pruned) > c.window {
+		for hash, at := range c.seen {
+			if now.Sub(at) > c.window {
+				delete(c.seen, hash)
+			}
+		}
+		c.pruned = now
+	}
+
+	hash := sha256.Sum256(body)
+	if at, ok := c.seen[hash]; ok && now.Sub(at) <= c.window {
+		return false
+	}
+	c.seen[hash] = now
+
+	return true
+}
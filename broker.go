@@ -2,16 +2,41 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/justone/pmb/api"
 )
 
 type BrokerCommand struct {
 	Address string `short:"a" long:"address" description:"Address to listen on" default:":3000"`
+	Config  string `short:"c" long:"config" description:"Config file with access tokens for each realm"`
+
+	TLSCert       string `long:"tls-cert" description:"Certificate file, to serve over TLS"`
+	TLSKey        string `long:"tls-key" description:"Key file for the certificate"`
+	TLSSelfSigned bool   `long:"tls-self-signed" description:"Serve over TLS with a generated self-signed certificate (for testing)"`
+
+	HistorySize int           `long:"history-size" description:"Number of messages to keep in each realm for replay" default:"100"`
+	HistoryAge  time.Duration `long:"history-age" description:"How long to keep messages for replay" default:"10m"`
+	DataDir     string        `long:"data-dir" description:"Directory to store realm history in, so that it survives restarts"`
+
+	ClientRate     float64 `long:"client-rate" description:"Messages per second each client may publish, 0 for no limit"`
+	ClientBytes    float64 `long:"client-bytes" description:"Bytes per second each client may publish, 0 for no limit"`
+	RealmRate      float64 `long:"realm-rate" description:"Messages per second that may be published in each realm, 0 for no limit"`
+	RealmBytes     float64 `long:"realm-bytes" description:"Bytes per second that may be published in each realm, 0 for no limit"`
+	MaxMessageSize int     `long:"max-message-size" description:"Largest message that may be published, in bytes, up to 262144" default:"262144"`
+
+	Backpressure string `long:"backpressure" description:"What to do with slow clients: drop-oldest, drop-newest, block-timeout[:duration] or disconnect" default:"disconnect"`
+
+	ShutdownTimeout time.Duration `long:"shutdown-timeout" description:"How long to wait for clients to be disconnected on shutdown" default:"10s"`
 }
 
 var brokerCommand BrokerCommand
@@ -28,68 +53,214 @@ var (
 	space   = []byte{' '}
 )
 
+// A Broker runs a single realm.  Its clients map is only touched by its own
+// goroutine, everything else asks it to do things over its channels.
 type Broker struct {
-	clients map[*Client]bool
-	send    chan []byte
-	add     chan *Client
-	remove  chan *Client
-	done    bool
+	clients   map[*Client]bool
+	send      chan realmMessage
+	add       chan *Client
+	remove    chan *Client
+	snapshots chan chan realmSnapshot
+
+	// retire asks the broker to stop if it is idle, and stop tells it to
+	// disconnect its clients and stop regardless
+	retire chan chan bool
+	stop   chan struct{}
+
+	// closed once run has returned, so that clients still holding the
+	// broker don't block on it
+	done chan struct{}
+
+	seq          uint64
+	history      *history
+	stats        *realmStats
+	backpressure backpressure
+	cluster      *cluster
 }
 
-func newBroker() *Broker {
+func newBroker(realm string, history *history, bp backpressure, cluster *cluster) *Broker {
 	return &Broker{
-		clients: make(map[*Client]bool),
-		send:    make(chan []byte),
-		add:     make(chan *Client),
-		remove:  make(chan *Client),
-		done:    false,
+		clients:      make(map[*Client]bool),
+		send:         make(chan realmMessage),
+		add:          make(chan *Client),
+		remove:       make(chan *Client),
+		snapshots:    make(chan chan realmSnapshot),
+		retire:       make(chan chan bool),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+		seq:          history.lastSeq(),
+		history:      history,
+		stats:        stats.realm(realm),
+		backpressure: bp,
+		cluster:      cluster,
 	}
 }
 
 func (b *Broker) run() {
+	defer close(b.done)
+
 	for {
-		if b.done {
-			break
-		}
 		select {
 		case client := <-b.add:
 			b.clients[client] = true
+			b.stats.connect()
+			b.replay(client)
 		case client := <-b.remove:
 			if _, ok := b.clients[client]; ok {
-				delete(b.clients, client)
-				close(client.send)
+				b.disconnect(client, websocket.CloseNormalClosure, "")
+				b.stats.disconnect()
 			}
+		case reply := <-b.snapshots:
+			reply <- b.snapshot()
 		case message := <-b.send:
+			b.stats.message(len(message.message))
+			b.seq++
+			entry := historyEntry{
+				seq:         b.seq,
+				at:          time.Now(),
+				destination: message.destination,
+				message:     message.message,
+			}
+			b.history.add(entry)
+
 			for client := range b.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(b.clients, client)
-				}
+				b.deliver(client, entry)
+			}
+
+			if !message.remote {
+				b.cluster.publish(message)
+			}
+		case reply := <-b.retire:
+			idle := len(b.clients) == 0 && b.history.empty()
+			reply <- idle
+			if idle {
+				b.history.retire()
+				return
+			}
+		case <-b.stop:
+			for client := range b.clients {
+				b.disconnect(client, websocket.CloseGoingAway, "broker shutting down")
 			}
+			b.history.close()
+			return
+		}
+	}
+}
+
+// publish and leave are for the client goroutines, which may outlive the
+// broker if it drops them.
+func (b *Broker) publish(message realmMessage) {
+	select {
+	case b.send <- message:
+	case <-b.done:
+	}
+}
+
+func (b *Broker) leave(client *Client) {
+	select {
+	case b.remove <- client:
+	case <-b.done:
+	}
+}
+
+// disconnect removes a client, which sends it a close frame with the given
+// code and reason.
+func (b *Broker) disconnect(client *Client, code int, reason string) {
+	delete(b.clients, client)
+	client.closeCode = code
+	client.closeReason = reason
+	close(client.send)
+}
+
+// replay sends a newly added client the history it asked for.
+func (b *Broker) replay(client *Client) {
+	if !client.replay.wanted {
+		return
+	}
+
+	entries := b.history.since(client.replay)
+	logrus.Debugf("Replaying %d message(s) to new client", len(entries))
+
+	for _, entry := range entries {
+		if !b.deliver(client, entry) {
+			return
 		}
 	}
 }
 
+// deliver sends an entry to a client if it wants it, applying the realm's
+// backpressure policy if the client has fallen too far behind.  It returns
+// false if the client was disconnected.
+func (b *Broker) deliver(client *Client, entry historyEntry) bool {
+	if !pmb.Wants(client.bindings, entry.destination) {
+		return true
+	}
+
+	// clients that understand sequence numbers also get the destination,
+	// which bridges need to forward the message on
+	message := entry.message
+	if client.replay.sequenced {
+		message = pmb.SequenceFrame(entry.seq, pmb.RouteFrame(entry.destination, message))
+	}
+
+	select {
+	case client.send <- message:
+		return true
+	default:
+		return b.overflow(client, message)
+	}
+}
+
 type Client struct {
 	realm  string
 	broker *Broker
 	conn   *websocket.Conn
 	send   chan []byte
+
+	// the destinations this client receives, empty for clients that
+	// predate destinations and so receive everything
+	bindings []string
+
+	replay replayRequest
+
+	// messages dropped by the backpressure policy
+	dropped uint64
+
+	// the limits on what the client publishes, and notices for it when
+	// they refuse a message
+	limits     *brokerLimits
+	limiter    *limiter
+	notices    chan []byte
+	throttling bool
+
+	remote    string
+	connected time.Time
+
+	// set by the broker before it closes send, for the close frame
+	closeCode   int
+	closeReason string
 }
 
-func newClient(realm string, conn *websocket.Conn) *Client {
+// newClient creates a client with the bindings and replay request from the
+// request it connected with.
+func newClient(realm string, conn *websocket.Conn, r *http.Request) *Client {
+	query := r.URL.Query()
+
 	return &Client{
-		realm: realm,
-		conn:  conn,
-		send:  make(chan []byte, 256),
+		realm:     realm,
+		conn:      conn,
+		send:      make(chan []byte, 256),
+		notices:   make(chan []byte, 16),
+		bindings:  pmb.ParseBindings(query),
+		replay:    parseReplay(query),
+		remote:    r.RemoteAddr,
+		connected: time.Now(),
 	}
 }
 
 func (c *Client) processReads() {
 	defer func() {
-		c.broker.remove <- c
+		c.broker.leave(c)
 		c.conn.Close()
 	}()
 
@@ -110,7 +281,14 @@ func (c *Client) processReads() {
 		}
 		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
 
-		c.broker.send <- message
+		destination, body := pmb.SplitFrame(message)
+		if wait, reason := c.limits.allow(c.realm, c.limiter, len(body)); len(reason) > 0 {
+			c.throttle(wait, reason)
+			continue
+		}
+		c.throttling = false
+
+		c.broker.publish(realmMessage{realm: c.realm, destination: destination, message: body})
 	}
 }
 
@@ -126,7 +304,7 @@ func (c *Client) processWrites() {
 		case message, ok := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeReason))
 				return
 			}
 
@@ -139,6 +317,11 @@ func (c *Client) processWrites() {
 			if err := w.Close(); err != nil {
 				return
 			}
+		case notice := <-c.notices:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, notice); err != nil {
+				return
+			}
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
@@ -148,85 +331,344 @@ func (c *Client) processWrites() {
 	}
 }
 
-func (c *Client) start() {
-	go c.processWrites()
-	go c.processReads()
+// throttle tells the client that a message it published was refused.  Only
+// the first of a run of refused messages is logged.
+func (c *Client) throttle(wait time.Duration, reason string) {
+	c.broker.stats.throttle()
+	if !c.throttling {
+		logrus.Infof("Throttling client %s in realm %s: %s", c.remote, c.realm, reason)
+		c.throttling = true
+	}
+
+	// clients that don't understand sequence numbers don't understand
+	// notices either
+	if !c.replay.sequenced {
+		return
+	}
+
+	// a client with a full queue of notices isn't reading them anyway
+	select {
+	case c.notices <- pmb.ThrottleFrame(wait, reason):
+	default:
+	}
 }
 
-func allowAllOrigins(r *http.Request) bool {
-	return true
+// start runs the client's goroutines, counting the writer in writers so that
+// shutdown can wait for close frames to go out.
+func (c *Client) start(writers *sync.WaitGroup) {
+	writers.Add(1)
+	go func() {
+		defer writers.Done()
+		c.processWrites()
+	}()
+	go c.processReads()
 }
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin:     allowAllOrigins,
 }
 
-func runBrokerManager() chan *Client {
-	receiver := make(chan *Client)
+// realmMessage is a message published into a realm, either by a websocket
+// client or an HTTP POST.
+type realmMessage struct {
+	realm       string
+	destination string
+	message     []byte
+
+	// came from a peer, rather than being published on this broker
+	remote bool
+}
+
+type brokerManager struct {
+	register   chan *Client
+	unregister chan *Client
+	publish    chan realmMessage
+	snapshots  chan chan map[string]realmSnapshot
+	stop       chan chan struct{}
+	limits     *brokerLimits
 
-	go func(receiver chan *Client) {
+	// closed once the manager has stopped, after which nothing more is
+	// accepted
+	done chan struct{}
+
+	// the websocket writers, so that shutdown can wait for them
+	writers sync.WaitGroup
+}
+
+func runBrokerManager(store *brokerStore, config *brokerConfig, bp backpressure, limits *brokerLimits, cluster *cluster) *brokerManager {
+	manager := &brokerManager{
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		publish:    make(chan realmMessage),
+		snapshots:  make(chan chan map[string]realmSnapshot),
+		stop:       make(chan chan struct{}),
+		done:       make(chan struct{}),
+		limits:     limits,
+	}
+
+	go func(manager *brokerManager) {
 		brokers := make(map[string]*Broker)
 		ticker := time.NewTicker(6 * time.Second)
 		defer func() {
 			ticker.Stop()
+			close(manager.done)
 		}()
 
+		getBroker := func(realm string) *Broker {
+			broker, ok := brokers[realm]
+			if !ok {
+				broker = newBroker(realm, store.history(realm), config.backpressure(realm, bp), cluster)
+				brokers[realm] = broker
+				go broker.run()
+			}
+
+			return broker
+		}
+
+		// bring back the realms with stored history, so that it can be
+		// replayed to clients reconnecting after a restart
+		for _, realm := range store.realms() {
+			logrus.Infof("Loading history for realm %s", realm)
+			getBroker(realm)
+		}
+
 		for {
 			select {
-			case c, ok := <-receiver:
-				if !ok {
-					return
-				}
+			case c := <-manager.register:
+				c.broker = getBroker(c.realm)
+				c.broker.add <- c
 
-				broker, ok := brokers[c.realm]
-				if !ok {
-					broker = newBroker()
-					brokers[c.realm] = broker
-					go broker.run()
+				// HTTP pollers have no socket, their messages are
+				// picked up by the long-poll handler instead
+				if c.conn != nil {
+					c.limits = manager.limits
+					c.limiter = manager.limits.client()
+					c.start(&manager.writers)
 				}
-
-				c.broker = broker
-				c.broker.add <- c
-				c.start()
+			case c := <-manager.unregister:
+				// only remove from a broker that is still running, a
+				// retired broker has already dropped all its clients
+				if broker, ok := brokers[c.realm]; ok && broker == c.broker {
+					broker.remove <- c
+				}
+			case rm := <-manager.publish:
+				if broker, ok := brokers[rm.realm]; ok {
+					broker.send <- rm
+				} else if store.size > 0 {
+					// keep the message for clients that connect later
+					getBroker(rm.realm).send <- rm
+				} else {
+					logrus.Debugf("No clients in realm %s, dropping message.", rm.realm)
+				}
+			case reply := <-manager.snapshots:
+				snapshot := make(map[string]realmSnapshot)
+				for realm, broker := range brokers {
+					brokerReply := make(chan realmSnapshot)
+					broker.snapshots <- brokerReply
+					snapshot[realm] = <-brokerReply
+				}
+				reply <- snapshot
 			case <-ticker.C:
 				logrus.Debugf("Checking for expired brokers")
 				for realm, broker := range brokers {
 					logrus.Debugf("Checking %s", realm)
-					if len(broker.clients) == 0 {
+					idle := make(chan bool)
+					broker.retire <- idle
+					if <-idle {
 						logrus.Debugf("Broker %s has no clients, retiring.", realm)
-						broker.done = true
 						delete(brokers, realm)
 					}
 				}
+				stats.retain(brokers)
+			case reply := <-manager.stop:
+				logrus.Infof("Stopping %d realm(s)", len(brokers))
+				for _, broker := range brokers {
+					close(broker.stop)
+				}
+				for _, broker := range brokers {
+					<-broker.done
+				}
+				close(reply)
+				return
 			}
 		}
 
-	}(receiver)
+	}(manager)
+
+	return manager
+}
+
+// join adds a client to its realm, returning false if the broker is
+// shutting down.
+func (manager *brokerManager) join(c *Client) bool {
+	select {
+	case manager.register <- c:
+		return true
+	case <-manager.done:
+		return false
+	}
+}
+
+func (manager *brokerManager) leave(c *Client) {
+	select {
+	case manager.unregister <- c:
+	case <-manager.done:
+	}
+}
 
-	return receiver
+// send publishes into a realm, returning false if the broker is shutting
+// down.
+func (manager *brokerManager) send(rm realmMessage) bool {
+	select {
+	case manager.publish <- rm:
+		return true
+	case <-manager.done:
+		return false
+	}
+}
+
+// shutdown stops every realm, which sends each websocket client a close
+// frame and closes the stored history, and then waits for the close frames
+// to be written or ctx to expire.
+func (manager *brokerManager) shutdown(ctx context.Context) error {
+	reply := make(chan struct{})
+	select {
+	case manager.stop <- reply:
+		<-reply
+	case <-manager.done:
+	}
+
+	written := make(chan struct{})
+	go func() {
+		manager.writers.Wait()
+		close(written)
+	}()
+
+	select {
+	case <-written:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (x *BrokerCommand) Execute(args []string) error {
 	logrus.Debugf("Running Broker")
 
-	brokerReceiver := runBrokerManager()
+	var config *brokerConfig
+	if len(brokerCommand.Config) > 0 {
+		var err error
+		config, err = loadBrokerConfig(brokerCommand.Config)
+		if err != nil {
+			return err
+		}
+	} else {
+		logrus.Warnf("No config given, any client can join any realm")
+	}
+	upgrader.CheckOrigin = config.checkOrigin
+
+	store, err := newBrokerStore(brokerCommand.DataDir, brokerCommand.HistorySize, brokerCommand.HistoryAge)
+	if err != nil {
+		return err
+	}
+
+	bp, err := parseBackpressure(brokerCommand.Backpressure)
+	if err != nil {
+		return err
+	}
+
+	rateLimits, err := newBrokerLimits(limits{
+		clientRate:  brokerCommand.ClientRate,
+		clientBytes: brokerCommand.ClientBytes,
+		realmRate:   brokerCommand.RealmRate,
+		realmBytes:  brokerCommand.RealmBytes,
+		maxSize:     brokerCommand.MaxMessageSize,
+	})
+	if err != nil {
+		return err
+	}
+
+	cluster := newCluster(config)
+	manager := runBrokerManager(store, config, bp, rateLimits, cluster)
+
+	clusterCtx, stopCluster := context.WithCancel(context.Background())
+	defer stopCluster()
+	cluster.start(clusterCtx, manager)
+	pollers := newPollers(manager)
 
 	r := mux.NewRouter()
 
-	r.HandleFunc("/pmb/{category}/", func(w http.ResponseWriter, r *http.Request) {
+	r.HandleFunc("/pmb/{category}/", config.requireToken(func(w http.ResponseWriter, r *http.Request) {
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			logrus.Warnf("Error: %v", err)
 			return
 		}
 
-		client := newClient(r.URL.Path, conn)
-		brokerReceiver <- client
-	})
+		client := newClient(r.URL.Path, conn, r)
+		if !manager.join(client) {
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "broker shutting down"),
+				time.Now().Add(writeWait))
+			conn.Close()
+		}
+	}))
+
+	r.HandleFunc("/pmb/{category}", config.requireToken(pollers.handlePublish)).Methods("POST")
+	r.HandleFunc("/pmb/{category}/{id}", config.requireToken(pollers.handlePoll)).Methods("GET")
+
+	r.HandleFunc("/admin/realms", config.requireAdmin(manager.handleRealms)).Methods("GET")
+	r.HandleFunc("/admin/clients", config.requireAdmin(manager.handleClients)).Methods("GET")
+	r.HandleFunc("/peer/", cluster.handlePeer)
+	r.HandleFunc("/admin/peers", config.requireAdmin(cluster.handlePeers)).Methods("GET")
+	r.HandleFunc("/metrics", config.requireAdmin(manager.handleMetrics)).Methods("GET")
+
+	tlsConfig, err := brokerTLSConfig(brokerCommand.TLSCert, brokerCommand.TLSKey, brokerCommand.TLSSelfSigned)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Addr:      brokerCommand.Address,
+		Handler:   r,
+		TLSConfig: tlsConfig,
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		sig := <-signals
+		signal.Stop(signals)
+
+		logrus.Infof("Received %s, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), brokerCommand.ShutdownTimeout)
+		defer cancel()
+
+		// stopping the realms first ends the long polls, which Shutdown
+		// would otherwise wait on
+		stopCluster()
+		err := manager.shutdown(ctx)
+		if serr := server.Shutdown(ctx); err == nil {
+			err = serr
+		}
+		stopped <- err
+	}()
 
-	logrus.Warnf("Error: %v", http.ListenAndServe(brokerCommand.Address, r))
+	if tlsConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+
+	if err := <-stopped; err != nil {
+		logrus.Warnf("Unclean shutdown: %v", err)
+	}
+	logrus.Infof("Broker stopped")
 
 	return nil
 }
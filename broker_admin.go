@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// realmStats counts what happens in a realm.  They are forgotten along with
+// the realm once it's retired, so that the metrics don't list every realm
+// there has ever been.  A realm that comes back starts counting from zero
+// again, which Prometheus takes as a counter reset.
+type realmStats struct {
+	sync.Mutex
+	messages    uint64
+	bytes       uint64
+	dropped     uint64
+	connects    uint64
+	disconnects uint64
+
+	// what the backpressure policy did: messages it dropped, and times
+	// it had to wait for a client
+	droppedMessages uint64
+	blocked         uint64
+
+	// messages refused for going over a rate limit or quota
+	throttled uint64
+
+	// messages in each of the last 60 seconds, for the current rate
+	recent   [60]uint64
+	recentAt [60]int64
+}
+
+type brokerStats struct {
+	sync.Mutex
+	realms map[string]*realmStats
+}
+
+var stats = &brokerStats{realms: make(map[string]*realmStats)}
+
+func (s *brokerStats) realm(realm string) *realmStats {
+	s.Lock()
+	defer s.Unlock()
+
+	rs, ok := s.realms[realm]
+	if !ok {
+		rs = &realmStats{}
+		s.realms[realm] = rs
+	}
+
+	return rs
+}
+
+// retain forgets the stats of realms that have no broker.
+func (s *brokerStats) retain(brokers map[string]*Broker) {
+	s.Lock()
+	defer s.Unlock()
+
+	for realm := range s.realms {
+		if _, ok := brokers[realm]; !ok {
+			delete(s.realms, realm)
+		}
+	}
+}
+
+func (rs *realmStats) message(size int) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	rs.messages++
+	rs.bytes += uint64(size)
+
+	now := time.Now().Unix()
+	slot := now % int64(len(rs.recent))
+	if rs.recentAt[slot] != now {
+		rs.recentAt[slot] = now
+		rs.recent[slot] = 0
+	}
+	rs.recent[slot]++
+}
+
+func (rs *realmStats) drop() {
+	rs.Lock()
+	defer rs.Unlock()
+
+	rs.dropped++
+	rs.disconnects++
+}
+
+func (rs *realmStats) dropMessage() {
+	rs.Lock()
+	defer rs.Unlock()
+
+	rs.droppedMessages++
+}
+
+func (rs *realmStats) block() {
+	rs.Lock()
+	defer rs.Unlock()
+
+	rs.blocked++
+}
+
+func (rs *realmStats) throttle() {
+	rs.Lock()
+	defer rs.Unlock()
+
+	rs.throttled++
+}
+
+func (rs *realmStats) connect() {
+	rs.Lock()
+	defer rs.Unlock()
+
+	rs.connects++
+}
+
+func (rs *realmStats) disconnect() {
+	rs.Lock()
+	defer rs.Unlock()
+
+	rs.disconnects++
+}
+
+// rate returns the average messages per second over the last minute.
+func (rs *realmStats) rate() float64 {
+	rs.Lock()
+	defer rs.Unlock()
+
+	now := time.Now().Unix()
+	var total uint64
+	for i, at := range rs.recentAt {
+		if now-at < int64(len(rs.recent)) {
+			total += rs.recent[i]
+		}
+	}
+
+	return float64(total) / float64(len(rs.recent))
+}
+
+// realmInfo and clientInfo are what the admin API reports.
+type realmInfo struct {
+	Realm             string  `json:"realm"`
+	Clients           int     `json:"clients"`
+	History           int     `json:"history"`
+	Messages          uint64  `json:"messages"`
+	MessagesPerSecond float64 `json:"messages_per_second"`
+	Dropped           uint64  `json:"dropped"`
+	Backpressure      string  `json:"backpressure"`
+	DroppedMessages   uint64  `json:"dropped_messages"`
+	Blocked           uint64  `json:"blocked"`
+	Throttled         uint64  `json:"throttled"`
+	Connects          uint64  `json:"connects"`
+	Disconnects       uint64  `json:"disconnects"`
+}
+
+type clientInfo struct {
+	Realm     string    `json:"realm"`
+	Transport string    `json:"transport"`
+	Remote    string    `json:"remote"`
+	Connected time.Time `json:"connected"`
+	Bindings  []string  `json:"bindings"`
+	Queued    int       `json:"queued"`
+	Dropped   uint64    `json:"dropped"`
+}
+
+// realmSnapshot is the state of a realm's broker at one moment.
+type realmSnapshot struct {
+	clients      []clientInfo
+	history      int
+	backpressure backpressure
+}
+
+// snapshot asks every running broker for its state.
+func (manager *brokerManager) snapshot() map[string]realmSnapshot {
+	reply := make(chan map[string]realmSnapshot)
+	select {
+	case manager.snapshots <- reply:
+		return <-reply
+	case <-manager.done:
+		return nil
+	}
+}
+
+func (b *Broker) snapshot() realmSnapshot {
+	clients := make([]clientInfo, 0, len(b.clients))
+	for client := range b.clients {
+		transport := "websocket"
+		if client.conn == nil {
+			transport = "http"
+		}
+
+		clients = append(clients, clientInfo{
+			Realm:     client.realm,
+			Transport: transport,
+			Remote:    client.remote,
+			Connected: client.connected,
+			Bindings:  client.bindings,
+			Queued:    len(client.send),
+			Dropped:   client.dropped,
+		})
+	}
+
+	return realmSnapshot{clients: clients, history: b.history.len(), backpressure: b.backpressure}
+}
+
+func (manager *brokerManager) realmInfo() []realmInfo {
+	snapshot := manager.snapshot()
+
+	realms := make([]realmInfo, 0, len(snapshot))
+	for realm, rsnap := range snapshot {
+		rs := stats.realm(realm)
+		rate := rs.rate()
+
+		rs.Lock()
+		realms = append(realms, realmInfo{
+			Realm:             realm,
+			Clients:           len(rsnap.clients),
+			History:           rsnap.history,
+			Messages:          rs.messages,
+			MessagesPerSecond: rate,
+			Dropped:           rs.dropped,
+			Backpressure:      rsnap.backpressure.String(),
+			DroppedMessages:   rs.droppedMessages,
+			Blocked:           rs.blocked,
+			Throttled:         rs.throttled,
+			Connects:          rs.connects,
+			Disconnects:       rs.disconnects,
+		})
+		rs.Unlock()
+	}
+
+	sort.Slice(realms, func(i, j int) bool { return realms[i].Realm < realms[j].Realm })
+
+	return realms
+}
+
+func (manager *brokerManager) handleRealms(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, manager.realmInfo())
+}
+
+func (manager *brokerManager) handleClients(w http.ResponseWriter, r *http.Request) {
+	clients := []clientInfo{}
+	for _, rsnap := range manager.snapshot() {
+		clients = append(clients, rsnap.clients...)
+	}
+
+	if realm := r.URL.Query().Get("realm"); len(realm) > 0 {
+		filtered := []clientInfo{}
+		for _, client := range clients {
+			if client.Realm == realm {
+				filtered = append(filtered, client)
+			}
+		}
+		clients = filtered
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Realm != clients[j].Realm {
+			return clients[i].Realm < clients[j].Realm
+		}
+		return clients[i].Connected.Before(clients[j].Connected)
+	})
+
+	writeJSON(w, clients)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// handleMetrics reports the stats in the Prometheus text format.
+func (manager *brokerManager) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	snapshot := manager.snapshot()
+
+	stats.Lock()
+	realms := make([]string, 0, len(stats.realms))
+	byRealm := make(map[string]*realmStats, len(stats.realms))
+	for realm, rs := range stats.realms {
+		realms = append(realms, realm)
+		byRealm[realm] = rs
+	}
+	stats.Unlock()
+	sort.Strings(realms)
+
+	var b strings.Builder
+
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("pmb_realms", "gauge", "Number of active realms.")
+	fmt.Fprintf(&b, "pmb_realms %d\n", len(snapshot))
+
+	metric("pmb_clients", "gauge", "Number of connected clients.")
+	for _, realm := range realms {
+		fmt.Fprintf(&b, "pmb_clients{realm=\"%s\"} %d\n", labelValue(realm), len(snapshot[realm].clients))
+	}
+
+	counters := []struct {
+		name  string
+		help  string
+		value func(rs *realmStats) uint64
+	}{
+		{"pmb_messages_total", "Messages published.", func(rs *realmStats) uint64 { return rs.messages }},
+		{"pmb_message_bytes_total", "Bytes of messages published.", func(rs *realmStats) uint64 { return rs.bytes }},
+		{"pmb_dropped_total", "Clients dropped for falling behind.", func(rs *realmStats) uint64 { return rs.dropped }},
+		{"pmb_dropped_messages_total", "Messages dropped by the backpressure policy.", func(rs *realmStats) uint64 { return rs.droppedMessages }},
+		{"pmb_blocked_total", "Deliveries that waited for a slow client.", func(rs *realmStats) uint64 { return rs.blocked }},
+		{"pmb_throttled_total", "Messages refused for going over a rate limit or quota.", func(rs *realmStats) uint64 { return rs.throttled }},
+		{"pmb_connects_total", "Clients connected.", func(rs *realmStats) uint64 { return rs.connects }},
+		{"pmb_disconnects_total", "Clients disconnected, including those dropped.", func(rs *realmStats) uint64 { return rs.disconnects }},
+	}
+
+	for _, counter := range counters {
+		metric(counter.name, "counter", counter.help)
+		for _, realm := range realms {
+			rs := byRealm[realm]
+			rs.Lock()
+			value := counter.value(rs)
+			rs.Unlock()
+
+			fmt.Fprintf(&b, "%s{realm=\"%s\"} %d\n", counter.name, labelValue(realm), value)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
+
+// labelValue escapes a label value as the Prometheus text format expects,
+// which is only backslashes, double quotes and newlines.
+var labelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLabelValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "work", want: "work"},
+		{value: `say "hi"`, want: `say \"hi\"`},
+		{value: `back\slash`, want: `back\\slash`},
+		{value: "two\nlines", want: `two\nlines`},
+		// left alone, unlike Go quoting
+		{value: "café\x00", want: "café\x00"},
+	}
+
+	for _, test := range tests {
+		if got := labelValue(test.value); got != test.want {
+			t.Errorf("labelValue(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestStatsRetain(t *testing.T) {
+	s := &brokerStats{realms: make(map[string]*realmStats)}
+	s.realm("live").message(10)
+	s.realm("retired").message(10)
+
+	s.retain(map[string]*Broker{"live": nil})
+
+	if len(s.realms) != 1 || s.realms["live"] == nil {
+		t.Errorf("stats kept for %d realm(s), want only the live one", len(s.realms))
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/justone/pmb/api"
+	ini "gopkg.in/ini.v1"
+)
+
+// brokerConfig holds the access rules from the broker config file, which
+// looks like:
+//
+//	[broker]
+//	allowed-origins = https://example.com
+//	admin-token = token4
+//	peers = wss://broker2.example.com:3000, wss://broker3.example.com:3000
+//	peer-token = token5
+//	peer-tls-ca = /etc/pmb/peers-ca.pem
+//	peer-tls-fingerprint = AB:CD:..., 12:34:...
+//
+//	[realms]
+//	work = token1, token2
+//	work-* = token1
+//	* = token3
+//
+//	[backpressure]
+//	logs = drop-oldest
+//	* = block-timeout:500ms
+//
+// Each realm (the category in /pmb/{category}/) is only open to clients
+// presenting one of its tokens, and "*" applies to realms that aren't
+// listed.  Sub realms ({category}-{sub}) are realms of their own, except
+// that those of send-file ({category}-files) take their realm's tokens, and
+// "{category}-*" gives tokens for all of a realm's sub realms, such as
+// those of stream and sink.  Realms with no tokens at
+// all are refused.  The admin API and metrics need the admin token, and
+// don't exist if there isn't one.  A nil config leaves the realms open to
+// anyone, as they were before tokens existed, and has no admin API.
+// Realms not listed under backpressure use the --backpressure policy.
+// Brokers listed as peers share the messages published on them, and must
+// all have the same peer token.  Their certificates are checked as clients
+// check the broker's, against the peer CA or fingerprints if given.
+type brokerConfig struct {
+	tokens     map[string][]string
+	origins    []string
+	adminToken string
+	policies   map[string]backpressure
+	peers      []string
+	peerToken  string
+	peerTLS    *tls.Config
+}
+
+func loadBrokerConfig(path string) (*brokerConfig, error) {
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &brokerConfig{
+		tokens:     make(map[string][]string),
+		origins:    splitList(cfg.Section("broker").Key("allowed-origins").String()),
+		adminToken: cfg.Section("broker").Key("admin-token").String(),
+		policies:   make(map[string]backpressure),
+		peers:      splitList(cfg.Section("broker").Key("peers").String()),
+		peerToken:  cfg.Section("broker").Key("peer-token").String(),
+	}
+
+	if len(config.peers) > 0 && len(config.peerToken) == 0 {
+		return nil, fmt.Errorf("%s: peers need a peer-token", path)
+	}
+
+	config.peerTLS, err = pmb.ClientTLSConfig(
+		cfg.Section("broker").Key("peer-tls-ca").String(),
+		cfg.Section("broker").Key("peer-tls-fingerprint").String())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	for _, key := range cfg.Section("realms").Keys() {
+		config.tokens[key.Name()] = splitList(key.String())
+	}
+
+	for _, key := range cfg.Section("backpressure").Keys() {
+		bp, err := parseBackpressure(key.String())
+		if err != nil {
+			return nil, fmt.Errorf("%s: realm %s: %s", path, key.Name(), err)
+		}
+		config.policies[key.Name()] = bp
+	}
+
+	return config, nil
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// backpressure returns the policy for a realm, or fallback if the config
+// doesn't set one.
+func (config *brokerConfig) backpressure(realm string, fallback backpressure) backpressure {
+	if config == nil {
+		return fallback
+	}
+
+	if bp, ok := config.policies[realmCategory(realm)]; ok {
+		return bp
+	}
+	if bp, ok := config.policies["*"]; ok {
+		return bp
+	}
+
+	return fallback
+}
+
+// authorized reports whether the request carries a token for the realm.
+func (config *brokerConfig) authorized(category string, r *http.Request) bool {
+	if config == nil {
+		return true
+	}
+
+	return hasToken(r, config.realmTokens(category))
+}
+
+// realmTokens returns the tokens for a category.  HTTP sub-clients connect
+// to "{category}-{sub}", which is only covered by the category's tokens for
+// send-file's sub-clients, or if the config lists "{category}-*".  Stream
+// and sink name their sub-clients after the stream, so any name can follow
+// the dash, and the config has to say that's expected.
+func (config *brokerConfig) realmTokens(category string) []string {
+	if tokens, ok := config.tokens[category]; ok {
+		return tokens
+	}
+
+	if parent := strings.TrimSuffix(category, "-"+transferSub); parent != category {
+		if tokens, ok := config.tokens[parent]; ok {
+			return tokens
+		}
+	}
+
+	// the longest listed prefix wins
+	for name := category; ; {
+		dash := strings.LastIndex(name, "-")
+		if dash < 0 {
+			break
+		}
+		name = name[:dash]
+
+		if tokens, ok := config.tokens[name+"-*"]; ok {
+			return tokens
+		}
+	}
+
+	return config.tokens["*"]
+}
+
+func hasToken(r *http.Request, tokens []string) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	presented := []byte(strings.TrimPrefix(auth, "Bearer "))
+
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare(presented, []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requireToken wraps a realm handler, refusing requests without a valid
+// token for the realm.
+func (config *brokerConfig) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		category := mux.Vars(r)["category"]
+
+		if !config.authorized(category, r) {
+			logrus.Warnf("Refused %s %s from %s: missing or invalid token", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pmb"`)
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// requireAdmin wraps an admin handler, refusing requests without the admin
+// token.  Without an admin token configured, the handler is hidden
+// entirely.
+func (config *brokerConfig) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config == nil || len(config.adminToken) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		if !hasToken(r, []string{config.adminToken}) {
+			logrus.Warnf("Refused %s %s from %s: missing or invalid admin token", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pmb admin"`)
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// checkOrigin allows websocket connections from clients that aren't
+// browsers, from pages served by the broker itself, and from the origins
+// listed in the config.
+func (config *brokerConfig) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	if config != nil {
+		for _, allowed := range config.origins {
+			if strings.EqualFold(origin, allowed) {
+				return true
+			}
+		}
+	}
+
+	logrus.Warnf("Refused websocket from %s: origin %s not allowed", r.RemoteAddr, origin)
+	return false
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRequireToken(t *testing.T) {
+	config := &brokerConfig{tokens: map[string][]string{
+		"work":       {"work-token"},
+		"work-audit": {"audit-token"},
+		"team":       {"team-token"},
+		"team-*":     {"stream-token"},
+		"*":          {"any-token"},
+	}}
+
+	tests := []struct {
+		name  string
+		path  string
+		token string
+		want  int
+	}{
+		{name: "realm", path: "/pmb/work", token: "work-token", want: http.StatusNoContent},
+		{name: "wrong token", path: "/pmb/work", token: "any-token", want: http.StatusUnauthorized},
+		{name: "no token", path: "/pmb/work", want: http.StatusUnauthorized},
+		// sub-clients of send-file take their realm's tokens
+		{name: "send-file sub realm", path: "/pmb/work-files", token: "work-token", want: http.StatusNoContent},
+		{name: "send-file sub realm, fallback token", path: "/pmb/work-files", token: "any-token", want: http.StatusUnauthorized},
+		// but other sub realms need to be listed
+		{name: "other sub realm", path: "/pmb/work-anything", token: "work-token", want: http.StatusUnauthorized},
+		{name: "other sub realm, fallback token", path: "/pmb/work-anything", token: "any-token", want: http.StatusNoContent},
+		{name: "wildcard sub realm", path: "/pmb/team-my-stream", token: "stream-token", want: http.StatusNoContent},
+		{name: "wildcard sub realm, realm token", path: "/pmb/team-my-stream", token: "team-token", want: http.StatusUnauthorized},
+		{name: "wildcard doesn't cover the realm", path: "/pmb/team", token: "stream-token", want: http.StatusUnauthorized},
+		{name: "listed sub realm", path: "/pmb/work-audit", token: "audit-token", want: http.StatusNoContent},
+		{name: "listed sub realm, parent token", path: "/pmb/work-audit", token: "work-token", want: http.StatusUnauthorized},
+		{name: "unlisted realm", path: "/pmb/home", token: "any-token", want: http.StatusNoContent},
+		{name: "unlisted sub realm", path: "/pmb/home-files", token: "any-token", want: http.StatusNoContent},
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/pmb/{category}", config.requireToken(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", test.path, nil)
+			if len(test.token) > 0 {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != test.want {
+				t.Errorf("%s = %d, want %d", test.path, w.Code, test.want)
+			}
+		})
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *brokerConfig
+		token  string
+		want   int
+	}{
+		{name: "no config", config: nil, want: http.StatusNotFound},
+		{name: "no admin token", config: &brokerConfig{tokens: map[string][]string{"*": {"token"}}}, token: "token", want: http.StatusNotFound},
+		{name: "admin token", config: &brokerConfig{adminToken: "admin"}, token: "admin", want: http.StatusOK},
+		{name: "wrong token", config: &brokerConfig{adminToken: "admin"}, token: "token", want: http.StatusUnauthorized},
+		{name: "missing token", config: &brokerConfig{adminToken: "admin"}, want: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := test.config.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			if len(test.token) > 0 {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+
+			w := httptest.NewRecorder()
+			handler(w, req)
+			if w.Code != test.want {
+				t.Errorf("/metrics = %d, want %d", w.Code, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+)
+
+// What to do when a message is delivered to a client whose queue is full.
+const (
+	// dropOldest discards the oldest queued message to make room.
+	dropOldest = "drop-oldest"
+
+	// dropNewest discards the message being delivered.
+	dropNewest = "drop-newest"
+
+	// blockTimeout waits for room, holding up the whole realm, and
+	// disconnects the client if there is still none after the timeout.
+	blockTimeout = "block-timeout"
+
+	// disconnect drops the client straight away, so that it reconnects and
+	// catches up from the history.
+	disconnect = "disconnect"
+)
+
+const defaultBlockTimeout = time.Second
+
+// backpressure is a realm's policy for slow clients.  It is written as the
+// policy name, with an optional timeout for block-timeout, like
+// "block-timeout:250ms".
+type backpressure struct {
+	policy  string
+	timeout time.Duration
+}
+
+func parseBackpressure(spec string) (backpressure, error) {
+	spec = strings.TrimSpace(spec)
+	policy, timeout := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		policy, timeout = spec[:i], spec[i+1:]
+	}
+
+	bp := backpressure{policy: policy}
+	switch policy {
+	case dropOldest, dropNewest, disconnect:
+		if len(timeout) > 0 {
+			return bp, fmt.Errorf("Backpressure policy %s doesn't take a timeout", policy)
+		}
+	case blockTimeout:
+		bp.timeout = defaultBlockTimeout
+		if len(timeout) > 0 {
+			d, err := time.ParseDuration(timeout)
+			if err != nil {
+				return bp, fmt.Errorf("Bad timeout in backpressure policy %s: %s", spec, err)
+			}
+			bp.timeout = d
+		}
+	default:
+		return bp, fmt.Errorf("Unknown backpressure policy %s, expected one of %s, %s, %s or %s",
+			policy, dropOldest, dropNewest, blockTimeout, disconnect)
+	}
+
+	return bp, nil
+}
+
+func (bp backpressure) String() string {
+	if bp.policy == blockTimeout {
+		return fmt.Sprintf("%s:%s", bp.policy, bp.timeout)
+	}
+
+	return bp.policy
+}
+
+// overflow applies the realm's policy to a client whose queue is full.  It
+// returns false if the client was disconnected.
+func (b *Broker) overflow(client *Client, message []byte) bool {
+	switch b.backpressure.policy {
+	case dropNewest:
+		client.dropped++
+		b.stats.dropMessage()
+		return true
+	case dropOldest:
+		// only the broker adds to the queue, so once one message has
+		// been taken off there is room
+		for {
+			select {
+			case client.send <- message:
+				return true
+			default:
+			}
+
+			select {
+			case <-client.send:
+				client.dropped++
+				b.stats.dropMessage()
+			default:
+			}
+		}
+	case blockTimeout:
+		b.stats.block()
+
+		timer := time.NewTimer(b.backpressure.timeout)
+		defer timer.Stop()
+
+		select {
+		case client.send <- message:
+			return true
+		case <-timer.C:
+		}
+	}
+
+	logrus.Warnf("Client %s in realm %s fell behind, dropping it.", client.remote, client.realm)
+	b.disconnect(client, websocket.CloseTryAgainLater, "too far behind")
+	b.stats.drop()
+	return false
+}
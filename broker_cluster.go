@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+	"github.com/justone/pmb/api"
+)
+
+// NodeHeader carries a broker's node id when peers connect, so that each
+// side knows who is on the other end of a link.
+const NodeHeader = "X-PMB-Node"
+
+const (
+	// how long message ids are remembered, to drop copies arriving by
+	// another route
+	gossipWindow = 10 * time.Minute
+
+	// how many messages can wait for a peer before they are dropped
+	peerQueue = 1024
+
+	peerRetryMin = time.Second
+	peerRetryMax = 30 * time.Second
+)
+
+// gossip is a message passed between brokers.  Path holds the nodes it has
+// been through, so it isn't sent back to them.
+type gossip struct {
+	ID          string   `json:"id"`
+	Realm       string   `json:"realm"`
+	Destination string   `json:"destination"`
+	Message     string   `json:"message"`
+	Path        []string `json:"path"`
+}
+
+// A cluster passes the messages published on this broker to the peers
+// listed in the config, and publishes what they send here.  Each broker
+// dials every peer, and only sends over the links it dialed, so each pair
+// of brokers has a link in each direction.  Messages are forwarded on to
+// the other peers too, so the peers don't all have to list each other.
+type cluster struct {
+	node    string
+	token   string
+	dialer  *websocket.Dialer
+	manager *brokerManager
+	peers   []*peer
+	seen    *bodyCache
+	counter uint64
+}
+
+type peer struct {
+	uri  string
+	node atomic.Value
+	send chan gossip
+}
+
+// newCluster returns nil if no peers are configured, which leaves the
+// broker on its own.
+func newCluster(config *brokerConfig) *cluster {
+	if config == nil || len(config.peers) == 0 {
+		return nil
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = config.peerTLS
+
+	c := &cluster{
+		node:   pmb.GenerateRandomID("node"),
+		token:  config.peerToken,
+		dialer: &dialer,
+		seen:   newBodyCache(gossipWindow),
+	}
+	for _, uri := range config.peers {
+		p := &peer{uri: uri, send: make(chan gossip, peerQueue)}
+		p.node.Store("")
+		c.peers = append(c.peers, p)
+	}
+
+	return c
+}
+
+// start dials the peers, until ctx is done.
+func (c *cluster) start(ctx context.Context, manager *brokerManager) {
+	if c == nil {
+		return
+	}
+
+	c.manager = manager
+	logrus.Infof("Joining cluster as %s with %d peer(s)", c.node, len(c.peers))
+
+	for _, p := range c.peers {
+		go c.link(ctx, p)
+	}
+}
+
+// publish passes a message published on this broker to the peers.  It
+// never blocks, as it's called from realm brokers.
+func (c *cluster) publish(message realmMessage) {
+	if c == nil {
+		return
+	}
+
+	g := gossip{
+		ID:          fmt.Sprintf("%s-%d", c.node, atomic.AddUint64(&c.counter, 1)),
+		Realm:       message.realm,
+		Destination: message.destination,
+		Message:     string(message.message),
+	}
+	c.seen.first([]byte(g.ID))
+	c.forward(g)
+}
+
+// forward sends a message to each peer it hasn't been through.
+func (c *cluster) forward(g gossip) {
+	g.Path = append(append([]string{}, g.Path...), c.node)
+
+	for _, p := range c.peers {
+		if onPath(g.Path, p.node.Load().(string)) {
+			continue
+		}
+
+		select {
+		case p.send <- g:
+		default:
+			logrus.Warnf("Peer %s fell behind, dropping message", p.uri)
+		}
+	}
+}
+
+func onPath(path []string, node string) bool {
+	for _, n := range path {
+		if n == node {
+			return true
+		}
+	}
+
+	return false
+}
+
+// link keeps a connection open to a peer, sending it messages.
+func (c *cluster) link(ctx context.Context, p *peer) {
+	delay := peerRetryMin
+
+	for ctx.Err() == nil {
+		conn, err := c.dial(p)
+		if err != nil {
+			logrus.Warnf("Unable to connect to peer %s, retrying in %s: %s", p.uri, delay, err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			if delay *= 2; delay > peerRetryMax {
+				delay = peerRetryMax
+			}
+			continue
+		}
+
+		logrus.Infof("Connected to peer %s (%s)", p.uri, p.node.Load())
+		delay = peerRetryMin
+		c.sendTo(ctx, p, conn)
+		p.node.Store("")
+	}
+}
+
+func (c *cluster) dial(p *peer) (*websocket.Conn, error) {
+	header := make(http.Header)
+	header.Set("Authorization", "Bearer "+c.token)
+	header.Set(NodeHeader, c.node)
+
+	conn, res, err := c.dialer.Dial(strings.TrimRight(p.uri, "/")+"/peer/", header)
+	if err != nil {
+		if res != nil {
+			return nil, fmt.Errorf("%s: %s", err, res.Status)
+		}
+		return nil, err
+	}
+	p.node.Store(res.Header.Get(NodeHeader))
+
+	return conn, nil
+}
+
+// sendTo sends messages over a link until it fails or ctx is done.
+func (c *cluster) sendTo(ctx context.Context, p *peer, conn *websocket.Conn) {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		conn.Close()
+	}()
+
+	// nothing is expected from the peer but control frames, reading is
+	// only to notice when it goes away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case g := <-p.send:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteJSON(g); err != nil {
+				logrus.Warnf("Lost peer %s: %s", p.uri, err)
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				logrus.Warnf("Lost peer %s: %s", p.uri, err)
+				return
+			}
+		case <-closed:
+			logrus.Warnf("Lost peer %s", p.uri)
+			return
+		case <-ctx.Done():
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "broker shutting down"))
+			return
+		}
+	}
+}
+
+// handlePeer receives messages from a peer that dialed this broker.
+func (c *cluster) handlePeer(w http.ResponseWriter, r *http.Request) {
+	if c == nil || !hasToken(r, []string{c.token}) {
+		logrus.Warnf("Refused peer %s: peering disabled or invalid token", r.RemoteAddr)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	header := make(http.Header)
+	header.Set(NodeHeader, c.node)
+
+	conn, err := upgrader.Upgrade(w, r, header)
+	if err != nil {
+		logrus.Warnf("Error: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	node := r.Header.Get(NodeHeader)
+	logrus.Infof("Peer %s (%s) connected", r.RemoteAddr, node)
+
+	conn.SetReadLimit(2 * maxMessageSize)
+	for {
+		var g gossip
+		if err := conn.ReadJSON(&g); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				logrus.Warnf("Lost peer %s (%s): %s", r.RemoteAddr, node, err)
+			}
+			return
+		}
+
+		if !c.seen.first([]byte(g.ID)) {
+			logrus.Debugf("Already seen message %s, skipping", g.ID)
+			continue
+		}
+
+		if !c.manager.send(realmMessage{realm: g.Realm, destination: g.Destination, message: []byte(g.Message), remote: true}) {
+			return
+		}
+		c.forward(g)
+	}
+}
+
+// peerStatus is what the admin API reports about each peer, the node is
+// only known while connected.
+type peerStatus struct {
+	URI       string `json:"uri"`
+	Node      string `json:"node"`
+	Connected bool   `json:"connected"`
+}
+
+func (c *cluster) handlePeers(w http.ResponseWriter, r *http.Request) {
+	peers := []peerStatus{}
+	if c != nil {
+		for _, p := range c.peers {
+			node := p.node.Load().(string)
+			peers = append(peers, peerStatus{URI: p.uri, Node: node, Connected: len(node) > 0})
+		}
+	}
+
+	writeJSON(w, peers)
+}
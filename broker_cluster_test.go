@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/justone/pmb/api"
+)
+
+func TestClusterDialTLS(t *testing.T) {
+	t.Setenv("PMB_SSL_INSECURE_SKIP_VERIFY", "")
+
+	peerServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := make(http.Header)
+		header.Set(NodeHeader, "node-peer")
+
+		conn, err := upgrader.Upgrade(w, r, header)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer peerServer.Close()
+
+	cert := peerServer.Certificate()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	uri := strings.Replace(peerServer.URL, "https://", "wss://", 1)
+	other := strings.Repeat("AB:", 31) + "AB"
+
+	tests := []struct {
+		name     string
+		settings string
+		ok       bool
+	}{
+		{name: "system CAs", settings: "", ok: false},
+		{name: "pinned", settings: "peer-tls-fingerprint = " + pmb.Fingerprint(cert.Raw), ok: true},
+		{name: "one of several pinned", settings: "peer-tls-fingerprint = " + other + ", " + pmb.Fingerprint(cert.Raw), ok: true},
+		{name: "wrong pin", settings: "peer-tls-fingerprint = " + other, ok: false},
+		{name: "ca", settings: "peer-tls-ca = " + ca, ok: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "broker.ini")
+			ini := "[broker]\npeers = " + uri + "\npeer-token = secret\n" + test.settings + "\n"
+			if err := os.WriteFile(path, []byte(ini), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := loadBrokerConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := newCluster(config)
+			conn, err := c.dial(c.peers[0])
+			if (err == nil) != test.ok {
+				t.Fatalf("dial() = %v, want ok: %t", err, test.ok)
+			}
+			if err != nil {
+				return
+			}
+			conn.Close()
+
+			if node := c.peers[0].node.Load(); node != "node-peer" {
+				t.Errorf("peer node = %q, want node-peer", node)
+			}
+		})
+	}
+}
+
+func TestBrokerConfigBadPeerTLS(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings string
+	}{
+		{name: "missing ca", settings: "peer-tls-ca = /nonexistent/ca.pem"},
+		{name: "bad fingerprint", settings: "peer-tls-fingerprint = not-a-fingerprint"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "broker.ini")
+			if err := os.WriteFile(path, []byte("[broker]\n"+test.settings+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := loadBrokerConfig(path); err == nil {
+				t.Error("loadBrokerConfig() succeeded, want an error")
+			}
+		})
+	}
+}
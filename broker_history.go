@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// historyEntry is a message as it was published into a realm.  Messages
+// are kept exactly as received, so they stay encrypted.
+type historyEntry struct {
+	seq         uint64
+	at          time.Time
+	destination string
+	message     []byte
+}
+
+// history is a realm's recent messages, bounded by count and by age, so
+// that clients connecting a little late can ask for what they missed.  It
+// is locked because the manager checks it when retiring idle realms.
+type history struct {
+	sync.Mutex
+	entries []historyEntry
+	size    int
+	maxAge  time.Duration
+
+	// where the history is stored, if anywhere
+	log *realmLog
+}
+
+func newHistory(size int, maxAge time.Duration) *history {
+	return &history{size: size, maxAge: maxAge}
+}
+
+func (h *history) add(entry historyEntry) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.size <= 0 {
+		return
+	}
+
+	if len(h.entries) >= h.size {
+		h.entries = h.entries[len(h.entries)-h.size+1:]
+	}
+	h.entries = append(h.entries, entry)
+
+	if h.log == nil {
+		return
+	}
+
+	if err := h.log.append(entry); err != nil {
+		logrus.Warnf("Unable to store message: %s", err)
+	}
+
+	if h.log.lines >= 2*h.size {
+		h.prune()
+		if err := h.log.rewrite(h.entries); err != nil {
+			logrus.Warnf("Unable to compact history: %s", err)
+		}
+	}
+}
+
+func (h *history) len() int {
+	h.Lock()
+	defer h.Unlock()
+
+	return len(h.entries)
+}
+
+// lastSeq returns the sequence number of the newest entry, so that a realm
+// loaded from disk carries on numbering where it left off.
+func (h *history) lastSeq() uint64 {
+	h.Lock()
+	defer h.Unlock()
+
+	if len(h.entries) == 0 {
+		return 0
+	}
+
+	return h.entries[len(h.entries)-1].seq
+}
+
+// retire deletes the stored history of a realm that is being retired.
+func (h *history) retire() {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.log != nil {
+		if err := h.log.remove(); err != nil {
+			logrus.Warnf("Unable to remove stored history: %s", err)
+		}
+		h.log = nil
+	}
+}
+
+// close closes the stored history of a realm, leaving it to be loaded again
+// on the next start.
+func (h *history) close() {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.log != nil {
+		if err := h.log.close(); err != nil {
+			logrus.Warnf("Unable to close stored history: %s", err)
+		}
+		h.log = nil
+	}
+}
+
+// since returns the retained entries matching the replay request.
+func (h *history) since(replay replayRequest) []historyEntry {
+	h.Lock()
+	defer h.Unlock()
+
+	h.prune()
+
+	// a sequence number from before the broker restarted can be ahead of
+	// ours, in which case everything retained is new to the client
+	if len(h.entries) > 0 && replay.seq > h.entries[len(h.entries)-1].seq {
+		replay.seq = 0
+	}
+
+	var entries []historyEntry
+	for _, entry := range h.entries {
+		if entry.seq > replay.seq && !entry.at.Before(replay.at) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// empty prunes expired entries and reports whether any are left.
+func (h *history) empty() bool {
+	h.Lock()
+	defer h.Unlock()
+
+	h.prune()
+
+	return len(h.entries) == 0
+}
+
+func (h *history) prune() {
+	cutoff := time.Now().Add(-h.maxAge)
+
+	expired := 0
+	for expired < len(h.entries) && h.entries[expired].at.Before(cutoff) {
+		expired++
+	}
+	h.entries = h.entries[expired:]
+}
+
+// replayRequest is what a client asked for when connecting: history since a
+// time ("since", RFC 3339 or unix seconds) or after a sequence number
+// ("since-seq"), and whether to have each message's sequence number sent
+// with it ("seq"), so that it can ask for what it missed after reconnecting.
+type replayRequest struct {
+	wanted    bool
+	at        time.Time
+	seq       uint64
+	sequenced bool
+}
+
+func parseReplay(query url.Values) replayRequest {
+	var replay replayRequest
+
+	if since := query.Get("since"); len(since) > 0 {
+		if at, err := time.Parse(time.RFC3339Nano, since); err == nil {
+			replay.at = at
+			replay.wanted = true
+		} else if secs, err := strconv.ParseInt(since, 10, 64); err == nil {
+			replay.at = time.Unix(secs, 0)
+			replay.wanted = true
+		} else {
+			logrus.Warnf("Ignoring invalid since: %s", since)
+		}
+	}
+
+	if sinceSeq := query.Get("since-seq"); len(sinceSeq) > 0 {
+		if seq, err := strconv.ParseUint(sinceSeq, 10, 64); err == nil {
+			replay.seq = seq
+			replay.wanted = true
+		} else {
+			logrus.Warnf("Ignoring invalid since-seq: %s", sinceSeq)
+		}
+	}
+
+	replay.sequenced, _ = strconv.ParseBool(query.Get("seq"))
+
+	return replay
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testHistory returns a history holding messages with sequence numbers 1 to
+// count, a second apart and ending now.
+func testHistory(size int, count int) *history {
+	h := newHistory(size, time.Hour)
+
+	now := time.Now()
+	for seq := 1; seq <= count; seq++ {
+		h.add(historyEntry{
+			seq:         uint64(seq),
+			at:          now.Add(time.Duration(seq-count) * time.Second),
+			destination: "@all",
+			message:     []byte("message"),
+		})
+	}
+
+	return h
+}
+
+func seqs(entries []historyEntry) []uint64 {
+	var seqs []uint64
+	for _, entry := range entries {
+		seqs = append(seqs, entry.seq)
+	}
+
+	return seqs
+}
+
+func TestHistorySince(t *testing.T) {
+	tests := []struct {
+		name   string
+		replay replayRequest
+		want   []uint64
+	}{
+		{name: "everything", replay: replayRequest{wanted: true}, want: []uint64{1, 2, 3, 4, 5}},
+		{name: "since seq", replay: replayRequest{wanted: true, seq: 3}, want: []uint64{4, 5}},
+		{name: "since latest seq", replay: replayRequest{wanted: true, seq: 5}, want: nil},
+		// the broker restarted without storing history, so the
+		// client's sequence numbers are from before
+		{name: "seq ahead of broker", replay: replayRequest{wanted: true, seq: 50}, want: []uint64{1, 2, 3, 4, 5}},
+		{name: "since time", replay: replayRequest{wanted: true, at: time.Now().Add(-1500 * time.Millisecond)}, want: []uint64{4, 5}},
+		{name: "since time and seq", replay: replayRequest{wanted: true, seq: 4, at: time.Now().Add(-10 * time.Second)}, want: []uint64{5}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := seqs(testHistory(10, 5).since(test.replay))
+			if len(got) != len(test.want) {
+				t.Fatalf("since() = %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("since() = %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestHistoryBounded(t *testing.T) {
+	h := testHistory(3, 5)
+	if got := seqs(h.since(replayRequest{wanted: true})); len(got) != 3 || got[0] != 3 {
+		t.Errorf("since() = %v, want the newest 3", got)
+	}
+
+	h = newHistory(10, time.Minute)
+	h.add(historyEntry{seq: 1, at: time.Now().Add(-2 * time.Minute)})
+	h.add(historyEntry{seq: 2, at: time.Now()})
+	if got := seqs(h.since(replayRequest{wanted: true})); len(got) != 1 || got[0] != 2 {
+		t.Errorf("since() = %v, want only the unexpired entry", got)
+	}
+}
+
+func TestParseReplay(t *testing.T) {
+	at := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		query string
+		want  replayRequest
+	}{
+		{name: "nothing", query: "", want: replayRequest{}},
+		{name: "since rfc3339", query: "since=2016-05-01T12:00:00Z", want: replayRequest{wanted: true, at: at}},
+		{name: "since unix", query: "since=1462104000", want: replayRequest{wanted: true, at: at}},
+		{name: "since-seq", query: "since-seq=42&seq=true", want: replayRequest{wanted: true, seq: 42, sequenced: true}},
+		{name: "invalid since-seq", query: "since-seq=-1", want: replayRequest{}},
+		{name: "invalid since", query: "since=yesterday&seq=1", want: replayRequest{sequenced: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := parseReplay(query)
+			if got.wanted != test.want.wanted || !got.at.Equal(test.want.at) || got.seq != test.want.seq || got.sequenced != test.want.sequenced {
+				t.Errorf("parseReplay(%q) = %+v, want %+v", test.query, got, test.want)
+			}
+		})
+	}
+}
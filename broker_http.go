@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/justone/pmb/api"
+)
+
+const (
+	pollTimeout = 30 * time.Second
+	pollExpiry  = 2 * pollTimeout
+)
+
+// A poller is a broker client that receives messages by long-polling over
+// HTTP rather than holding a websocket open.
+type poller struct {
+	client   *Client
+	lastPoll time.Time
+}
+
+// A publisher is a client publishing over HTTP, which has no connection to
+// hold its rate limits.
+type publisher struct {
+	limiter     *limiter
+	lastPublish time.Time
+}
+
+type pollers struct {
+	sync.Mutex
+	manager    *brokerManager
+	clients    map[string]*poller
+	publishers map[string]*publisher
+}
+
+func newPollers(manager *brokerManager) *pollers {
+	p := &pollers{
+		manager:    manager,
+		clients:    make(map[string]*poller),
+		publishers: make(map[string]*publisher),
+	}
+
+	go p.reap()
+
+	return p
+}
+
+// realmPath returns the realm for a category, matching the path that
+// websocket clients connect on so that both kinds of client share a realm.
+func realmPath(category string) string {
+	return fmt.Sprintf("/pmb/%s/", category)
+}
+
+// realmCategory is the reverse of realmPath.
+func realmCategory(realm string) string {
+	return strings.Trim(strings.TrimPrefix(realm, "/pmb/"), "/")
+}
+
+func (p *pollers) handlePublish(w http.ResponseWriter, r *http.Request) {
+	realm := realmPath(mux.Vars(r)["category"])
+
+	limits := p.manager.limits
+	message, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(limits.maxSize)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
+
+	destination := r.Header.Get(pmb.DestinationHeader)
+	if len(destination) == 0 {
+		destination = pmb.Broadcast
+	}
+
+	if wait, reason := limits.allow(realm, p.publisher(realm, r), len(message)); len(reason) > 0 {
+		logrus.Debugf("Throttling publisher %s in realm %s: %s", r.RemoteAddr, realm, reason)
+		stats.realm(realm).throttle()
+		pmb.RetryAfter(w.Header(), wait)
+		http.Error(w, reason, http.StatusTooManyRequests)
+		return
+	}
+
+	if !p.manager.send(realmMessage{realm: realm, destination: destination, message: message}) {
+		http.Error(w, "broker shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *pollers) handlePoll(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	realm := realmPath(vars["category"])
+	key := fmt.Sprintf("%s%s", realm, vars["id"])
+
+	p.Lock()
+	poll, ok := p.clients[key]
+	if !ok {
+		poll = &poller{client: newClient(realm, nil, r)}
+
+		// pollers always get sequence numbers, which are passed on in a
+		// header rather than in the body
+		poll.client.replay.sequenced = true
+		p.clients[key] = poll
+	}
+	poll.lastPoll = time.Now()
+	p.Unlock()
+
+	// the first poll only registers, so the client knows that anything
+	// sent from now on will be queued for it
+	if !ok {
+		logrus.Debugf("Registering poller %s", key)
+		if !p.manager.join(poll.client) {
+			p.forget(key, poll)
+			http.Error(w, "broker shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	defer p.touch(poll)
+
+	select {
+	case message, ok := <-poll.client.send:
+		if !ok {
+			logrus.Debugf("Poller %s was removed by the broker", key)
+			p.forget(key, poll)
+			http.Error(w, "poller removed", http.StatusGone)
+			return
+		}
+
+		seq, body := pmb.SplitSequence(message)
+		if seq > 0 {
+			w.Header().Set(pmb.SequenceHeader, strconv.FormatUint(seq, 10))
+		}
+		destination, body := pmb.SplitFrame(body)
+		w.Header().Set(pmb.DestinationHeader, destination)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(body)
+	case <-time.After(pollTimeout):
+		w.WriteHeader(http.StatusRequestTimeout)
+	case <-r.Context().Done():
+	}
+}
+
+// publisher returns the publisher a request came from.
+func (p *pollers) publisher(realm string, r *http.Request) *limiter {
+	key := realm + " " + publisherKey(r)
+
+	p.Lock()
+	defer p.Unlock()
+
+	pub, ok := p.publishers[key]
+	if !ok {
+		pub = &publisher{limiter: p.manager.limits.client()}
+		p.publishers[key] = pub
+	}
+	pub.lastPublish = time.Now()
+
+	return pub.limiter
+}
+
+// publisherKey identifies who published a request: the token it gives, or
+// else the address it came from.  Clients behind the same NAT share an
+// address, so that's only used when there's no token.  Client ids aren't
+// used, as a client could give a new one each time to get a fresh limit.
+func publisherKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return "token:" + strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "host:" + host
+}
+
+func (p *pollers) touch(poll *poller) {
+	p.Lock()
+	defer p.Unlock()
+
+	poll.lastPoll = time.Now()
+}
+
+func (p *pollers) forget(key string, poll *poller) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.clients[key] == poll {
+		delete(p.clients, key)
+	}
+}
+
+func (p *pollers) reap() {
+	ticker := time.NewTicker(pollTimeout)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var expired []*poller
+
+		p.Lock()
+		for key, poll := range p.clients {
+			if time.Since(poll.lastPoll) > pollExpiry {
+				logrus.Debugf("Poller %s has gone away, removing.", key)
+				delete(p.clients, key)
+				expired = append(expired, poll)
+			}
+		}
+		for key, pub := range p.publishers {
+			if time.Since(pub.lastPublish) > pollExpiry {
+				delete(p.publishers, key)
+			}
+		}
+		p.Unlock()
+
+		for _, poll := range expired {
+			p.manager.leave(poll.client)
+		}
+	}
+}
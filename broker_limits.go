@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows rate things per second on average, with bursts of up
+// to burst.  A nil bucket allows everything.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	if !tb.last.IsZero() {
+		tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	}
+	tb.last = now
+}
+
+// wait returns how long until n tokens will be available, zero if they are
+// available now.
+func (tb *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	if tb == nil {
+		return 0
+	}
+
+	tb.refill(now)
+	if tb.tokens >= n {
+		return 0
+	}
+
+	return time.Duration((math.Min(n, tb.burst) - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+func (tb *tokenBucket) take(n float64) {
+	if tb != nil {
+		tb.tokens -= n
+	}
+}
+
+// limits are the rate limits and quotas the broker applies, each one zero
+// if there is no limit.
+type limits struct {
+	clientRate  float64
+	clientBytes float64
+	realmRate   float64
+	realmBytes  float64
+	maxSize     int
+}
+
+// limiter applies limits to one client or realm.  Messages are counted
+// against the message bucket and their size against the byte bucket.
+type limiter struct {
+	sync.Mutex
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+// newLimiter creates a limiter, with bursts of twice the rate so that a
+// client sending steadily at the limit isn't throttled.  The byte bucket is
+// never smaller than the largest message, or those would never get through.
+func newLimiter(rate, bytes float64, maxSize int) *limiter {
+	return &limiter{
+		messages: newTokenBucket(rate, math.Max(1, 2*rate)),
+		bytes:    newTokenBucket(bytes, math.Max(float64(maxSize), 2*bytes)),
+	}
+}
+
+// check returns how long until the limiter allows a message of size.
+func (l *limiter) check(size int, now time.Time) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	wait := l.messages.wait(1, now)
+	if bytesWait := l.bytes.wait(float64(size), now); bytesWait > wait {
+		wait = bytesWait
+	}
+
+	return wait
+}
+
+func (l *limiter) take(size int) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.messages.take(1)
+	l.bytes.take(float64(size))
+}
+
+// brokerLimits holds the realms' limiters.  Like the stats, they outlive the
+// realms' brokers, so that retiring an idle realm doesn't reset its limits.
+type brokerLimits struct {
+	sync.Mutex
+	limits
+	realms map[string]*limiter
+}
+
+// newBrokerLimits refuses a size limit over what the broker can read, as
+// larger messages would be cut off before the limit was ever reached.
+func newBrokerLimits(l limits) (*brokerLimits, error) {
+	if l.maxSize > maxMessageSize {
+		return nil, fmt.Errorf("max-message-size can be at most %d bytes", maxMessageSize)
+	} else if l.maxSize <= 0 {
+		l.maxSize = maxMessageSize
+	}
+
+	return &brokerLimits{limits: l, realms: make(map[string]*limiter)}, nil
+}
+
+// client returns a new limiter for a client.
+func (bl *brokerLimits) client() *limiter {
+	return newLimiter(bl.clientRate, bl.clientBytes, bl.maxSize)
+}
+
+func (bl *brokerLimits) realm(realm string) *limiter {
+	bl.Lock()
+	defer bl.Unlock()
+
+	l, ok := bl.realms[realm]
+	if !ok {
+		l = newLimiter(bl.realmRate, bl.realmBytes, bl.maxSize)
+		bl.realms[realm] = l
+	}
+
+	return l
+}
+
+// allow checks a message from a client against the size limit, the client's
+// limits and the realm's limits.  If any of them refuse it, nothing is
+// counted against the others, and the reason and how long until it would be
+// allowed are returned.
+func (bl *brokerLimits) allow(realm string, client *limiter, size int) (time.Duration, string) {
+	if size > bl.maxSize {
+		return 0, fmt.Sprintf("message of %d bytes is over the limit of %d", size, bl.maxSize)
+	}
+
+	now := time.Now()
+	if wait := client.check(size, now); wait > 0 {
+		return wait, "client rate limit"
+	}
+
+	realmLimiter := bl.realm(realm)
+	if wait := realmLimiter.check(size, now); wait > 0 {
+		return wait, "realm rate limit"
+	}
+
+	client.take(size)
+	realmLimiter.take(size)
+
+	return 0, ""
+}
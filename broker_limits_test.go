@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Unix(1462104000, 0)
+
+	tests := []struct {
+		name  string
+		rate  float64
+		burst float64
+		// tokens taken at start, then how long after start to ask
+		// for one more
+		taken float64
+		after time.Duration
+		want  time.Duration
+	}{
+		{name: "within burst", rate: 1, burst: 2, taken: 1, want: 0},
+		{name: "burst used up", rate: 1, burst: 2, taken: 2, want: time.Second},
+		{name: "refilled", rate: 1, burst: 2, taken: 2, after: time.Second, want: 0},
+		{name: "partly refilled", rate: 2, burst: 2, taken: 2, after: 250 * time.Millisecond, want: 250 * time.Millisecond},
+		{name: "refill capped at burst", rate: 10, burst: 2, taken: 2, after: time.Hour, want: 0},
+		{name: "no limit", rate: 0, taken: 1000, want: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tb := newTokenBucket(test.rate, test.burst)
+			tb.wait(test.taken, start)
+			tb.take(test.taken)
+
+			if got := tb.wait(1, start.Add(test.after)); got != test.want {
+				t.Errorf("wait() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTokenBucketBurstCap(t *testing.T) {
+	start := time.Unix(1462104000, 0)
+	tb := newTokenBucket(10, 2)
+	tb.wait(0, start)
+	tb.take(2)
+
+	tb.wait(0, start.Add(time.Hour))
+	tb.take(2)
+	if got := tb.wait(1, start.Add(time.Hour)); got != 100*time.Millisecond {
+		t.Errorf("wait() = %s after using the refilled burst, want 100ms", got)
+	}
+
+	// asking for more than the burst waits for a full bucket, rather
+	// than forever
+	if got := tb.wait(50, start.Add(time.Hour)); got != 200*time.Millisecond {
+		t.Errorf("wait(50) = %s, want 200ms", got)
+	}
+}
+
+func TestBrokerLimitsAllow(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  limits
+		sizes   []int
+		allowed int
+		reason  string
+	}{
+		{name: "no limits", sizes: []int{100, 100, 100, 100}, allowed: 4},
+		{name: "too big", limits: limits{maxSize: 50}, sizes: []int{100}, allowed: 0, reason: "message of 100 bytes is over the limit of 50"},
+		{name: "client rate", limits: limits{clientRate: 1}, sizes: []int{1, 1, 1}, allowed: 2, reason: "client rate limit"},
+		{name: "client bytes", limits: limits{clientBytes: 100, maxSize: 100}, sizes: []int{100, 100, 100}, allowed: 2, reason: "client rate limit"},
+		{name: "realm rate", limits: limits{realmRate: 1}, sizes: []int{1, 1, 1}, allowed: 2, reason: "realm rate limit"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bl, err := newBrokerLimits(test.limits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := bl.client()
+
+			allowed := 0
+			var reason string
+			for _, size := range test.sizes {
+				var wait time.Duration
+				if wait, reason = bl.allow("/pmb/test", client, size); len(reason) > 0 {
+					if wait < 0 {
+						t.Errorf("allow() returned a negative wait: %s", wait)
+					}
+					break
+				}
+				allowed++
+			}
+
+			if allowed != test.allowed || reason != test.reason {
+				t.Errorf("allowed %d with reason %q, want %d with %q", allowed, reason, test.allowed, test.reason)
+			}
+		})
+	}
+}
+
+func TestBrokerLimitsMaxSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxSize int
+		want    int
+		wantErr bool
+	}{
+		{name: "default", want: maxMessageSize},
+		{name: "smaller", maxSize: 1024, want: 1024},
+		{name: "largest", maxSize: maxMessageSize, want: maxMessageSize},
+		{name: "too big", maxSize: maxMessageSize + 1, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bl, err := newBrokerLimits(limits{maxSize: test.maxSize})
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("newBrokerLimits() allowed %d bytes", test.maxSize)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bl.maxSize != test.want {
+				t.Errorf("maxSize = %d, want %d", bl.maxSize, test.want)
+			}
+		})
+	}
+}
+
+func TestBrokerLimitsRefusalCountsNothing(t *testing.T) {
+	bl, err := newBrokerLimits(limits{clientRate: 1, realmRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the realm allows two, so a third client is refused by the realm
+	// and must not have that counted against it
+	for _, client := range []*limiter{bl.client(), bl.client()} {
+		if _, reason := bl.allow("/pmb/test", client, 1); len(reason) > 0 {
+			t.Fatalf("allow() = %q, want allowed", reason)
+		}
+	}
+
+	third := bl.client()
+	if _, reason := bl.allow("/pmb/test", third, 1); reason != "realm rate limit" {
+		t.Fatalf("allow() = %q, want the realm rate limit", reason)
+	}
+	if wait := third.check(1, time.Now()); wait != 0 {
+		t.Errorf("refused client has to wait %s, want nothing counted against it", wait)
+	}
+
+	// each realm has its own limiter
+	if _, reason := bl.allow("/pmb/other", third, 1); len(reason) > 0 {
+		t.Errorf("allow() in another realm = %q, want allowed", reason)
+	}
+}
+
+func TestPublisherKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		client string
+		auth   string
+		want   string
+	}{
+		{name: "token", auth: "Bearer secret", want: "token:secret"},
+		// the id is chosen by the client, so changing it mustn't get a
+		// fresh limit
+		{name: "client id", client: "notify-abc", auth: "Bearer secret", want: "token:secret"},
+		{name: "host", client: "notify-abc", auth: "Basic secret", want: "host:192.0.2.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/pmb/test", nil)
+			r.RemoteAddr = "192.0.2.1:4321"
+			if len(test.client) > 0 {
+				r.Header.Set("X-PMB-Client", test.client)
+			}
+			r.Header.Set("Authorization", test.auth)
+
+			if got := publisherKey(r); got != test.want {
+				t.Errorf("publisherKey() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// brokerStore creates each realm's history, optionally backed by an
+// append-only log file in a data directory so that it survives the broker
+// being restarted.  Log files are compacted once they hold twice as many
+// messages as the history keeps.
+type brokerStore struct {
+	dir    string
+	size   int
+	maxAge time.Duration
+}
+
+const realmLogSuffix = ".log"
+
+func newBrokerStore(dir string, size int, maxAge time.Duration) (*brokerStore, error) {
+	if len(dir) > 0 {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	return &brokerStore{dir: dir, size: size, maxAge: maxAge}, nil
+}
+
+// history returns a realm's history, loading whatever was stored for it.
+func (s *brokerStore) history(realm string) *history {
+	h := newHistory(s.size, s.maxAge)
+	if len(s.dir) == 0 || s.size <= 0 {
+		return h
+	}
+
+	log, entries, err := openRealmLog(filepath.Join(s.dir, url.QueryEscape(realm)+realmLogSuffix))
+	if err != nil {
+		logrus.Warnf("Unable to open history for realm %s, keeping it in memory: %s", realm, err)
+		return h
+	}
+
+	for _, entry := range entries {
+		h.add(entry)
+	}
+	h.log = log
+
+	return h
+}
+
+// realms returns the realms with stored history.
+func (s *brokerStore) realms() []string {
+	if len(s.dir) == 0 {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		logrus.Warnf("Unable to read data dir: %s", err)
+		return nil
+	}
+
+	var realms []string
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), realmLogSuffix) {
+			continue
+		}
+
+		realm, err := url.QueryUnescape(strings.TrimSuffix(file.Name(), realmLogSuffix))
+		if err != nil {
+			continue
+		}
+		realms = append(realms, realm)
+	}
+
+	return realms
+}
+
+// realmLog is the append-only file holding a realm's history, one JSON
+// entry per line.
+type realmLog struct {
+	path  string
+	file  *os.File
+	lines int
+}
+
+type storedEntry struct {
+	Seq         uint64    `json:"seq"`
+	At          time.Time `json:"at"`
+	Destination string    `json:"destination"`
+	Message     []byte    `json:"message"`
+}
+
+func openRealmLog(path string) (*realmLog, []historyEntry, error) {
+	var entries []historyEntry
+
+	existing, err := os.Open(path)
+	if err == nil {
+		scanner := bufio.NewScanner(existing)
+		scanner.Buffer(make([]byte, 64*1024), 2*maxMessageSize)
+		for scanner.Scan() {
+			var stored storedEntry
+			if err := json.Unmarshal(scanner.Bytes(), &stored); err != nil {
+				// most likely a line cut short by a crash
+				logrus.Warnf("Skipping bad entry in %s: %s", path, err)
+				continue
+			}
+
+			entries = append(entries, historyEntry{
+				seq:         stored.Seq,
+				at:          stored.At,
+				destination: stored.Destination,
+				message:     stored.Message,
+			})
+		}
+		existing.Close()
+
+		if err := scanner.Err(); err != nil {
+			return nil, nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &realmLog{path: path, file: file, lines: len(entries)}, entries, nil
+}
+
+func (l *realmLog) append(entry historyEntry) error {
+	line, err := encodeEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := l.file.Write(line); err != nil {
+		return err
+	}
+	l.lines++
+
+	return nil
+}
+
+// rewrite replaces the log with just the given entries.
+func (l *realmLog) rewrite(entries []historyEntry) error {
+	tmp := l.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	for _, entry := range entries {
+		line, err := encodeEntry(entry)
+		if err == nil {
+			_, err = w.Write(line)
+		}
+		if err != nil {
+			file.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	file.Close()
+
+	if err := os.Rename(tmp, l.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	l.file.Close()
+	l.file, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	l.lines = len(entries)
+
+	return nil
+}
+
+// close flushes the log to disk and closes it, when the broker shuts down.
+func (l *realmLog) close() error {
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+
+	return l.file.Close()
+}
+
+// remove closes and deletes the log, once the realm has been retired.
+func (l *realmLog) remove() error {
+	l.file.Close()
+	return os.Remove(l.path)
+}
+
+func encodeEntry(entry historyEntry) ([]byte, error) {
+	line, err := json.Marshal(storedEntry{
+		Seq:         entry.seq,
+		At:          entry.at,
+		Destination: entry.destination,
+		Message:     entry.message,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(line, '\n'), nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBrokerStoreSurvivesRestart(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		added  int
+		replay replayRequest
+		want   []uint64
+	}{
+		{name: "everything", size: 10, added: 4, replay: replayRequest{wanted: true}, want: []uint64{1, 2, 3, 4}},
+		{name: "since seq", size: 10, added: 4, replay: replayRequest{wanted: true, seq: 2}, want: []uint64{3, 4}},
+		// enough to compact the log along the way
+		{name: "compacted", size: 3, added: 8, replay: replayRequest{wanted: true}, want: []uint64{6, 7, 8}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			store, err := newBrokerStore(dir, test.size, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := store.history("/pmb/test")
+			for seq := 1; seq <= test.added; seq++ {
+				h.add(historyEntry{seq: uint64(seq), at: time.Now(), destination: "@all", message: []byte("message")})
+			}
+			h.close()
+
+			if realms := store.realms(); len(realms) != 1 || realms[0] != "/pmb/test" {
+				t.Fatalf("realms() = %q, want the one realm", realms)
+			}
+
+			// as the broker does when it starts again
+			restarted, err := newBrokerStore(dir, test.size, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h = restarted.history("/pmb/test")
+			defer h.close()
+
+			if last := h.lastSeq(); last != uint64(test.added) {
+				t.Errorf("lastSeq() = %d, want %d", last, test.added)
+			}
+
+			got := seqs(h.since(test.replay))
+			if len(got) != len(test.want) {
+				t.Fatalf("since() = %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("since() = %v, want %v", got, test.want)
+				}
+			}
+
+			if lines := countLines(t, filepath.Join(dir, "%2Fpmb%2Ftest"+realmLogSuffix)); lines > 2*test.size {
+				t.Errorf("log has %d lines, want it compacted to at most %d", lines, 2*test.size)
+			}
+		})
+	}
+}
+
+func TestBrokerStoreSkipsTruncatedEntry(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "realm"+realmLogSuffix)
+
+	line, err := encodeEntry(historyEntry{seq: 1, at: time.Now(), destination: "@all", message: []byte("message")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a crash part way through writing the second entry
+	if err := os.WriteFile(path, append(line, line[:len(line)/2]...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	log, entries, err := openRealmLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.close()
+
+	if len(entries) != 1 || entries[0].seq != 1 {
+		t.Errorf("openRealmLog() loaded %v, want just the complete entry", seqs(entries))
+	}
+}
+
+func TestBrokerStoreRetire(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := newBrokerStore(dir, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := store.history("/pmb/test")
+	h.add(historyEntry{seq: 1, at: time.Now(), destination: "@all", message: []byte("message")})
+	h.retire()
+
+	if realms := store.realms(); len(realms) != 0 {
+		t.Errorf("realms() = %q after retiring, want none", realms)
+	}
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines++
+	}
+
+	return lines
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/justone/pmb/api"
+)
+
+// clipboardBackend copies to and pastes from one kind of clipboard.  copy
+// or paste is nil if the backend can't do it.
+type clipboardBackend struct {
+	name   string
+	usable func() bool
+	copy   func(data, selection string) error
+	paste  func(selection string) (string, error)
+}
+
+// clipboardBackends are tried in order, until one works.  Backends that need
+// a display are only tried when there is one.
+var clipboardBackends = []clipboardBackend{
+	{
+		name:   "pbcopy",
+		usable: installed("pbcopy"),
+		copy:   commandCopy(func(string) []string { return []string{"pbcopy"} }),
+		paste:  commandPaste(func(string) []string { return []string{"pbpaste"} }),
+	},
+	{
+		name:   "clip",
+		usable: installed("clip"),
+		copy:   commandCopy(func(string) []string { return []string{"clip"} }),
+	},
+	{
+		name:   "wl-copy",
+		usable: both(installed("wl-copy"), hasEnv("WAYLAND_DISPLAY")),
+		copy: commandCopy(func(selection string) []string {
+			return withPrimary(selection, []string{"wl-copy"}, "--primary")
+		}),
+		paste: commandPaste(func(selection string) []string {
+			return withPrimary(selection, []string{"wl-paste", "--no-newline"}, "--primary")
+		}),
+	},
+	{
+		name:   "xclip",
+		usable: both(installed("xclip"), hasEnv("DISPLAY")),
+		copy: commandCopy(func(selection string) []string {
+			return []string{"xclip", "-selection", selection}
+		}),
+		paste: commandPaste(func(selection string) []string {
+			return []string{"xclip", "-o", "-selection", selection}
+		}),
+	},
+	{
+		name:   "xsel",
+		usable: both(installed("xsel"), hasEnv("DISPLAY")),
+		copy: commandCopy(func(selection string) []string {
+			return []string{"xsel", "--input", "--" + selection}
+		}),
+		paste: commandPaste(func(selection string) []string {
+			return []string{"xsel", "--output", "--" + selection}
+		}),
+	},
+	{
+		name:   "tmux",
+		usable: installed("tmux"),
+		copy:   commandCopy(func(string) []string { return []string{"tmux", "load-buffer", "-"} }),
+		paste:  commandPaste(func(string) []string { return []string{"tmux", "save-buffer", "-"} }),
+	},
+	{
+		name:   "osc52",
+		usable: hasTerminal,
+		copy:   osc52Copy,
+	},
+}
+
+func installed(command string) func() bool {
+	return func() bool {
+		_, err := exec.LookPath(command)
+		return err == nil
+	}
+}
+
+func hasEnv(name string) func() bool {
+	return func() bool {
+		return len(os.Getenv(name)) > 0
+	}
+}
+
+func both(a, b func() bool) func() bool {
+	return func() bool {
+		return a() && b()
+	}
+}
+
+func withPrimary(selection string, args []string, flag string) []string {
+	if selection == pmb.SelectionPrimary {
+		return append(args, flag)
+	}
+
+	return args
+}
+
+func commandCopy(args func(selection string) []string) func(data, selection string) error {
+	return func(data, selection string) error {
+		command := args(selection)
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdin = strings.NewReader(data)
+
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s (%s)", err, strings.TrimSpace(string(output)))
+		}
+
+		return nil
+	}
+}
+
+func commandPaste(args func(selection string) []string) func(selection string) (string, error) {
+	return func(selection string) (string, error) {
+		command := args(selection)
+		data, err := exec.Command(command[0], command[1:]...).Output()
+		if err != nil {
+			return "", err
+		}
+
+		return string(data), nil
+	}
+}
+
+func hasTerminal() bool {
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		return false
+	}
+	tty.Close()
+
+	return true
+}
+
+// osc52Copy asks the terminal to set its clipboard, with an OSC 52 escape
+// sequence.  This works through ssh, as long as the terminal supports it.
+// Inside tmux, the sequence is passed through to the outer terminal, which
+// needs tmux's allow-passthrough option on.
+func osc52Copy(data, selection string) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer tty.Close()
+
+	target := "c"
+	if selection == pmb.SelectionPrimary {
+		target = "p"
+	}
+
+	sequence := fmt.Sprintf("\x1b]52;%s;%s\x07", target, base64.StdEncoding.EncodeToString([]byte(data)))
+	if len(os.Getenv("TMUX")) > 0 {
+		sequence = fmt.Sprintf("\x1bPtmux;%s\x1b\\", strings.Replace(sequence, "\x1b", "\x1b\x1b", -1))
+	}
+
+	_, err = tty.Write([]byte(sequence))
+	return err
+}
+
+// clipboardSettings returns the backends to try and the selection to use,
+// from the clipboard.backend and clipboard.selection config keys.  A
+// selection given by the sender takes precedence over the config.
+func clipboardSettings(selection string) ([]clipboardBackend, string, error) {
+	var backend string
+	if config, err := pmb.NewDefaultConfigClient(); err == nil {
+		backend, _ = config.Get("clipboard.backend")
+		if len(selection) == 0 {
+			selection, _ = config.Get("clipboard.selection")
+		}
+	}
+
+	switch selection {
+	case "":
+		selection = pmb.SelectionClipboard
+	case pmb.SelectionClipboard, pmb.SelectionPrimary:
+	default:
+		return nil, "", fmt.Errorf("unknown clipboard selection %s", selection)
+	}
+
+	if len(backend) == 0 {
+		return clipboardBackends, selection, nil
+	}
+
+	for _, b := range clipboardBackends {
+		if b.name == backend {
+			return []clipboardBackend{b}, selection, nil
+		}
+	}
+
+	return nil, "", fmt.Errorf("unknown clipboard backend %s", backend)
+}
+
+func copyToClipboard(data, selection string) error {
+
+	logrus.Debugf("copy data: %s", strings.Replace(truncate(data, 50), "\n", "\\n", -1))
+
+	backends, selection, err := clipboardSettings(selection)
+	if err != nil {
+		return err
+	}
+
+	var failures []string
+	for _, backend := range backends {
+		if backend.copy == nil || !backend.usable() {
+			continue
+		}
+
+		logrus.Debugf("Copying to %s with %s", selection, backend.name)
+		if err := backend.copy(data, selection); err != nil {
+			logrus.Warningf("Unable to copy with %s: %s", backend.name, err)
+			failures = append(failures, fmt.Sprintf("%s: %s", backend.name, err))
+			continue
+		}
+
+		return nil
+	}
+
+	if len(failures) == 0 {
+		return fmt.Errorf("no clipboard found to copy to")
+	}
+
+	return fmt.Errorf("unable to copy to the clipboard (%s)", strings.Join(failures, "; "))
+}
+
+func pasteFromClipboard(selection string) (string, error) {
+	backends, selection, err := clipboardSettings(selection)
+	if err != nil {
+		return "", err
+	}
+
+	var failures []string
+	for _, backend := range backends {
+		if backend.paste == nil || !backend.usable() {
+			continue
+		}
+
+		logrus.Debugf("Pasting from %s with %s", selection, backend.name)
+		data, err := backend.paste(selection)
+		if err != nil {
+			logrus.Warningf("Unable to paste with %s: %s", backend.name, err)
+			failures = append(failures, fmt.Sprintf("%s: %s", backend.name, err))
+			continue
+		}
+
+		logrus.Debugf("paste data: %s", strings.Replace(truncate(data, 50), "\n", "\\n", -1))
+		return data, nil
+	}
+
+	if len(failures) == 0 {
+		return "", fmt.Errorf("no clipboard found to paste from")
+	}
+
+	return "", fmt.Errorf("unable to paste from the clipboard (%s)", strings.Join(failures, "; "))
+}
@@ -17,7 +17,8 @@ type DumpRawCommand struct {
 var dumpRawCommand DumpRawCommand
 
 func (x *DumpRawCommand) Execute(args []string) error {
-	bus := pmb.GetPMB(globalOptions.Broker)
+	// dump everything on the bus, not just what is sent to us
+	bus := pmb.GetPMB(globalOptions.Broker).Subscribe(pmb.Everything)
 
 	id := pmb.GenerateRandomID("dumpRaw")
 
@@ -46,8 +47,8 @@ func runDumpRaw(conn *pmb.Connection) error {
 	for {
 		message := <-conn.In
 
-		if _, ok := ignoreTypes[message.Contents["type"].(string)]; ok {
-			logrus.Debugf("ignoring message of type %s", message.Contents["type"].(string))
+		if _, ok := ignoreTypes[message.Type()]; ok {
+			logrus.Debugf("ignoring message of type %s", message.Type())
 			continue
 		}
 
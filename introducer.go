@@ -19,6 +19,8 @@ type IntroducerCommand struct {
 	PersistKey  bool    `short:"p" long:"persist-key" description:"Persist the key and re-use it rather than generating a new key every run."`
 	LevelSticky float64 `short:"s" long:"level-sticky" description:"Level at which notifications should 'stick'." default:"3"`
 	Level       float64 `short:"l" long:"level" description:"Priority level, compared to other introducers." default:"5"`
+	Paste       string  `long:"paste" description:"Whether to give the clipboard to remote hosts that ask for it (deny, confirm each time, or allow)." choice:"deny" choice:"confirm" choice:"allow" default:"confirm"`
+	Files       string  `long:"files" description:"Whether to accept files sent with send-file (deny, confirm each time, or allow).  They are saved in the directory set by files.downloads, ~/Downloads by default." choice:"deny" choice:"confirm" choice:"allow" default:"confirm"`
 }
 
 var introducerCommand IntroducerCommand
@@ -94,107 +96,59 @@ func init() {
 		&introducerCommand)
 }
 
-func sendPresent(out chan pmb.Message, level float64) {
-	out <- pmb.Message{Contents: map[string]interface{}{"type": "IntroducerPresent", "level": level}}
-}
-
-func sendRollCall(out chan pmb.Message) {
-	out <- pmb.Message{Contents: map[string]interface{}{"type": "IntroducerRollCall"}}
-}
-
 func runIntroducer(bus *pmb.PMB, conn *pmb.Connection, level float64) error {
-	active := true
-	sendPresent(conn.Out, level)
-	sendRollCall(conn.Out)
+	handlers, err := introducerHandlers(bus)
+	if err != nil {
+		return err
+	}
+
+	outage := false
+	election := pmb.NewElection(conn, level)
+	election.Start()
 
 	logrus.Infof("Introducer ready (doing roll call).")
 	for {
-		introTimeout := time.After(time.Second * 30)
+		introTimeout := time.After(pmb.ElectionTimeout)
 		select {
 		case <-introTimeout:
-			if !active {
-				logrus.Infof("checking if I should become active...")
-				active = true
-				sendRollCall(conn.Out)
-			}
-		case message := <-conn.In:
-			if message.Contents["type"].(string) == "IntroducerPresent" {
-				logrus.Debugf("IntroducerPresent message received")
-				if message.Contents["level"].(float64) > level {
-					logrus.Infof("deactivating, saw an introducer with level %0.2f, which is higher than my %0.2f", message.Contents["level"].(float64), level)
-					active = false
-				}
-			} else if message.Contents["type"].(string) == "IntroducerRollCall" {
-				logrus.Debugf("IntroducerRollCall message received")
-				sendPresent(conn.Out, level)
-			} else if message.Contents["type"].(string) == "Reconnected" {
-				active = true
-				logrus.Infof("checking if I should become active... (after reconnect)")
-				sendPresent(conn.Out, level)
-				sendRollCall(conn.Out)
-			} else if active {
-				if message.Contents["type"].(string) == "CopyData" {
-					copyToClipboard(message.Contents["data"].(string))
-					displayNotice("Remote copy complete.", false)
-
-					data := map[string]interface{}{
-						"type":   "DataCopied",
-						"origin": message.Contents["id"].(string),
-					}
-					conn.Out <- pmb.Message{Contents: data}
-				} else if message.Contents["type"].(string) == "OpenURL" {
-					var isHTML bool
-					if isHTMLRaw, ok := message.Contents["is_html"]; ok {
-						isHTML = isHTMLRaw.(bool)
-					} else {
-						isHTML = false
-					}
-
-					err := openURL(message.Contents["data"].(string), isHTML)
-					if err != nil {
-						displayNotice(fmt.Sprintf("Unable to open url: %v", err), false)
-						continue
-					}
-
-					displayNotice("URL opened.", false)
-
-					data := map[string]interface{}{
-						"type":   "URLOpened",
-						"origin": message.Contents["id"].(string),
-					}
-					conn.Out <- pmb.Message{Contents: data}
-				} else if message.Contents["type"].(string) == "TestAuth" {
-					data := map[string]interface{}{
-						"type":   "AuthValid",
-						"origin": message.Contents["id"].(string),
-					}
-					conn.Out <- pmb.Message{Contents: data}
-				} else if message.Contents["type"].(string) == "RequestAuth" {
-					copyToClipboard(strings.Join(conn.Keys, ","))
-					displayNotice("Copied key.", false)
-				} else if message.Contents["type"].(string) == "Notification" {
-					level := message.Contents["level"].(float64)
-
-					displayNotice(message.Contents["message"].(string), level >= introducerCommand.LevelSticky)
-					ssRunning, _ := screensaverRunning()
-
-					data := map[string]interface{}{
-						"type":            "NotificationDisplayed",
-						"origin":          message.Contents["id"].(string),
-						"notification-id": message.Contents["notification-id"].(string),
-						"level":           level,
-						"message":         message.Contents["message"].(string),
-						"screenSaverOn":   ssRunning,
-					}
-					conn.Out <- pmb.Message{Contents: data}
+			election.Timeout()
+		case state := <-conn.State():
+			switch state {
+			case pmb.Disconnected:
+				outage = true
+				logrus.Warningf("Lost connection to the broker, reconnecting...")
+				displayNotice("PMB introducer lost connection to the broker.", false)
+			case pmb.Connected:
+				if outage {
+					outage = false
+					logrus.Infof("Connection to the broker restored.")
+					displayNotice("PMB introducer reconnected to the broker.", false)
 				}
-				// any other message type is an error and ignored
-			} else {
+			case pmb.GaveUp:
+				displayNotice("PMB introducer gave up reconnecting to the broker.", true)
+				return fmt.Errorf("Gave up reconnecting to the broker")
+			}
+		case message, ok := <-conn.In:
+			if !ok {
+				return pmb.ErrClosed
+			}
+
+			if election.Handle(message) {
+				continue
+			}
+
+			if !election.Active() {
 				logrus.Debugf("Skipped message due to being inactive")
+				continue
+			}
+
+			// any message type without a handler is ignored
+			err := handlers.Dispatch(conn, message)
+			if err != nil && err != pmb.ErrNoHandler {
+				logrus.Warningf("Unable to handle %s message: %s", message.Type(), err)
 			}
 		}
 	}
-	return nil
 }
 
 func screensaverRunning() (bool, error) {
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/justone/pmb/api"
+)
+
+// introducerHandlers returns the handlers for the messages an introducer
+// acts on.  Handlers from the [handlers] config section are added after the
+// built-in ones, so they can replace them as well as handle new types.
+func introducerHandlers(bus *pmb.PMB) (*pmb.Handlers, error) {
+	handlers := pmb.NewHandlers()
+
+	history, err := pmb.NewDefaultNotificationLog()
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Recording notifications in %s", history.Path())
+
+	handlers.RegisterFunc("CopyData", handleCopyData)
+	handlers.RegisterFunc("OpenURL", handleOpenURL)
+	handlers.RegisterFunc("TestAuth", handleTestAuth)
+	handlers.RegisterFunc("RequestAuth", handleRequestAuth)
+	handlers.Register("Notification", notificationHandler(history))
+	handlers.Register("RequestNotifications", notificationHistoryHandler(history))
+	handlers.RegisterFunc("RequestClipboard", handleRequestClipboard)
+	handlers.Register("FileOffer", fileOfferHandler(bus))
+
+	commands, err := configuredHandlers()
+	if err != nil {
+		return nil, err
+	}
+	for messageType, args := range commands {
+		logrus.Infof("Handling %s messages with %s", messageType, strings.Join(args, " "))
+		handlers.Register(messageType, commandHandler(args))
+	}
+
+	return handlers, nil
+}
+
+// configuredHandlers returns the commands in the [handlers] config section,
+// keyed by the message type they handle, e.g.
+//
+//	[handlers]
+//	Deploy = /usr/local/bin/deploy --quiet
+func configuredHandlers() (map[string][]string, error) {
+	config, err := pmb.NewDefaultConfigClient()
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := config.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	commands := make(map[string][]string)
+	for key, value := range all {
+		if !strings.HasPrefix(key, "handlers.") {
+			continue
+		}
+
+		args := strings.Fields(value)
+		if len(args) == 0 {
+			return nil, fmt.Errorf("No command given to handle %s messages", strings.TrimPrefix(key, "handlers."))
+		}
+		commands[strings.TrimPrefix(key, "handlers.")] = args
+	}
+
+	return commands, nil
+}
+
+func handleCopyData(conn *pmb.Connection, message pmb.Message) error {
+	body, err := pmb.Decode(message)
+	if err != nil {
+		return err
+	}
+	copyData := body.(*pmb.CopyData)
+
+	if err := copyToClipboard(copyData.Data, copyData.Selection); err != nil {
+		displayNotice("Remote copy failed.", false)
+		conn.Out <- pmb.Reply(copyData.Header, &pmb.CopyFailed{Origin: copyData.ID, Reason: err.Error()})
+		return err
+	}
+	displayNotice("Remote copy complete.", false)
+
+	conn.Out <- pmb.Reply(copyData.Header, &pmb.DataCopied{Origin: copyData.ID})
+	return nil
+}
+
+func handleOpenURL(conn *pmb.Connection, message pmb.Message) error {
+	body, err := pmb.Decode(message)
+	if err != nil {
+		return err
+	}
+	openURLBody := body.(*pmb.OpenURL)
+
+	if err := openURL(openURLBody.Data, openURLBody.IsHTML); err != nil {
+		displayNotice(fmt.Sprintf("Unable to open url: %v", err), false)
+		return err
+	}
+
+	displayNotice("URL opened.", false)
+
+	conn.Out <- pmb.Reply(openURLBody.Header, &pmb.URLOpened{Origin: openURLBody.ID})
+	return nil
+}
+
+func handleTestAuth(conn *pmb.Connection, message pmb.Message) error {
+	body, err := pmb.Decode(message)
+	if err != nil {
+		return err
+	}
+	testAuth := body.(*pmb.TestAuth)
+
+	conn.Out <- pmb.Reply(testAuth.Header, &pmb.AuthValid{Origin: testAuth.ID})
+	return nil
+}
+
+func handleRequestAuth(conn *pmb.Connection, message pmb.Message) error {
+	if _, err := pmb.Decode(message); err != nil {
+		return err
+	}
+
+	if err := copyToClipboard(strings.Join(conn.Keys, ","), ""); err != nil {
+		displayNotice("Unable to copy key.", false)
+		return err
+	}
+	displayNotice("Copied key.", false)
+	return nil
+}
+
+// notificationHandler displays notifications, and records them in the
+// history along with how they were displayed.
+func notificationHandler(history *pmb.NotificationLog) pmb.Handler {
+	return pmb.HandlerFunc(func(conn *pmb.Connection, message pmb.Message) error {
+		body, err := pmb.Decode(message)
+		if err != nil {
+			return err
+		}
+		notification := body.(*pmb.Notification)
+
+		sticky := notification.Level >= introducerCommand.LevelSticky
+		displayNotice(notification.Message, sticky)
+		ssRunning, _ := screensaverRunning()
+
+		conn.Out <- pmb.Reply(notification.Header, &pmb.NotificationDisplayed{
+			Origin:         notification.ID,
+			NotificationID: notification.NotificationID,
+			Level:          notification.Level,
+			Message:        notification.Message,
+			ScreenSaverOn:  ssRunning,
+		})
+
+		entry := pmb.NotificationEntry{
+			NotificationID: notification.NotificationID,
+			Message:        notification.Message,
+			URL:            notification.URL,
+			Level:          notification.Level,
+			Hostname:       notification.Hostname,
+			IP:             notification.IP,
+			Sent:           notification.Sent,
+			Received:       time.Now().Format(time.RFC3339),
+			Sticky:         sticky,
+			ScreenSaverOn:  ssRunning,
+		}
+		if err := history.Add(entry); err != nil {
+			return fmt.Errorf("unable to record notification: %s", err)
+		}
+		conn.Out <- pmb.EncodeTo(notificationsTopic, &pmb.NotificationRecorded{Entry: entry})
+
+		return nil
+	})
+}
+
+// notificationHistoryHandler replies with the notifications in the history
+// that match the request.
+func notificationHistoryHandler(history *pmb.NotificationLog) pmb.Handler {
+	return pmb.HandlerFunc(func(conn *pmb.Connection, message pmb.Message) error {
+		body, err := pmb.Decode(message)
+		if err != nil {
+			return err
+		}
+		request := body.(*pmb.RequestNotifications)
+
+		entries, err := history.Query(pmb.NotificationFilter{Search: request.Search, Level: request.Level, Count: request.Count})
+		if err != nil {
+			return err
+		}
+
+		entries, truncated := fitNotifications(entries, maxRemoteNotificationsSize)
+		conn.Out <- pmb.Reply(request.Header, &pmb.NotificationHistory{Origin: request.ID, Entries: entries, Truncated: truncated})
+		return nil
+	})
+}
+
+// fitNotifications returns as many of the most recent entries as fit in
+// size bytes of JSON, and whether any had to be left out.
+func fitNotifications(entries []pmb.NotificationEntry, size int) ([]pmb.NotificationEntry, bool) {
+	total := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		encoded, err := json.Marshal(entries[i])
+		if err != nil {
+			return entries[i+1:], true
+		}
+
+		// and a comma to separate it from the next
+		if total += len(encoded) + 1; total > size {
+			return entries[i+1:], true
+		}
+	}
+
+	return entries, false
+}
+
+// how long the user has to allow a paste or a file, before it's denied
+const confirmTimeout = 30 * time.Second
+
+// how many paste confirmations can be open at once, across all hosts
+const maxPendingPastes = 3
+
+// pendingPastes tracks the paste confirmations waiting for the user, so
+// that a host asking over and over doesn't fill the desktop with dialogs.
+// Each host gets one at a time, and requests while it's open are denied.
+type pendingPastes struct {
+	sync.Mutex
+	hosts map[string]bool
+}
+
+var pastes = &pendingPastes{hosts: make(map[string]bool)}
+
+// start reports whether a confirmation can be opened for host, and if so
+// records it as open until finish is called.
+func (p *pendingPastes) start(host string) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.hosts[host] || len(p.hosts) >= maxPendingPastes {
+		return false
+	}
+	p.hosts[host] = true
+
+	return true
+}
+
+func (p *pendingPastes) finish(host string) {
+	p.Lock()
+	defer p.Unlock()
+
+	delete(p.hosts, host)
+}
+
+// handleRequestClipboard replies with the clipboard, if the paste policy
+// allows.  Asking the user can take a while, so it happens in the
+// background rather than holding up other messages.
+func handleRequestClipboard(conn *pmb.Connection, message pmb.Message) error {
+	body, err := pmb.Decode(message)
+	if err != nil {
+		return err
+	}
+	request := body.(*pmb.RequestClipboard)
+
+	deny := func(reason string) {
+		logrus.Warningf("Denied paste to %s (%s): %s", request.Hostname, request.IP, reason)
+		conn.Out <- pmb.Reply(request.Header, &pmb.ClipboardDenied{Origin: request.ID, Reason: reason})
+	}
+
+	switch introducerCommand.Paste {
+	case "allow":
+	case "confirm":
+		host := fmt.Sprintf("%s (%s)", request.Hostname, request.IP)
+		if !pastes.start(host) {
+			deny("already waiting for the user to allow a paste")
+			return nil
+		}
+
+		go func() {
+			defer pastes.finish(host)
+
+			question := fmt.Sprintf("Allow %s to paste from the clipboard?", host)
+			if !confirm(question, confirmTimeout) {
+				deny("refused by the user")
+				return
+			}
+			sendClipboard(conn, request)
+		}()
+		return nil
+	default:
+		deny("pasting is disabled")
+		return nil
+	}
+
+	sendClipboard(conn, request)
+	return nil
+}
+
+func sendClipboard(conn *pmb.Connection, request *pmb.RequestClipboard) {
+	data, err := pasteFromClipboard(request.Selection)
+	if err != nil {
+		logrus.Warningf("Unable to read the clipboard: %s", err)
+		conn.Out <- pmb.Reply(request.Header, &pmb.ClipboardDenied{Origin: request.ID, Reason: err.Error()})
+		return
+	}
+
+	displayNotice(fmt.Sprintf("Clipboard pasted to %s.", request.Hostname), false)
+	conn.Out <- pmb.Reply(request.Header, &pmb.ClipboardData{Origin: request.ID, Data: data})
+}
+
+// fileOfferHandler receives offered files into the downloads directory, if
+// the files policy allows.  Transfers take a while, so they happen in the
+// background.
+func fileOfferHandler(bus *pmb.PMB) pmb.Handler {
+	return pmb.HandlerFunc(func(conn *pmb.Connection, message pmb.Message) error {
+		body, err := pmb.Decode(message)
+		if err != nil {
+			return err
+		}
+		offer := body.(*pmb.FileOffer)
+
+		if introducerCommand.Files == "deny" {
+			return rejectFile(conn, offer, "receiving files is disabled")
+		}
+
+		dir, err := downloadsDir()
+		if err != nil {
+			return rejectFile(conn, offer, err.Error())
+		}
+
+		go func() {
+			if introducerCommand.Files == "confirm" {
+				question := fmt.Sprintf("Accept %s (%d bytes) from %s (%s)?", offer.Name, offer.Size, offer.Hostname, offer.IP)
+				if !confirm(question, confirmTimeout) {
+					logrus.Warningf("%s", rejectFile(conn, offer, "refused by the user"))
+					return
+				}
+			}
+
+			path, err := receiveFile(bus, conn, offer, dir)
+			if err != nil {
+				logrus.Warningf("%s", err)
+				displayNotice(fmt.Sprintf("Unable to receive %s.", offer.Name), false)
+				return
+			}
+			displayNotice(fmt.Sprintf("Received %s.", path), false)
+		}()
+
+		return nil
+	})
+}
+
+// downloadsDir returns where received files are saved, from the
+// files.downloads config key.
+func downloadsDir() (string, error) {
+	if config, err := pmb.NewDefaultConfigClient(); err == nil {
+		if dir, _ := config.Get("files.downloads"); len(dir) > 0 {
+			return dir, nil
+		}
+	}
+
+	home := os.Getenv("HOME")
+	if len(home) == 0 {
+		return "", fmt.Errorf("$HOME environment variable not found")
+	}
+
+	return filepath.Join(home, "Downloads"), nil
+}
+
+// how long a configured handler's command can run before it's killed
+const commandTimeout = time.Minute
+
+// commandHandler runs a command for each message, as plugins do, writing
+// the message to its stdin.  Each JSON object the command writes to stdout
+// is sent back to the sender of the message.  Commands run in the
+// background, so a slow one doesn't hold up other messages.
+func commandHandler(args []string) pmb.Handler {
+	return pmb.HandlerFunc(func(conn *pmb.Connection, message pmb.Message) error {
+		go func() {
+			if err := runHandlerCommand(conn, message, args, commandTimeout); err != nil {
+				logrus.Warningf("Handler for %s messages: %s", message.Type(), err)
+			}
+		}()
+
+		return nil
+	})
+}
+
+func runHandlerCommand(conn *pmb.Connection, message pmb.Message, args []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(message.Raw)
+	cmd.Stderr = os.Stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// killing the command doesn't stop anything it started, which can
+	// keep stdout open, so stop reading too
+	stop := context.AfterFunc(ctx, func() { stdout.Close() })
+	defer stop()
+
+	sender, _ := message.Contents["id"].(string)
+	requestID, _ := message.Contents["request-id"].(string)
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		var contents map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &contents); err != nil {
+			logrus.Debugf("Skipping output from %s that isn't a JSON object: %s", args[0], scanner.Text())
+			continue
+		}
+
+		reply := pmb.Message{Contents: contents}
+		if len(sender) > 0 {
+			reply.Destination = pmb.ToClient(sender)
+		}
+		if _, ok := contents["request-id"]; !ok && len(requestID) > 0 {
+			contents["request-id"] = requestID
+		}
+
+		// nothing sends what's on Out once the connection is closed
+		select {
+		case conn.Out <- reply:
+		case <-conn.Done():
+			cancel()
+			cmd.Wait()
+			return pmb.ErrClosed
+		}
+	}
+
+	if err := cmd.Wait(); ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s killed after running for %s", args[0], timeout)
+	} else if err != nil {
+		return fmt.Errorf("%s failed: %s", args[0], err)
+	}
+
+	return nil
+}
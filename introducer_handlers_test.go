@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/justone/pmb/api"
+	"github.com/justone/pmb/api/pmbtest"
+)
+
+func TestNotificationHistoryReply(t *testing.T) {
+	tests := []struct {
+		name          string
+		messageSize   int
+		count         int
+		wantEntries   int
+		wantTruncated bool
+	}{
+		{name: "small", messageSize: 100, count: 0, wantEntries: 50},
+		{name: "count", messageSize: 100, count: 5, wantEntries: 5},
+		// 50 of these are well over the broker's limit
+		{name: "too big", messageSize: 10 * 1024, count: 0, wantEntries: 17, wantTruncated: true},
+		{name: "too big, but few enough", messageSize: 10 * 1024, count: 10, wantEntries: 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := pmbtest.NewHarness(t)
+
+			history := pmb.NewNotificationLog(filepath.Join(t.TempDir(), "notifications.jsonl"))
+			for i := 0; i < 50; i++ {
+				message := fmt.Sprintf("%02d %s", i, strings.Repeat("x", test.messageSize))
+				if err := history.Add(pmb.NotificationEntry{Message: message, Level: 3}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// the handler answers on a connection of its own, as the
+			// active introducer would
+			handlerConn := pmbtest.ConnectClient(t, h, "history-handler")
+			handler := notificationHistoryHandler(history)
+			go func() {
+				for message := range handlerConn.In {
+					if message.Type() == "RequestNotifications" {
+						handler.Handle(handlerConn, message)
+					}
+				}
+			}()
+
+			conn := pmbtest.ConnectClient(t, h, "history-test")
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			reply, err := conn.Request(ctx, pmb.EncodeTo(pmb.ToClient("history-handler"), &pmb.RequestNotifications{Count: test.count}), "NotificationHistory")
+			if err != nil {
+				t.Fatalf("no reply: %s", err)
+			}
+
+			if size := len(reply.Raw); size > 256*1024*3/4 {
+				t.Errorf("reply is %d bytes, too big to send once encrypted", size)
+			}
+
+			body, err := pmb.Decode(reply)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := body.(*pmb.NotificationHistory)
+			if len(got.Entries) != test.wantEntries || got.Truncated != test.wantTruncated {
+				t.Fatalf("reply has %d entries (truncated: %t), want %d (truncated: %t)", len(got.Entries), got.Truncated, test.wantEntries, test.wantTruncated)
+			}
+			if last := got.Entries[len(got.Entries)-1].Message; !strings.HasPrefix(last, "49 ") {
+				t.Errorf("last entry is %.10q, want the most recent", last)
+			}
+		})
+	}
+}
+
+func TestCommandHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		script    string
+		timeout   time.Duration
+		wantReply bool
+		wantErr   string
+	}{
+		{name: "reply", script: `cat >/dev/null; echo '{"type":"Deployed","status":"ok"}'`, timeout: 5 * time.Second, wantReply: true},
+		{name: "not json", script: `cat >/dev/null; echo deployed`, timeout: 5 * time.Second},
+		{name: "fails", script: `cat >/dev/null; exit 3`, timeout: 5 * time.Second, wantErr: "sh failed: exit status 3"},
+		{name: "too slow", script: `cat >/dev/null; sleep 2`, timeout: 200 * time.Millisecond, wantErr: "sh killed after running for 200ms"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := pmbtest.NewHarness(t)
+			handlerConn := pmbtest.ConnectClient(t, h, "command-handler")
+			conn := pmbtest.ConnectClient(t, h, "command-test")
+
+			conn.Out <- pmb.Message{
+				Contents:    map[string]interface{}{"type": "Deploy", "request-id": "deploy-1"},
+				Destination: pmb.ToClient("command-handler"),
+			}
+
+			var message pmb.Message
+			select {
+			case message = <-handlerConn.In:
+			case <-time.After(5 * time.Second):
+				t.Fatal("handler didn't receive the message")
+			}
+
+			err := runHandlerCommand(handlerConn, message, []string{"sh", "-c", test.script}, test.timeout)
+			if len(test.wantErr) == 0 && err != nil {
+				t.Fatalf("runHandlerCommand() = %v, want no error", err)
+			} else if len(test.wantErr) > 0 && (err == nil || err.Error() != test.wantErr) {
+				t.Fatalf("runHandlerCommand() = %v, want %q", err, test.wantErr)
+			}
+
+			select {
+			case reply := <-conn.In:
+				if !test.wantReply {
+					t.Fatalf("unexpected reply %s", reply.Type())
+				}
+				if reply.Type() != "Deployed" || reply.Contents["request-id"] != "deploy-1" {
+					t.Errorf("reply %s with request-id %v, want Deployed with deploy-1", reply.Type(), reply.Contents["request-id"])
+				}
+			case <-time.After(500 * time.Millisecond):
+				if test.wantReply {
+					t.Fatal("no reply from the command")
+				}
+			}
+		})
+	}
+}
+
+func TestCommandHandlerDoesntBlock(t *testing.T) {
+	h := pmbtest.NewHarness(t)
+	conn := pmbtest.ConnectClient(t, h, "command-test")
+
+	handler := commandHandler([]string{"sleep", "2"})
+
+	start := time.Now()
+	if err := handler.Handle(conn, pmb.Message{Contents: map[string]interface{}{"type": "Deploy"}}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Handle() took %s, want it to return while the command runs", elapsed)
+	}
+}
+
+func TestCommandHandlerAfterClose(t *testing.T) {
+	h := pmbtest.NewHarness(t)
+	conn := pmbtest.ConnectClient(t, h, "command-handler")
+	conn.Close()
+
+	// more replies than Out holds, with nothing sending them
+	script := `cat >/dev/null; for i in $(seq 20); do echo '{"type":"Deployed"}'; done`
+
+	done := make(chan error, 1)
+	go func() {
+		done <- runHandlerCommand(conn, pmb.Message{Contents: map[string]interface{}{"type": "Deploy"}}, []string{"sh", "-c", script}, 5*time.Second)
+	}()
+
+	select {
+	case err := <-done:
+		if err != pmb.ErrClosed {
+			t.Errorf("runHandlerCommand() = %v, want %v", err, pmb.ErrClosed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("runHandlerCommand() blocked after the connection closed")
+	}
+}
+
+func TestPendingPastes(t *testing.T) {
+	p := &pendingPastes{hosts: make(map[string]bool)}
+
+	if !p.start("laptop (192.0.2.1)") {
+		t.Fatal("first paste refused")
+	}
+	if p.start("laptop (192.0.2.1)") {
+		t.Error("second paste from the same host allowed while the first is open")
+	}
+
+	for i := 2; i <= maxPendingPastes; i++ {
+		if !p.start(fmt.Sprintf("host%d", i)) {
+			t.Fatalf("paste from host%d refused", i)
+		}
+	}
+	if p.start("one-too-many") {
+		t.Errorf("more than %d pastes open at once", maxPendingPastes)
+	}
+
+	p.finish("laptop (192.0.2.1)")
+	if !p.start("laptop (192.0.2.1)") {
+		t.Error("paste refused after the first was answered")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hpcloud/tail"
+	"github.com/justone/pmb/api"
+)
+
+type NotificationsCommand struct {
+	Count   int           `short:"n" long:"count" description:"Number of notifications to show, 0 for all of them (with --remote, as many as fit in one reply)." default:"20"`
+	Search  string        `short:"s" long:"search" description:"Only show notifications containing this text, in the message, URL or sender."`
+	Level   float64       `short:"l" long:"level" description:"Only show notifications of at least this level."`
+	Follow  bool          `short:"f" long:"follow" description:"Keep showing notifications as they arrive, like 'tail -f'."`
+	Remote  bool          `short:"r" long:"remote" description:"Ask the active introducer, rather than reading the local history."`
+	JSON    bool          `long:"json" description:"Show each notification as a line of JSON."`
+	Timeout time.Duration `long:"timeout" description:"How long to wait for the introducer to reply." default:"5s"`
+}
+
+var notificationsCommand NotificationsCommand
+
+// notificationsTopic is where introducers send each notification they
+// record, for pmb notifications --follow --remote.
+var notificationsTopic = pmb.ToTopic("notifications")
+
+// the most history, as JSON, that an introducer sends in one reply.
+// Replies are encrypted and base64 encoded, which adds a third, so this
+// keeps them under the broker's 256KB message size limit.
+const maxRemoteNotificationsSize = 180 * 1024
+
+func (x *NotificationsCommand) Execute(args []string) error {
+	filter := pmb.NotificationFilter{
+		Search: notificationsCommand.Search,
+		Level:  notificationsCommand.Level,
+		Count:  notificationsCommand.Count,
+	}
+
+	if notificationsCommand.Remote {
+		return runRemoteNotifications(filter)
+	}
+
+	return runLocalNotifications(filter)
+}
+
+func init() {
+	parser.AddCommand("notifications",
+		"Show notification history.",
+		"Lists the notifications recorded by the introducer.  Without --remote, this reads the history on this machine, which is where the introducer records it.",
+		&notificationsCommand)
+}
+
+func runLocalNotifications(filter pmb.NotificationFilter) error {
+	history, err := pmb.NewDefaultNotificationLog()
+	if err != nil {
+		return err
+	}
+
+	entries, err := history.Query(filter)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		printNotification(entry)
+	}
+
+	if !notificationsCommand.Follow {
+		return nil
+	}
+
+	fileTail, err := tail.TailFile(history.Path(), tail.Config{
+		Follow:    true,
+		ReOpen:    true,
+		MustExist: false,
+		Logger:    tail.DiscardingLogger,
+		Location:  &tail.SeekInfo{Offset: 0, Whence: os.SEEK_END},
+	})
+	if err != nil {
+		return err
+	}
+
+	for line := range fileTail.Lines {
+		var entry pmb.NotificationEntry
+		if err := json.Unmarshal([]byte(line.Text), &entry); err != nil {
+			continue
+		}
+		if filter.Matches(entry) {
+			printNotification(entry)
+		}
+	}
+
+	return fileTail.Err()
+}
+
+func runRemoteNotifications(filter pmb.NotificationFilter) error {
+	bus := pmb.GetPMB(globalOptions.Broker)
+	if notificationsCommand.Follow {
+		bus = bus.Subscribe(notificationsTopic)
+	}
+
+	id := pmb.GenerateRandomID("notifications")
+
+	conn, err := bus.ConnectClient(id, !globalOptions.TrustKey)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notificationsCommand.Timeout)
+	defer cancel()
+
+	reply, err := conn.Request(ctx, pmb.EncodeTo(pmb.ToRole(pmb.IntroducerRole), &pmb.RequestNotifications{
+		Search: filter.Search,
+		Level:  filter.Level,
+		Count:  filter.Count,
+	}), "NotificationHistory")
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("No reply from the introducer...")
+	} else if err != nil {
+		return err
+	}
+
+	body, err := pmb.Decode(reply)
+	if err != nil {
+		return err
+	}
+	history := body.(*pmb.NotificationHistory)
+	if history.Truncated {
+		logrus.Warnf("Only the most recent %d notifications fit in the introducer's reply", len(history.Entries))
+	}
+	for _, entry := range history.Entries {
+		printNotification(entry)
+	}
+
+	if !notificationsCommand.Follow {
+		return nil
+	}
+
+	for message := range conn.In {
+		body, err := pmb.Decode(message)
+		if err != nil {
+			continue
+		}
+
+		if recorded, ok := body.(*pmb.NotificationRecorded); ok && filter.Matches(recorded.Entry) {
+			printNotification(recorded.Entry)
+		}
+	}
+
+	return pmb.ErrClosed
+}
+
+func printNotification(entry pmb.NotificationEntry) {
+	if notificationsCommand.JSON {
+		line, _ := json.Marshal(entry)
+		fmt.Println(string(line))
+		return
+	}
+
+	received := entry.Received
+	if at, err := time.Parse(time.RFC3339, entry.Received); err == nil {
+		received = at.Local().Format("2006-01-02 15:04:05")
+	}
+
+	var notes []string
+	if entry.Sticky {
+		notes = append(notes, "sticky")
+	}
+	if entry.ScreenSaverOn {
+		notes = append(notes, "screensaver on")
+	}
+	if len(entry.URL) > 0 {
+		notes = append(notes, entry.URL)
+	}
+
+	extra := ""
+	if len(notes) > 0 {
+		extra = fmt.Sprintf("  (%s)", strings.Join(notes, ", "))
+	}
+
+	fmt.Printf("%s  level %g  %s (%s)  %s%s\n", received, entry.Level, entry.Hostname, entry.IP, entry.Message, extra)
+}
@@ -22,10 +22,7 @@ func (x *NotifyCommand) Execute(args []string) error {
 
 	id := pmb.GenerateRandomID("notify")
 
-	conn, err := bus.ConnectClient(id, !globalOptions.TrustKey)
-	if err != nil {
-		return err
-	}
+	conn := connectOrQueue(bus, id)
 
 	return runNotify(conn, id)
 }
@@ -42,5 +39,5 @@ func runNotify(conn *pmb.Connection, id string) error {
 	message := notifyCommand.Message
 
 	note := pmb.Notification{Message: message, Level: notifyCommand.Level}
-	return pmb.SendNotification(conn, note)
+	return notifyOrQueue(conn, note)
 }
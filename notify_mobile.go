@@ -21,8 +21,16 @@ type NotifyMobileCommand struct {
 
 var notifyMobileCommand NotifyMobileCommand
 
+// how long a notification has to be displayed before it's sent on as
+// unacknowledged
+var unackTimeout = 5 * time.Second
+
+// a mobileSender sends a notification to the mobile provider
+type mobileSender func(message string) error
+
 func (x *NotifyMobileCommand) Execute(args []string) error {
-	bus := pmb.GetPMB(globalOptions.Broker)
+	// watch all notifications, not just those sent to us
+	bus := pmb.GetPMB(globalOptions.Broker).Subscribe(pmb.Everything)
 
 	// get necessary Pushover parameters from environment or options
 	var token string
@@ -53,7 +61,7 @@ func (x *NotifyMobileCommand) Execute(args []string) error {
 		return err
 	}
 
-	return runNotifyMobile(conn, id, token, userKey)
+	return runNotifyMobile(conn, id, pushoverSender(token, userKey))
 }
 
 func init() {
@@ -63,38 +71,52 @@ func init() {
 		&notifyMobileCommand)
 }
 
-func waitForComplete(message pmb.Message, complete chan bool, reapChan chan string, pushoverChan chan pmb.Message) {
-	notificationId := message.Contents["notification-id"].(string)
+// notice returns the fields shared by Notification and NotificationDisplayed
+// messages.
+func notice(body pmb.Body) (notificationId string, message string) {
+	switch body := body.(type) {
+	case *pmb.Notification:
+		return body.NotificationID, body.Message
+	case *pmb.NotificationDisplayed:
+		return body.NotificationID, body.Message
+	}
+
+	return "", ""
+}
+
+func waitForComplete(body pmb.Body, complete chan bool, reapChan chan string, pushoverChan chan pmb.Body) {
+	notificationId, _ := notice(body)
 
 	select {
 	case <-complete:
 		logrus.Infof("Notification was acknowledged")
 		reapChan <- notificationId
-	case <-time.After(5 * time.Second):
+	case <-time.After(unackTimeout):
 		logrus.Infof("Notification was never acknowledged, sending to Pushover")
-		pushoverChan <- message
+		pushoverChan <- body
 		reapChan <- notificationId
 	}
 }
 
-func unackAgent(in chan pmb.Message, pushoverChan chan pmb.Message) {
+func unackAgent(in chan pmb.Body, pushoverChan chan pmb.Body) {
 	reapChan := make(chan string)
 	completeChans := make(map[string]chan bool)
 
 	for {
 		select {
-		case message := <-in:
-			notificationId := message.Contents["notification-id"].(string)
-			if message.Contents["type"].(string) == "NotificationDisplayed" {
+		case body := <-in:
+			notificationId, _ := notice(body)
+			switch body.(type) {
+			case *pmb.NotificationDisplayed:
 				logrus.Infof("Notification Displayed")
 				if complete, ok := completeChans[notificationId]; ok {
 					complete <- true
 				}
-			} else if message.Contents["type"].(string) == "Notification" {
+			case *pmb.Notification:
 				logrus.Infof("Notification Sent")
 				complete := make(chan bool)
 				completeChans[notificationId] = complete
-				go waitForComplete(message, complete, reapChan, pushoverChan)
+				go waitForComplete(body, complete, reapChan, pushoverChan)
 			}
 		case notificationId := <-reapChan:
 			logrus.Infof("Reaping channel for notification id %s", notificationId)
@@ -108,45 +130,46 @@ func unackAgent(in chan pmb.Message, pushoverChan chan pmb.Message) {
 	}
 }
 
-func runNotifyMobile(conn *pmb.Connection, id string, token string, userKey string) error {
+func runNotifyMobile(conn *pmb.Connection, id string, send mobileSender) error {
 
 	logrus.Debugf("always: %f, unacknowledged: %f, unseen: %f\n", notifyMobileCommand.LevelAlways, notifyMobileCommand.LevelUnacknowledged, notifyMobileCommand.LevelUnseen)
 
 	logrus.Infof("starting mobile notifiation.")
 
-	pushoverChan := make(chan pmb.Message)
-	go pushoverAgent(pushoverChan, token, userKey)
+	pushoverChan := make(chan pmb.Body)
+	go pushoverAgent(pushoverChan, send)
 
-	unackChan := make(chan pmb.Message)
+	unackChan := make(chan pmb.Body)
 	go unackAgent(unackChan, pushoverChan)
 
-	for {
-		message := <-conn.In
-		if message.Contents["type"].(string) == "Notification" {
-			level := message.Contents["level"].(float64)
+	for message := range conn.In {
+		body, err := pmb.Decode(message)
+		if err != nil {
+			logrus.Debugf("Skipping message: %s", err)
+			continue
+		}
 
-			if level >= notifyMobileCommand.LevelUnacknowledged {
-				unackChan <- message
+		switch body := body.(type) {
+		case *pmb.Notification:
+			if body.Level >= notifyMobileCommand.LevelUnacknowledged {
+				unackChan <- body
 			}
 
-			if level >= notifyMobileCommand.LevelAlways {
+			if body.Level >= notifyMobileCommand.LevelAlways {
 				logrus.Infof("Important notification found, sending Pushover")
-				pushoverChan <- message
+				pushoverChan <- body
 			} else {
 				logrus.Infof("Unimportant notification found, dropping on the floor.")
 			}
-		} else if message.Contents["type"].(string) == "NotificationDisplayed" {
-			level := message.Contents["level"].(float64)
-
-			if level >= notifyMobileCommand.LevelUnacknowledged {
-				unackChan <- message
+		case *pmb.NotificationDisplayed:
+			if body.Level >= notifyMobileCommand.LevelUnacknowledged {
+				unackChan <- body
 			}
 
-			screenSaverOn := message.Contents["screenSaverOn"].(bool)
-			if level >= notifyMobileCommand.LevelUnseen {
-				if screenSaverOn {
+			if body.Level >= notifyMobileCommand.LevelUnseen {
+				if body.ScreenSaverOn {
 					logrus.Infof("Unseen notification found, sending Pushover")
-					pushoverChan <- message
+					pushoverChan <- body
 				} else {
 					logrus.Infof("Seen notification found, skipping Pushover")
 				}
@@ -159,20 +182,24 @@ func runNotifyMobile(conn *pmb.Connection, id string, token string, userKey stri
 	return nil
 }
 
-func pushoverAgent(in chan pmb.Message, token string, userKey string) {
-
-	recentIds := make([]string, 0)
-
+func pushoverSender(token string, userKey string) mobileSender {
 	po := pushover.New(token)
 
 	recipient := pushover.NewRecipient(userKey)
 
+	return func(message string) error {
+		_, err := po.SendMessage(pushover.NewMessage(message), recipient)
+		return err
+	}
+}
+
+func pushoverAgent(in chan pmb.Body, send mobileSender) {
+
+	recentIds := make([]string, 0)
+
 MESSAGE:
 	for {
-		message := <-in
-
-		messageText := message.Contents["message"].(string)
-		messageId := message.Contents["notification-id"].(string)
+		messageId, messageText := notice(<-in)
 
 		for _, val := range recentIds {
 			if val == messageId {
@@ -187,13 +214,9 @@ MESSAGE:
 			recentIds = recentIds[1:]
 		}
 
-		poMessage := pushover.NewMessage(messageText)
-
-		_, err := po.SendMessage(poMessage, recipient)
+		err := send(messageText)
 		if err != nil {
 			logrus.Warnf("Error sending Pushover notification: %s", err)
 		}
 	}
-
-	return
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/justone/pmb/api"
+	"github.com/justone/pmb/api/pmbtest"
+)
+
+func TestNotifyMobile(t *testing.T) {
+	unackTimeout = 100 * time.Millisecond
+	notifyMobileCommand = NotifyMobileCommand{LevelAlways: 4, LevelUnacknowledged: 2, LevelUnseen: 2}
+
+	tests := []struct {
+		name        string
+		level       float64
+		silent      bool
+		screenSaver bool
+		wantSent    bool
+	}{
+		{name: "important", level: 4, wantSent: true},
+		{name: "seen", level: 3},
+		{name: "unseen", level: 3, screenSaver: true, wantSent: true},
+		{name: "unacknowledged", level: 3, silent: true, wantSent: true},
+		{name: "unimportant", level: 1, silent: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := pmbtest.NewHarness(t)
+			h.Introducer.SetScreenSaver(test.screenSaver)
+
+			mobile, err := h.Bus().Subscribe(pmb.Everything).ConnectClient("notify-mobile-test", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sent := make(chan string, 10)
+			go runNotifyMobile(mobile, "notify-mobile-test", func(message string) error {
+				sent <- message
+				return nil
+			})
+
+			conn := pmbtest.ConnectClient(t, h, "notify-test")
+			h.Introducer.SetSilent(test.silent)
+			conn.Out <- pmb.EncodeTo(pmb.ToRole(pmb.IntroducerRole), &pmb.Notification{
+				NotificationID: pmb.GenerateRandomID("notify"),
+				Message:        "hello",
+				Level:          test.level,
+			})
+
+			select {
+			case message := <-sent:
+				if !test.wantSent {
+					t.Errorf("sent %q to the mobile, want nothing", message)
+				} else if message != "hello" {
+					t.Errorf("sent %q to the mobile, want %q", message, "hello")
+				}
+			case <-time.After(3 * unackTimeout):
+				if test.wantSent {
+					t.Errorf("nothing sent to the mobile")
+				}
+			}
+
+			// each notification is only sent once
+			select {
+			case message := <-sent:
+				t.Errorf("sent %q to the mobile again", message)
+			case <-time.After(3 * unackTimeout):
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/justone/pmb/api"
+	"github.com/justone/pmb/api/pmbtest"
+)
+
+func TestNotify(t *testing.T) {
+	tests := []struct {
+		name    string
+		silent  bool
+		closed  bool
+		wantErr error
+		queued  int
+	}{
+		{name: "displayed"},
+		// sent, so not queued, as an introducer may still show it
+		{name: "no introducer", silent: true, wantErr: pmb.ErrNotDisplayed},
+		// queued to be sent later, rather than failing
+		{name: "not sent", closed: true, queued: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := pmbtest.NewHarness(t)
+			conn := pmbtest.ConnectClient(t, h, "notify-test")
+			h.Introducer.SetSilent(test.silent)
+			if test.closed {
+				conn.Close()
+			}
+
+			notifyCommand = NotifyCommand{Message: "hello", Level: 4}
+			if err := runNotify(conn, "notify-test"); err != test.wantErr {
+				t.Fatalf("runNotify() = %v, want %v", err, test.wantErr)
+			}
+
+			if !test.closed {
+				body, err := h.Introducer.WaitFor("Notification", time.Second)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if note := body.(*pmb.Notification); note.Message != "hello" || note.Level != 4 {
+					t.Errorf("introducer received %q at level %g, want %q at level 4", note.Message, note.Level, "hello")
+				}
+			}
+
+			queue, err := pmb.NewDefaultQueue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := queue.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != test.queued {
+				t.Errorf("%d notification(s) queued, want %d", len(entries), test.queued)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -27,7 +28,7 @@ func (x *OpenURLCommand) Execute(args []string) error {
 	} else {
 		stdin, err := ioutil.ReadAll(os.Stdin)
 		if err != nil {
-			return fmt.Errorf("error reading all input", err)
+			return fmt.Errorf("error reading all input: %s", err)
 		}
 		data = string(stdin)
 	}
@@ -52,25 +53,13 @@ func init() {
 
 func runOpenURL(conn *pmb.Connection, id string, data string, isHTML bool) error {
 
-	copyData := map[string]interface{}{
-		"type":    "OpenURL",
-		"data":    data,
-		"is_html": isHTML,
-	}
-	conn.Out <- pmb.Message{Contents: copyData}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	timeout := time.After(5 * time.Second)
-	for {
-		select {
-		case message := <-conn.In:
-			data := message.Contents
-			if data["type"].(string) == "URLOpened" && data["origin"].(string) == id {
-				return nil
-			}
-		case _ = <-timeout:
-			return fmt.Errorf("Unable to determine if URL was opened...")
-		}
+	_, err := conn.Request(ctx, pmb.EncodeTo(pmb.ToRole(pmb.IntroducerRole), &pmb.OpenURL{Data: data, IsHTML: isHTML}), "URLOpened")
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("Unable to determine if URL was opened...")
 	}
 
-	return nil
+	return err
 }
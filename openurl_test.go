@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/justone/pmb/api"
+	"github.com/justone/pmb/api/pmbtest"
+)
+
+func TestOpenURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		isHTML  bool
+		silent  bool
+		wantErr bool
+	}{
+		{name: "url", data: "https://example.com/"},
+		{name: "html", data: "<p>hello</p>", isHTML: true},
+		{name: "no introducer", data: "https://example.com/", silent: true, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := pmbtest.NewHarness(t)
+			conn := pmbtest.ConnectClient(t, h, "openurl-test")
+			h.Introducer.SetSilent(test.silent)
+
+			if err := runOpenURL(conn, "openurl-test", test.data, test.isHTML); (err != nil) != test.wantErr {
+				t.Fatalf("runOpenURL() = %v, want error: %t", err, test.wantErr)
+			}
+
+			body, err := h.Introducer.WaitFor("OpenURL", time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if openURL := body.(*pmb.OpenURL); openURL.Data != test.data || openURL.IsHTML != test.isHTML {
+				t.Errorf("introducer received %q (html: %t), want %q (html: %t)", openURL.Data, openURL.IsHTML, test.data, test.isHTML)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/justone/pmb/api"
+)
+
+type PasteCommand struct {
+	Timeout time.Duration `long:"timeout" description:"How long to wait for the clipboard, which includes the time taken to confirm the paste." default:"45s"`
+	Primary bool          `long:"primary" description:"Paste from the primary selection rather than the clipboard."`
+}
+
+var pasteCommand PasteCommand
+
+func (x *PasteCommand) Execute(args []string) error {
+	bus := pmb.GetPMB(globalOptions.Broker)
+
+	id := pmb.GenerateRandomID("paste")
+
+	conn, err := bus.ConnectClient(id, !globalOptions.TrustKey)
+	if err != nil {
+		return err
+	}
+
+	return runPaste(conn, pasteCommand.Timeout, selection(pasteCommand.Primary))
+}
+
+func init() {
+	parser.AddCommand("paste",
+		"Remote paste.",
+		"Writes the clipboard of the machine running the active introducer to stdout.  Depending on the introducer's paste policy, the paste may have to be allowed there first.",
+		&pasteCommand)
+}
+
+func runPaste(conn *pmb.Connection, timeout time.Duration, selection string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	reply, err := conn.Request(ctx, pmb.EncodeTo(pmb.ToRole(pmb.IntroducerRole), &pmb.RequestClipboard{Selection: selection}), "ClipboardData")
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("No clipboard received...")
+	} else if reply.Type() == "ClipboardDenied" {
+		if body, err := pmb.Decode(reply); err == nil {
+			return fmt.Errorf("Paste denied: %s", body.(*pmb.ClipboardDenied).Reason)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	body, err := pmb.Decode(reply)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write([]byte(body.(*pmb.ClipboardData).Data))
+	return err
+}
@@ -19,7 +19,7 @@ type PluginCommand struct {
 var pluginCommand PluginCommand
 
 func (x *PluginCommand) Execute(args []string) error {
-	bus := pmb.GetPMB(globalOptions.Broker)
+	bus := pmb.GetPMB(globalOptions.Broker).Subscribe(pmb.Everything)
 
 	if len(args) == 0 {
 		return fmt.Errorf("Please specify a command (with args).")
@@ -109,7 +109,11 @@ func runPluginOnce(conn *pmb.Connection, message pmb.Message, args []string) {
 		} else {
 
 			logrus.Debugf("data: %s", rawData)
-			data := rawData.(map[string]interface{})
+			data, ok := rawData.(map[string]interface{})
+			if !ok {
+				logrus.Debugf("JSON data isn't an object, skipping.")
+				continue
+			}
 
 			conn.Out <- pmb.Message{Contents: data}
 		}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/justone/pmb/api"
+)
+
+type ListQueueCommand struct{}
+
+type RetryQueueCommand struct{}
+
+type PurgeQueueCommand struct {
+	Args struct {
+		IDs []string `description:"Entries to purge, all if none are given." positional-arg-name:"id"`
+	} `positional-args:"yes"`
+}
+
+type QueueCommand struct {
+	List  ListQueueCommand  `command:"list" description:"List notifications waiting to be sent."`
+	Retry RetryQueueCommand `command:"retry" description:"Try to send the queued notifications now."`
+	Purge PurgeQueueCommand `command:"purge" description:"Remove queued notifications without sending them."`
+}
+
+func (x *ListQueueCommand) Execute(args []string) error {
+	queue, err := pmb.NewDefaultQueue()
+	if err != nil {
+		return err
+	}
+
+	entries, err := queue.List()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("%s  %s  attempts: %d  %s\n", entry.ID, entry.Queued.Format("2006-01-02 15:04:05"), entry.Attempts, entry.Notification.Message)
+		if len(entry.LastError) > 0 {
+			fmt.Printf("    last error: %s\n", entry.LastError)
+		}
+	}
+
+	return nil
+}
+
+func (x *RetryQueueCommand) Execute(args []string) error {
+	bus := pmb.GetPMB(globalOptions.Broker)
+
+	id := pmb.GenerateRandomID("queue")
+
+	conn, err := bus.ConnectClient(id, !globalOptions.TrustKey)
+	if err != nil {
+		return err
+	}
+
+	queue, err := pmb.NewDefaultQueue()
+	if err != nil {
+		return err
+	}
+
+	sent, err := queue.Flush(conn)
+	logrus.Infof("Sent %d queued notification(s).", sent)
+
+	return err
+}
+
+func (x *PurgeQueueCommand) Execute(args []string) error {
+	queue, err := pmb.NewDefaultQueue()
+	if err != nil {
+		return err
+	}
+
+	if len(x.Args.IDs) == 0 {
+		purged, err := queue.Purge()
+		logrus.Infof("Purged %d queued notification(s).", purged)
+		return err
+	}
+
+	for _, id := range x.Args.IDs {
+		if err := queue.Remove(id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// connectOrQueue connects and sends anything queued by earlier runs.  If the
+// broker can't be reached it returns nil, so that notifyOrQueue queues
+// instead of sending.
+func connectOrQueue(bus *pmb.PMB, id string) *pmb.Connection {
+	conn, err := bus.ConnectClient(id, !globalOptions.TrustKey)
+	if err != nil {
+		logrus.Warningf("Unable to connect, notifications will be queued: %s", err)
+		return nil
+	}
+
+	queue, err := pmb.NewDefaultQueue()
+	if err != nil {
+		logrus.Warningf("Unable to open queue: %s", err)
+		return conn
+	}
+
+	if sent, err := queue.Flush(conn); err != nil {
+		logrus.Warningf("Unable to send queued notifications: %s", err)
+	} else if sent > 0 {
+		logrus.Infof("Sent %d queued notification(s).", sent)
+	}
+
+	return conn
+}
+
+// notifyOrQueue sends a notification, queueing it to be sent later if the
+// broker is unreachable.  A notification that was sent but not confirmed
+// isn't queued, as an introducer may still display it.
+func notifyOrQueue(conn *pmb.Connection, note pmb.Notification) error {
+	if len(note.NotificationID) == 0 {
+		note.NotificationID = pmb.GenerateRandomID("notify")
+	}
+
+	var err error
+	if conn == nil {
+		err = fmt.Errorf("not connected")
+	} else {
+		err = pmb.SendNotification(conn, note)
+		if err != pmb.ErrNotSent && err != pmb.ErrClosed {
+			return err
+		}
+	}
+
+	queue, qerr := pmb.NewDefaultQueue()
+	if qerr != nil {
+		return err
+	}
+
+	entry, qerr := queue.Add(note, err)
+	if qerr != nil {
+		logrus.Warningf("Unable to queue notification: %s", qerr)
+		return err
+	}
+
+	logrus.Warningf("Notification not sent (%s), queued as %s.", err, entry.ID)
+	return nil
+}
+
+func init() {
+	var queueCommand QueueCommand
+
+	_, err := parser.AddCommand("queue",
+		"Manage notifications waiting to be sent.",
+		"",
+		&queueCommand)
+
+	if err != nil {
+		fmt.Println(err)
+	}
+}
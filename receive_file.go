@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/justone/pmb/api"
+)
+
+type ReceiveFileCommand struct {
+	Name string `short:"n" long:"name" description:"Name to receive files as, for send-file --to." default:"default"`
+	Dir  string `short:"d" long:"dir" description:"Directory to save files in." default:"."`
+}
+
+var receiveFileCommand ReceiveFileCommand
+
+func (x *ReceiveFileCommand) Execute(args []string) error {
+	bus := pmb.GetPMB(globalOptions.Broker)
+
+	id := pmb.GenerateRandomID("receiveFile")
+
+	conn, err := bus.Subscribe(receiverTopic(receiveFileCommand.Name)).ConnectClient(id, !globalOptions.TrustKey)
+	if err != nil {
+		return err
+	}
+
+	return runReceiveFile(bus, conn)
+}
+
+func init() {
+	parser.AddCommand("receive-file",
+		"Receive files.",
+		"Saves the files sent with send-file --to, until interrupted.",
+		&receiveFileCommand)
+}
+
+func runReceiveFile(bus *pmb.PMB, conn *pmb.Connection) error {
+	logrus.Infof("Waiting for files as %s", receiveFileCommand.Name)
+
+	for {
+		message, ok := <-conn.In
+		if !ok {
+			return pmb.ErrClosed
+		}
+
+		body, err := pmb.Decode(message)
+		if err != nil {
+			logrus.Debugf("Skipping message: %s", err)
+			continue
+		}
+
+		if offer, ok := body.(*pmb.FileOffer); ok {
+			go func() {
+				if _, err := receiveFile(bus, conn, offer, receiveFileCommand.Dir); err != nil {
+					logrus.Warningf("%s", err)
+				}
+			}()
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -12,7 +13,7 @@ import (
 )
 
 type RemoteCopyCommand struct {
-	// no options yet
+	Primary bool `long:"primary" description:"Copy to the primary selection rather than the clipboard."`
 }
 
 var remoteCopyCommand RemoteCopyCommand
@@ -27,7 +28,7 @@ func (x *RemoteCopyCommand) Execute(args []string) error {
 	} else {
 		stdin, err := ioutil.ReadAll(os.Stdin)
 		if err != nil {
-			return fmt.Errorf("error reading all input", err)
+			return fmt.Errorf("error reading all input: %s", err)
 		}
 		data = string(stdin)
 	}
@@ -40,7 +41,7 @@ func (x *RemoteCopyCommand) Execute(args []string) error {
 		return err
 	}
 
-	return runRemoteCopy(conn, id, strings.TrimSpace(data))
+	return runRemoteCopy(conn, id, strings.TrimSpace(data), selection(remoteCopyCommand.Primary))
 }
 
 func init() {
@@ -56,26 +57,29 @@ func init() {
 	}
 }
 
-func runRemoteCopy(conn *pmb.Connection, id string, data string) error {
-
-	copyData := map[string]interface{}{
-		"type": "CopyData",
-		"data": data,
+// selection returns the selection asked for on the command line, or none
+// to leave it to the introducer's config.
+func selection(primary bool) string {
+	if primary {
+		return pmb.SelectionPrimary
 	}
-	conn.Out <- pmb.Message{Contents: copyData}
-
-	timeout := time.After(5 * time.Second)
-	for {
-		select {
-		case message := <-conn.In:
-			data := message.Contents
-			if data["type"].(string) == "DataCopied" && data["origin"].(string) == id {
-				return nil
-			}
-		case _ = <-timeout:
-			return fmt.Errorf("Unable to determine if data was copied...")
+
+	return ""
+}
+
+func runRemoteCopy(conn *pmb.Connection, id string, data string, selection string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reply, err := conn.Request(ctx, pmb.EncodeTo(pmb.ToRole(pmb.IntroducerRole), &pmb.CopyData{Data: data, Selection: selection}), "DataCopied")
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("Unable to determine if data was copied...")
+	} else if reply.Type() == "CopyFailed" {
+		if body, err := pmb.Decode(reply); err == nil {
+			return fmt.Errorf("Copy failed: %s", body.(*pmb.CopyFailed).Reason)
 		}
 	}
 
-	return nil
+	return err
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/justone/pmb/api"
+	"github.com/justone/pmb/api/pmbtest"
+)
+
+func TestRemoteCopy(t *testing.T) {
+	tests := []struct {
+		name      string
+		selection string
+		failure   string
+		wantErr   string
+	}{
+		{name: "copied"},
+		{name: "copied to primary", selection: pmb.SelectionPrimary},
+		{name: "failed", failure: "no clipboard", wantErr: "Copy failed: no clipboard"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := pmbtest.NewHarness(t)
+			conn := pmbtest.ConnectClient(t, h, "remotecopy-test")
+			h.Introducer.SetCopyFailure(test.failure)
+
+			err := runRemoteCopy(conn, "remotecopy-test", "some data", test.selection)
+			if len(test.wantErr) == 0 && err != nil {
+				t.Fatalf("runRemoteCopy() = %v, want no error", err)
+			} else if len(test.wantErr) > 0 && (err == nil || err.Error() != test.wantErr) {
+				t.Fatalf("runRemoteCopy() = %v, want %q", err, test.wantErr)
+			}
+
+			body, err := h.Introducer.WaitFor("CopyData", time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if copyData := body.(*pmb.CopyData); copyData.Data != "some data" || copyData.Selection != test.selection {
+				t.Errorf("introducer received %q for selection %q, want %q for %q", copyData.Data, copyData.Selection, "some data", test.selection)
+			}
+		})
+	}
+}
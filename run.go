@@ -12,17 +12,27 @@ import (
 )
 
 type RunCommand struct {
-	Message       string  `short:"m" long:"message" description:"Message to send."`
-	SendTrigger   string  `short:"s" long:"send-trigger" description:"Send trigger message when done."`
-	WaitTrigger   string  `short:"w" long:"wait-trigger" description:"Wait for trigger."`
-	TriggerAlways bool    `short:"a" long:"trigger-always" description:"When trigger received, execute command if previous failed."`
-	Level         float64 `short:"l" long:"level" description:"Notification level (1-5), higher numbers indictate higher importance" default:"3"`
+	Message       string        `short:"m" long:"message" description:"Message to send."`
+	SendTrigger   string        `short:"s" long:"send-trigger" description:"Send trigger message when done."`
+	WaitTrigger   string        `short:"w" long:"wait-trigger" description:"Wait for trigger."`
+	TriggerAlways bool          `short:"a" long:"trigger-always" description:"When trigger received, execute command if previous failed."`
+	TriggerTTL    float64       `long:"trigger-ttl" description:"Seconds after which a sent trigger is stale and will be discarded." default:"60"`
+	TriggerReplay time.Duration `long:"trigger-replay" description:"When waiting, also accept a trigger sent up to this long before starting." default:"1m"`
+	Level         float64       `short:"l" long:"level" description:"Notification level (1-5), higher numbers indictate higher importance" default:"3"`
 }
 
 var runCommand RunCommand
 
+// triggers are only sent to the clients waiting for them
+const triggerTopic = "trigger"
+
 func (x *RunCommand) Execute(args []string) error {
 	bus := pmb.GetPMB(globalOptions.Broker)
+	if len(runCommand.WaitTrigger) > 0 {
+		// the broker replays recent triggers, in case the one we are
+		// waiting for was sent just before we connected
+		bus = bus.Subscribe(pmb.ToTopic(triggerTopic)).Replay(time.Now().Add(-runCommand.TriggerReplay))
+	}
 
 	if len(args) == 0 {
 		return fmt.Errorf("A command is required")
@@ -30,12 +40,18 @@ func (x *RunCommand) Execute(args []string) error {
 
 	id := pmb.GenerateRandomID("run")
 
-	conn, err := bus.ConnectClient(id, !globalOptions.TrustKey)
-	if err != nil {
-		return err
+	// triggers need the broker, but a plain notification can be queued
+	// and the command run anyway
+	if len(runCommand.WaitTrigger) > 0 || len(runCommand.SendTrigger) > 0 {
+		conn, err := bus.ConnectClient(id, !globalOptions.TrustKey)
+		if err != nil {
+			return err
+		}
+
+		return runRun(conn, id, args)
 	}
 
-	return runRun(conn, id, args)
+	return runRun(connectOrQueue(bus, id), id, args)
 }
 
 func init() {
@@ -50,14 +66,19 @@ func runRun(conn *pmb.Connection, id string, args []string) error {
 	if waitTrigger := runCommand.WaitTrigger; len(waitTrigger) > 0 {
 		logrus.Infof("Waiting for trigger '%s' before starting...", waitTrigger)
 
-		var triggerMessage pmb.Message
+		var trigger *pmb.Trigger
 	WAIT:
 		for {
 			select {
 			case message := <-conn.In:
-				data := message.Contents
-				if data["type"].(string) == "Trigger" && data["from"].(string) == "run" && data["trigger"].(string) == waitTrigger {
-					triggerMessage = message
+				body, err := pmb.Decode(message)
+				if err != nil {
+					logrus.Debugf("Skipping message: %s", err)
+					continue
+				}
+
+				if t, ok := body.(*pmb.Trigger); ok && t.From == "run" && t.Trigger == waitTrigger {
+					trigger = t
 					break WAIT
 				}
 			case _ = <-time.After(10 * time.Minute):
@@ -72,7 +93,7 @@ func runRun(conn *pmb.Connection, id string, args []string) error {
 		}
 		pmb.SendNotification(conn, note)
 
-		if !runCommand.TriggerAlways && !triggerMessage.Contents["success"].(bool) {
+		if !runCommand.TriggerAlways && !trigger.Success {
 			return fmt.Errorf("Previous command failed, not running.")
 		}
 	}
@@ -107,7 +128,7 @@ func runRun(conn *pmb.Connection, id string, args []string) error {
 	}
 
 	note := pmb.Notification{Message: message, Level: runCommand.Level}
-	notifyErr := pmb.SendNotification(conn, note)
+	notifyErr := notifyOrQueue(conn, note)
 
 	if sendTrigger := runCommand.SendTrigger; len(sendTrigger) > 0 {
 		logrus.Infof("Sending trigger '%s'.", sendTrigger)
@@ -117,14 +138,12 @@ func runRun(conn *pmb.Connection, id string, args []string) error {
 		}
 		pmb.SendNotification(conn, note)
 
-		conn.Out <- pmb.Message{
-			Contents: map[string]interface{}{
-				"type":    "Trigger",
-				"trigger": sendTrigger,
-				"from":    "run",
-				"success": cmdSuccess,
-			},
-		}
+		conn.Out <- pmb.EncodeTo(pmb.ToTopic(triggerTopic), &pmb.Trigger{
+			Header:  pmb.Header{TTL: runCommand.TriggerTTL},
+			Trigger: sendTrigger,
+			From:    "run",
+			Success: cmdSuccess,
+		})
 		<-time.After(2 * time.Second)
 	}
 
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/justone/pmb/api"
+	"github.com/justone/pmb/api/pmbtest"
+)
+
+func TestRunWaitTrigger(t *testing.T) {
+	tests := []struct {
+		name    string
+		success bool
+		always  bool
+		ran     bool
+	}{
+		{name: "previous succeeded", success: true, ran: true},
+		{name: "previous failed", success: false, ran: false},
+		{name: "previous failed, trigger always", success: false, always: true, ran: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := pmbtest.NewHarness(t)
+
+			waiting, err := h.Bus().Subscribe(pmb.ToTopic(triggerTopic)).ConnectClient("run-test", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sender := pmbtest.ConnectClient(t, h, "run-sender")
+
+			runCommand = RunCommand{WaitTrigger: "build", TriggerAlways: test.always, Level: 3}
+			done := make(chan error, 1)
+			go func() {
+				done <- runRun(waiting, "run-test", []string{"true"})
+			}()
+
+			// a trigger for something else is ignored
+			for _, trigger := range []string{"deploy", "build"} {
+				sent := pmb.EncodeTo(pmb.ToTopic(triggerTopic), &pmb.Trigger{
+					Trigger: trigger,
+					From:    "run",
+					Success: test.success,
+				})
+				sent.Done = make(chan error, 1)
+				sender.Out <- sent
+				<-sent.Done
+			}
+
+			select {
+			case err = <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("run didn't finish after the trigger was sent")
+			}
+			if test.ran && err != nil {
+				t.Fatalf("runRun() = %v, want no error", err)
+			} else if !test.ran && err == nil {
+				t.Fatal("runRun() ran the command after a failed trigger")
+			}
+
+			var messages []string
+			for _, body := range h.Introducer.Received() {
+				if note, ok := body.(*pmb.Notification); ok {
+					messages = append(messages, note.Message)
+				}
+			}
+
+			if len(messages) == 0 || messages[0] != "Received trigger build" {
+				t.Fatalf("notifications %q, want the first to be for the trigger", messages)
+			}
+			if completed := len(messages) > 1 && strings.Contains(messages[1], "Command [true] completed successfully"); completed != test.ran {
+				t.Errorf("notifications %q, want command completed: %t", messages, test.ran)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/justone/pmb/api"
+)
+
+type SendFileCommand struct {
+	To        string        `long:"to" description:"Name of the receive-file to send to, rather than the introducer."`
+	ChunkSize int           `long:"chunk-size" description:"Size of each chunk, in bytes." default:"65536"`
+	Timeout   time.Duration `long:"timeout" description:"How long to wait for the file to be accepted, which includes the time taken to confirm it." default:"45s"`
+}
+
+var sendFileCommand SendFileCommand
+
+func (x *SendFileCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Please specify one file to send.")
+	}
+
+	bus := pmb.GetPMB(globalOptions.Broker)
+
+	id := pmb.GenerateRandomID("sendFile")
+
+	conn, err := bus.ConnectClient(id, !globalOptions.TrustKey)
+	if err != nil {
+		return err
+	}
+
+	destination := pmb.ToRole(pmb.IntroducerRole)
+	if len(sendFileCommand.To) > 0 {
+		destination = receiverTopic(sendFileCommand.To)
+	}
+
+	return sendFile(bus, conn, destination, args[0], sendFileCommand.ChunkSize, sendFileCommand.Timeout)
+}
+
+func init() {
+	parser.AddCommand("send-file",
+		"Send a file.",
+		"Sends a file to the active introducer, which saves it in its downloads directory, or to a receive-file.  The file is sent in chunks, each checked on arrival.  If the transfer is interrupted, sending the same file again sends only the chunks that are missing.",
+		&sendFileCommand)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/justone/pmb/api"
 )
 
@@ -32,17 +33,30 @@ func init() {
 		&sinkCommand)
 }
 
+// streamTopic returns the destination for a named stream, so that stream
+// data only goes to the sinks reading it.
+func streamTopic(name string) string {
+	return pmb.ToTopic(fmt.Sprintf("stream.%s", name))
+}
+
 func runSink(bus *pmb.PMB, conn *pmb.Connection, id string) error {
 
-	subConn, err := bus.ConnectSubClient(conn, sinkCommand.Name)
+	subConn, err := bus.Subscribe(streamTopic(sinkCommand.Name)).ConnectSubClient(conn, sinkCommand.Name)
 	if err != nil {
 		return err
 	}
 
 	for {
 		message := <-subConn.In
-		fmt.Printf("%s: %s\n", message.Contents["identifier"], message.Contents["data"])
-	}
 
-	return nil
+		body, err := pmb.Decode(message)
+		if err != nil {
+			logrus.Debugf("Skipping message: %s", err)
+			continue
+		}
+
+		if stream, ok := body.(*pmb.Stream); ok {
+			fmt.Printf("%s: %s\n", stream.Identifier, stream.Data)
+		}
+	}
 }
@@ -72,11 +72,10 @@ func runStream(bus *pmb.PMB, conn *pmb.Connection, id string) error {
 	}
 
 	for line := range fileTail.Lines {
-		subConn.Out <- pmb.Message{Contents: map[string]interface{}{
-			"type":       "Stream",
-			"identifier": ident,
-			"data":       line.Text,
-		}}
+		subConn.Out <- pmb.EncodeTo(streamTopic(streamCommand.Name), &pmb.Stream{
+			Identifier: ident,
+			Data:       line.Text,
+		})
 	}
 
 	return nil
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/justone/pmb/api"
+)
+
+const (
+	defaultChunkSize = 64 * 1024
+
+	// how many chunks the receiver asks for at once
+	transferWindow = 8
+
+	// how long without a chunk before the receiver asks again, and how
+	// many times it asks before giving up
+	chunkTimeout = 15 * time.Second
+	chunkRetries = 4
+
+	// how long the sender waits for the receiver to ask for chunks
+	senderTimeout = time.Minute
+
+	// file transfers use a sub-client, to keep them off the main channel
+	transferSub = "files"
+
+	// partially received files are kept as hidden files named after the
+	// transfer, with this suffix, until complete
+	partialSuffix = ".pmbpart"
+
+	// how long a partial file left by a receiver that never finished is
+	// kept, in case the file is offered again
+	stalePartial = 24 * time.Hour
+)
+
+// transferTopic is the destination for a transfer's chunks and chunk
+// requests, which only the sender and receiver subscribe to.
+func transferTopic(transferID string) string {
+	return pmb.ToTopic(fmt.Sprintf("file.%s", transferID))
+}
+
+// receiverTopic is the destination for offers to a named receive-file.
+func receiverTopic(name string) string {
+	return pmb.ToTopic(fmt.Sprintf("files.%s", name))
+}
+
+func fileChecksum(file io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func chunkChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// newFileOffer describes a file to send.  The transfer id is taken from the
+// file's name and contents, so it's the same each time the file is offered.
+func newFileOffer(file *os.File, chunkSize int) (*pmb.FileOffer, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	checksum, err := fileChecksum(file)
+	if err != nil {
+		return nil, err
+	}
+
+	name := filepath.Base(file.Name())
+	id := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%d", name, checksum, chunkSize)))
+
+	return &pmb.FileOffer{
+		TransferID: fmt.Sprintf("transfer-%s", hex.EncodeToString(id[:8])),
+		Name:       name,
+		Size:       info.Size(),
+		ChunkSize:  chunkSize,
+		Chunks:     int((info.Size() + int64(chunkSize) - 1) / int64(chunkSize)),
+		Checksum:   checksum,
+	}, nil
+}
+
+// transferProgress logs how far a transfer has got, every tenth of the way.
+// Chunks sent again don't count.
+type transferProgress struct {
+	verb    string
+	name    string
+	total   int
+	done    int
+	percent int
+}
+
+func (p *transferProgress) add(n int) {
+	if p.done += n; p.done > p.total || p.total == 0 {
+		p.done = p.total
+		return
+	}
+
+	if percent := p.done * 100 / p.total; percent/10 > p.percent/10 || p.done == p.total {
+		logrus.Infof("%s %s: %d of %d chunks (%d%%)", p.verb, p.name, p.done, p.total, percent)
+		p.percent = percent
+	}
+}
+
+// sendFile offers a file to destination, then sends the chunks the
+// receiver asks for until it has the whole file.
+func sendFile(bus *pmb.PMB, conn *pmb.Connection, destination string, path string, chunkSize int, timeout time.Duration) error {
+	if chunkSize <= 0 || chunkSize > pmb.MaxFileChunkSize {
+		return fmt.Errorf("Chunk size must be between 1 and %d bytes", pmb.MaxFileChunkSize)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offer, err := newFileOffer(file, chunkSize)
+	if err != nil {
+		return err
+	}
+	// the receiver refuses offers outside of the limits, so there's no
+	// point sending one
+	if err := offer.Validate(); err != nil {
+		return fmt.Errorf("Unable to send %s: %s", offer.Name, err)
+	}
+
+	// subscribe before offering, so no chunk requests are missed
+	subConn, err := bus.Subscribe(transferTopic(offer.TransferID)).ConnectSubClient(conn, transferSub)
+	if err != nil {
+		return err
+	}
+	defer subConn.Close()
+
+	logrus.Infof("Offering %s (%d bytes in %d chunks)", offer.Name, offer.Size, offer.Chunks)
+
+	accepted, err := requestTransfer(conn, destination, offer, timeout)
+	if err != nil {
+		return err
+	}
+	if accepted.Received > 0 {
+		logrus.Infof("Resuming transfer, receiver already has %d of %d chunks", accepted.Received, offer.Chunks)
+	}
+
+	progress := &transferProgress{verb: "Sent", name: offer.Name, total: offer.Chunks - accepted.Received}
+	sent := make(map[int]bool)
+	buffer := make([]byte, chunkSize)
+
+	for {
+		select {
+		case message, ok := <-subConn.In:
+			if !ok {
+				return pmb.ErrClosed
+			}
+
+			body, err := pmb.Decode(message)
+			if err != nil {
+				logrus.Debugf("Skipping message: %s", err)
+				continue
+			}
+
+			switch body := body.(type) {
+			case *pmb.FileChunkRequest:
+				if body.TransferID != offer.TransferID {
+					continue
+				}
+
+				for _, index := range body.Chunks {
+					if index < 0 || index >= offer.Chunks {
+						logrus.Warningf("Receiver asked for chunk %d, which doesn't exist", index)
+						continue
+					}
+
+					n, err := file.ReadAt(buffer, int64(index)*int64(chunkSize))
+					if err != nil && err != io.EOF {
+						return err
+					}
+
+					subConn.Out <- pmb.EncodeTo(transferTopic(offer.TransferID), &pmb.FileChunk{
+						TransferID: offer.TransferID,
+						Index:      index,
+						Data:       base64.StdEncoding.EncodeToString(buffer[:n]),
+						Checksum:   chunkChecksum(buffer[:n]),
+					})
+					if !sent[index] {
+						sent[index] = true
+						progress.add(1)
+					}
+				}
+			case *pmb.FileReceived:
+				if body.TransferID == offer.TransferID {
+					logrus.Infof("Transfer complete, saved as %s on %s", body.Name, body.Hostname)
+					return nil
+				}
+			case *pmb.FileRejected:
+				if body.TransferID == offer.TransferID {
+					return fmt.Errorf("Transfer failed: %s", body.Reason)
+				}
+			}
+		case <-time.After(senderTimeout):
+			return fmt.Errorf("Receiver stopped asking for chunks")
+		}
+	}
+}
+
+// requestTransfer offers a file and waits for the receiver to accept it.
+func requestTransfer(conn *pmb.Connection, destination string, offer *pmb.FileOffer, timeout time.Duration) (*pmb.FileAccepted, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	reply, err := conn.Request(ctx, pmb.EncodeTo(destination, offer), "FileAccepted")
+	if err == context.DeadlineExceeded {
+		return nil, fmt.Errorf("No receiver accepted the file...")
+	} else if reply.Type() == "FileRejected" {
+		if body, err := pmb.Decode(reply); err == nil {
+			return nil, fmt.Errorf("File rejected: %s", body.(*pmb.FileRejected).Reason)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := pmb.Decode(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return body.(*pmb.FileAccepted), nil
+}
+
+// partialFile is the state of a partially received file, kept next to it
+// so that the transfer can be resumed.
+type partialFile struct {
+	path string
+	file *os.File
+
+	Checksum  string `json:"checksum"`
+	ChunkSize int    `json:"chunk-size"`
+	Received  []bool `json:"received"`
+}
+
+// openPartial opens the partial file for an offer, picking up where an
+// earlier transfer of the same file left off.  It's named after the
+// transfer rather than the file, so that different files with the same
+// name don't clobber each other.
+func openPartial(dir string, offer *pmb.FileOffer) (*partialFile, error) {
+	path := filepath.Join(dir, fmt.Sprintf(".%s%s", offer.TransferID, partialSuffix))
+
+	part := &partialFile{}
+	if state, err := ioutil.ReadFile(path + ".json"); err == nil {
+		json.Unmarshal(state, part)
+	}
+	if part.Checksum != offer.Checksum || part.ChunkSize != offer.ChunkSize || len(part.Received) != offer.Chunks {
+		part = &partialFile{
+			Checksum:  offer.Checksum,
+			ChunkSize: offer.ChunkSize,
+			Received:  make([]bool, offer.Chunks),
+		}
+		os.Remove(path)
+	}
+	part.path = path
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	part.file = file
+
+	return part, nil
+}
+
+func (part *partialFile) missing() []int {
+	var missing []int
+	for index, received := range part.Received {
+		if !received {
+			missing = append(missing, index)
+		}
+	}
+
+	return missing
+}
+
+func (part *partialFile) write(chunk *pmb.FileChunk) error {
+	data, err := base64.StdEncoding.DecodeString(chunk.Data)
+	if err != nil {
+		return err
+	}
+	if chunkChecksum(data) != chunk.Checksum {
+		return fmt.Errorf("checksum mismatch")
+	}
+
+	if _, err := part.file.WriteAt(data, int64(chunk.Index)*int64(part.ChunkSize)); err != nil {
+		return err
+	}
+	part.Received[chunk.Index] = true
+
+	return nil
+}
+
+// save records which chunks have been received.  Chunks written since the
+// last save are asked for again on resume, which does no harm.
+func (part *partialFile) save() error {
+	state, err := json.Marshal(part)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(part.path+".json", state, 0600)
+}
+
+// finish checks the whole file and moves it into place, under a name that
+// doesn't clash with an existing file.
+func (part *partialFile) finish(dir, name string) (string, error) {
+	defer part.file.Close()
+
+	if _, err := part.file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	checksum, err := fileChecksum(part.file)
+	if err != nil {
+		return "", err
+	}
+	if checksum != part.Checksum {
+		part.discard()
+		return "", fmt.Errorf("checksum of received file doesn't match")
+	}
+
+	path := filepath.Join(dir, name)
+	ext := filepath.Ext(name)
+	for i := 1; fileExists(path); i++ {
+		path = filepath.Join(dir, fmt.Sprintf("%s.%d%s", strings.TrimSuffix(name, ext), i, ext))
+	}
+
+	if err := os.Rename(part.path, path); err != nil {
+		return "", err
+	}
+	os.Remove(part.path + ".json")
+
+	return path, nil
+}
+
+func (part *partialFile) discard() {
+	part.file.Close()
+	os.Remove(part.path)
+	os.Remove(part.path + ".json")
+}
+
+// removeStalePartials removes the partial files of transfers that were
+// never finished, such as those interrupted by the receiver exiting.
+func removeStalePartials(dir string) {
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"+partialSuffix))
+	for _, path := range matches {
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > stalePartial {
+			logrus.Infof("Removing %s, left by a transfer that never finished", path)
+			os.Remove(path)
+			os.Remove(path + ".json")
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// receiveFile accepts an offered file, and asks for the chunks it doesn't
+// have yet, a window at a time, until the file is complete.  Chunks that
+// don't arrive are asked for again.  A sender that is interrupted can offer
+// the file again to resume, which takes over what has arrived so far.  If
+// the transfer fails, what arrived is removed.
+func receiveFile(bus *pmb.PMB, conn *pmb.Connection, offer *pmb.FileOffer, dir string) (string, error) {
+	name := filepath.Base(offer.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return "", rejectFile(conn, offer, "invalid file name")
+	}
+	offer.Name = name
+
+	// a sender that was interrupted offers the file again, which
+	// replaces the transfer it abandoned
+	current := activeTransfers.start(offer.TransferID)
+	defer activeTransfers.finish(offer.TransferID, current)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", rejectFile(conn, offer, err.Error())
+	}
+	removeStalePartials(dir)
+
+	part, err := openPartial(dir, offer)
+	if err != nil {
+		return "", rejectFile(conn, offer, err.Error())
+	}
+
+	subConn, err := bus.Subscribe(transferTopic(offer.TransferID)).ConnectSubClient(conn, transferSub)
+	if err != nil {
+		part.discard()
+		return "", rejectFile(conn, offer, err.Error())
+	}
+	defer subConn.Close()
+
+	missing := part.missing()
+	logrus.Infof("Receiving %s from %s (%d bytes, %d of %d chunks to go)", name, offer.Hostname, offer.Size, len(missing), offer.Chunks)
+	conn.Out <- pmb.Reply(offer.Header, &pmb.FileAccepted{
+		Origin:     offer.ID,
+		TransferID: offer.TransferID,
+		Received:   offer.Chunks - len(missing),
+	})
+
+	progress := &transferProgress{verb: "Received", name: name, total: len(missing)}
+	outstanding := make(map[int]bool)
+	retries := 0
+
+	request := func(chunks []int) {
+		for _, index := range chunks {
+			outstanding[index] = true
+		}
+		subConn.Out <- pmb.EncodeTo(transferTopic(offer.TransferID), &pmb.FileChunkRequest{TransferID: offer.TransferID, Chunks: chunks})
+	}
+	fail := func(reason string) (string, error) {
+		part.discard()
+		subConn.Out <- pmb.EncodeTo(transferTopic(offer.TransferID), &pmb.FileRejected{TransferID: offer.TransferID, Reason: reason})
+		return "", fmt.Errorf("Transfer of %s failed: %s", name, reason)
+	}
+	fill := func() {
+		var chunks []int
+		for len(missing) > 0 && len(outstanding)+len(chunks) < transferWindow {
+			chunks, missing = append(chunks, missing[0]), missing[1:]
+		}
+		if len(chunks) > 0 {
+			request(chunks)
+		}
+	}
+
+	fill()
+	for len(outstanding) > 0 {
+		select {
+		case message, ok := <-subConn.In:
+			if !ok {
+				return fail("connection closed")
+			}
+
+			body, err := pmb.Decode(message)
+			if err != nil {
+				logrus.Debugf("Skipping message: %s", err)
+				continue
+			}
+
+			switch body := body.(type) {
+			case *pmb.FileChunk:
+				if body.TransferID != offer.TransferID || !outstanding[body.Index] {
+					continue
+				}
+
+				if err := part.write(body); err != nil {
+					logrus.Warningf("Bad chunk %d of %s, asking again: %s", body.Index, name, err)
+					request([]int{body.Index})
+					continue
+				}
+
+				delete(outstanding, body.Index)
+				retries = 0
+				progress.add(1)
+				if progress.done%(transferWindow*4) == 0 {
+					part.save()
+				}
+				fill()
+			case *pmb.FileRejected:
+				if body.TransferID == offer.TransferID {
+					return fail(fmt.Sprintf("sender gave up: %s", body.Reason))
+				}
+			}
+		case <-current.stop:
+			part.save()
+			part.file.Close()
+			return "", fmt.Errorf("Transfer of %s replaced by a new offer", name)
+		case <-time.After(chunkTimeout):
+			if retries++; retries > chunkRetries {
+				return fail("sender stopped sending chunks")
+			}
+
+			var chunks []int
+			for index := range outstanding {
+				chunks = append(chunks, index)
+			}
+			logrus.Warningf("No chunks of %s for %s, asking again for %d", name, chunkTimeout, len(chunks))
+			request(chunks)
+		}
+	}
+
+	path, err := part.finish(dir, name)
+	if err != nil {
+		subConn.Out <- pmb.EncodeTo(transferTopic(offer.TransferID), &pmb.FileRejected{TransferID: offer.TransferID, Reason: err.Error()})
+		return "", err
+	}
+
+	received := pmb.EncodeTo(transferTopic(offer.TransferID), &pmb.FileReceived{TransferID: offer.TransferID, Name: filepath.Base(path)})
+	received.Done = make(chan error, 1)
+	subConn.Out <- received
+	// a connection closed while sending doesn't signal Done
+	select {
+	case <-received.Done:
+	case <-subConn.Done():
+	}
+
+	logrus.Infof("Received %s, saved as %s", name, path)
+	return path, nil
+}
+
+// transfers holds the transfers being received, by id.
+type transfers struct {
+	sync.Mutex
+	active map[string]*transfer
+}
+
+type transfer struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+var activeTransfers = &transfers{active: make(map[string]*transfer)}
+
+// start registers a transfer, first stopping any earlier transfer with the
+// same id and waiting for it to save its progress.
+func (t *transfers) start(transferID string) *transfer {
+	current := &transfer{stop: make(chan struct{}), done: make(chan struct{})}
+
+	t.Lock()
+	previous := t.active[transferID]
+	t.active[transferID] = current
+	t.Unlock()
+
+	if previous != nil {
+		close(previous.stop)
+		<-previous.done
+	}
+
+	return current
+}
+
+func (t *transfers) finish(transferID string, current *transfer) {
+	t.Lock()
+	if t.active[transferID] == current {
+		delete(t.active, transferID)
+	}
+	t.Unlock()
+
+	close(current.done)
+}
+
+// rejectFile turns down an offer, returning the reason as an error.
+func rejectFile(conn *pmb.Connection, offer *pmb.FileOffer, reason string) error {
+	conn.Out <- pmb.Reply(offer.Header, &pmb.FileRejected{Origin: offer.ID, TransferID: offer.TransferID, Reason: reason})
+	return fmt.Errorf("Rejected %s: %s", offer.Name, reason)
+}
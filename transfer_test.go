@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/justone/pmb/api"
+	"github.com/justone/pmb/api/pmbtest"
+)
+
+func TestSendFileResumes(t *testing.T) {
+	const chunkSize = 1024
+
+	tests := []struct {
+		name string
+		// chunks the receiver already has from an earlier attempt
+		received []int
+	}{
+		{name: "fresh"},
+		{name: "resumed", received: []int{0, 1, 2, 3, 6}},
+		{name: "all but the last", received: []int{0, 1, 2, 3, 4, 5, 6, 7, 8}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := pmbtest.NewHarness(t)
+			dir := t.TempDir()
+
+			data := bytes.Repeat([]byte("0123456789abcdef"), 600)
+			path := filepath.Join(t.TempDir(), "data.bin")
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			offer := testOffer(t, path, chunkSize)
+			if len(test.received) > 0 {
+				receivePartly(t, dir, offer, data, test.received)
+			}
+
+			// a different file with the same name, part way through
+			// being received, which must be left alone
+			otherPath := filepath.Join(t.TempDir(), "data.bin")
+			if err := os.WriteFile(otherPath, []byte("something else"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			other := testOffer(t, otherPath, chunkSize)
+			receivePartly(t, dir, other, []byte("something else"), nil)
+
+			receiveFileCommand = ReceiveFileCommand{Name: "test", Dir: dir}
+			receiver, err := h.Bus().Subscribe(receiverTopic("test")).ConnectClient("receive-test", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go runReceiveFile(h.Bus(), receiver)
+
+			sent := countChunks(t, h.Bus(), pmbtest.ConnectClient(t, h, "observer"), offer.TransferID)
+
+			sender := pmbtest.ConnectClient(t, h, "send-test")
+			if err := sendFile(h.Bus(), sender, receiverTopic("test"), path, chunkSize, 5*time.Second); err != nil {
+				t.Fatalf("sendFile() = %v", err)
+			}
+
+			received, err := os.ReadFile(filepath.Join(dir, "data.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(received, data) {
+				t.Errorf("received %d bytes that don't match the %d sent", len(received), len(data))
+			}
+
+			if got, want := sent(), offer.Chunks-len(test.received); got != want {
+				t.Errorf("%d chunks sent, want only the %d missing", got, want)
+			}
+
+			if _, err := os.Stat(filepath.Join(dir, "."+offer.TransferID+partialSuffix)); !os.IsNotExist(err) {
+				t.Errorf("partial file left behind: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "."+other.TransferID+partialSuffix+".json")); err != nil {
+				t.Errorf("partial file of the other transfer was clobbered: %v", err)
+			}
+		})
+	}
+}
+
+func testOffer(t *testing.T, path string, chunkSize int) *pmb.FileOffer {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	offer, err := newFileOffer(file, chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return offer
+}
+
+// receivePartly leaves what an interrupted transfer would, with the given
+// chunks received.
+func receivePartly(t *testing.T, dir string, offer *pmb.FileOffer, data []byte, chunks []int) {
+	t.Helper()
+
+	part, err := openPartial(dir, offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer part.file.Close()
+
+	for _, index := range chunks {
+		end := (index + 1) * offer.ChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[index*offer.ChunkSize : end]
+
+		if err := part.write(&pmb.FileChunk{
+			TransferID: offer.TransferID,
+			Index:      index,
+			Data:       base64.StdEncoding.EncodeToString(chunk),
+			Checksum:   chunkChecksum(chunk),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := part.save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countChunks watches a transfer, returning a function that waits for it
+// to complete and reports how many chunks were sent.
+func countChunks(t *testing.T, bus *pmb.PMB, conn *pmb.Connection, transferID string) func() int {
+	t.Helper()
+
+	subConn, err := bus.Subscribe(transferTopic(transferID)).ConnectSubClient(conn, transferSub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := 0
+	done := make(chan struct{})
+	go func() {
+		for message := range subConn.In {
+			switch message.Type() {
+			case "FileChunk":
+				chunks++
+			case "FileReceived":
+				close(done)
+				return
+			}
+		}
+	}()
+
+	return func() int {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("transfer wasn't seen to complete")
+		}
+
+		return chunks
+	}
+}
+
+func TestReceiveFileFailureRemovesPartial(t *testing.T) {
+	h := pmbtest.NewHarness(t)
+	dir := t.TempDir()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 600)
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	offer := testOffer(t, path, 1024)
+	receivePartly(t, dir, offer, data, []int{0, 1})
+
+	// the sender gives up as soon as the receiver asks for chunks
+	sender := pmbtest.ConnectClient(t, h, "send-test")
+	subConn, err := h.Bus().Subscribe(transferTopic(offer.TransferID)).ConnectSubClient(sender, transferSub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for message := range subConn.In {
+			if message.Type() == "FileChunkRequest" {
+				subConn.Out <- pmb.EncodeTo(transferTopic(offer.TransferID), &pmb.FileRejected{TransferID: offer.TransferID, Reason: "cancelled"})
+				return
+			}
+		}
+	}()
+
+	receiver := pmbtest.ConnectClient(t, h, "receive-test")
+	if _, err := receiveFile(h.Bus(), receiver, offer, dir); err == nil {
+		t.Fatal("receiveFile() succeeded, want the transfer to fail")
+	}
+
+	partial := filepath.Join(dir, "."+offer.TransferID+partialSuffix)
+	for _, path := range []string{partial, partial + ".json"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestRemoveStalePartials(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		age      time.Duration
+		wantKept bool
+	}{
+		{name: ".stale" + partialSuffix, age: 2 * stalePartial},
+		{name: ".recent" + partialSuffix, age: time.Minute, wantKept: true},
+		{name: "stale.txt", age: 2 * stalePartial, wantKept: true},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		then := time.Now().Add(-test.age)
+		if err := os.Chtimes(path, then, then); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removeStalePartials(dir)
+
+	for _, test := range tests {
+		_, err := os.Stat(filepath.Join(dir, test.name))
+		if kept := err == nil; kept != test.wantKept {
+			t.Errorf("%s kept: %t, want %t", test.name, kept, test.wantKept)
+		}
+	}
+}
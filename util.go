@@ -12,29 +12,40 @@ import (
 	"github.com/pkg/browser"
 )
 
-func copyToClipboard(data string) error {
-
-	logrus.Infof("copy data: %s", strings.Replace(truncate(data, 50), "\n", "\\n", -1))
-
+// confirm asks the user a yes or no question on the desktop, returning
+// false if they say no, don't answer within the timeout, or can't be asked.
+func confirm(question string, timeout time.Duration) bool {
 	var cmd *exec.Cmd
 
-	// TODO support more than OSX and tmux
-	if _, err := exec.LookPath("pbcopy"); err == nil {
-		cmd = exec.Command("pbcopy")
-	} else if _, err := exec.LookPath("clip"); err == nil {
-		cmd = exec.Command("clip")
-	} else if _, err := exec.LookPath("xclip"); err == nil {
-		cmd = exec.Command("xclip", "-selection", "c")
-	} else if _, err := exec.LookPath("tmux"); err == nil {
-		cmd = exec.Command("tmux", "load-buffer", "-")
+	seconds := fmt.Sprintf("%d", int(timeout.Seconds()))
+	if _, err := exec.LookPath("osascript"); err == nil {
+		script := fmt.Sprintf(`display dialog %q with title "PMB" buttons {"Deny", "Allow"} default button "Deny" giving up after %s`, question, seconds)
+		output, err := exec.Command("osascript", "-e", script).Output()
+		return err == nil && strings.Contains(string(output), "button returned:Allow") && !strings.Contains(string(output), "gave up:true")
+	} else if _, err := exec.LookPath("zenity"); err == nil {
+		cmd = exec.Command("zenity", "--question", "--title", "PMB", "--text", question, "--timeout", seconds)
+	} else if _, err := exec.LookPath("kdialog"); err == nil {
+		cmd = exec.Command("kdialog", "--title", "PMB", "--yesno", question)
+	} else {
+		logrus.Warningf("Unable to ask for confirmation, no dialog program found.")
+		return false
 	}
-	cmd.Stdin = strings.NewReader(data)
 
-	err := cmd.Run()
-	if err != nil {
-		return err
+	// kdialog can't time out by itself
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		logrus.Warningf("Unable to ask for confirmation: %s", err)
+		return false
+	}
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		return err == nil
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return false
 	}
-	return nil
 }
 
 func openURL(data string, isHTML bool) error {
@@ -20,6 +20,12 @@ type WatchCommand struct {
 
 var watchCommand WatchCommand
 
+// how often to check on the process or file being watched
+var (
+	watchPidInterval  = 1 * time.Second
+	watchFileInterval = 5 * time.Second
+)
+
 func (x *WatchCommand) Execute(args []string) error {
 	bus := pmb.GetPMB(globalOptions.Broker)
 
@@ -43,10 +49,7 @@ func (x *WatchCommand) Execute(args []string) error {
 
 	id := pmb.GenerateRandomID("watch")
 
-	conn, err := bus.ConnectClient(id, !globalOptions.TrustKey)
-	if err != nil {
-		return err
-	}
+	conn := connectOrQueue(bus, id)
 
 	return runWatch(conn, id)
 }
@@ -78,7 +81,7 @@ func runWatch(conn *pmb.Connection, id string) error {
 				logrus.Infof("Process complete.")
 				break
 			} else {
-				time.Sleep(1 * time.Second)
+				time.Sleep(watchPidInterval)
 			}
 		}
 
@@ -96,7 +99,7 @@ func runWatch(conn *pmb.Connection, id string) error {
 				break
 			} else {
 				prevSize = statInfo.Size()
-				time.Sleep(5 * time.Second)
+				time.Sleep(watchFileInterval)
 			}
 		}
 
@@ -106,7 +109,7 @@ func runWatch(conn *pmb.Connection, id string) error {
 	}
 
 	note := pmb.Notification{Message: message, Level: watchCommand.Level}
-	return pmb.SendNotification(conn, note)
+	return notifyOrQueue(conn, note)
 }
 
 // TODO: use a go-based library for this, maybe gopsutil
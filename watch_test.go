@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/justone/pmb/api"
+	"github.com/justone/pmb/api/pmbtest"
+)
+
+func TestWatch(t *testing.T) {
+	watchPidInterval = 10 * time.Millisecond
+	watchFileInterval = 10 * time.Millisecond
+
+	tests := []struct {
+		name string
+		// sets up what to watch, returning the message to expect
+		setup func(t *testing.T) string
+	}{
+		{
+			name: "message",
+			setup: func(t *testing.T) string {
+				watchCommand = WatchCommand{Message: "hello", Level: 3}
+				return "hello"
+			},
+		},
+		{
+			name: "pid",
+			setup: func(t *testing.T) string {
+				cmd := exec.Command("sleep", "0.2")
+				if err := cmd.Start(); err != nil {
+					t.Fatal(err)
+				}
+				// reaped as soon as it exits, so that ps stops listing it
+				go cmd.Wait()
+
+				watchCommand = WatchCommand{Pid: cmd.Process.Pid, Level: 3}
+				return fmt.Sprintf("Command [pid %d] completed.", cmd.Process.Pid)
+			},
+		},
+		{
+			name: "file",
+			setup: func(t *testing.T) string {
+				path := filepath.Join(t.TempDir(), "output")
+				if err := os.WriteFile(path, []byte("done"), 0600); err != nil {
+					t.Fatal(err)
+				}
+
+				watchCommand = WatchCommand{File: path, Level: 3}
+				return fmt.Sprintf("File [%s] stabilized.", path)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := pmbtest.NewHarness(t)
+			conn := pmbtest.ConnectClient(t, h, "watch-test")
+
+			want := test.setup(t)
+			if err := runWatch(conn, "watch-test"); err != nil {
+				t.Fatalf("runWatch() = %v, want no error", err)
+			}
+
+			body, err := h.Introducer.WaitFor("Notification", time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if note := body.(*pmb.Notification); note.Message != want || note.Level != 3 {
+				t.Errorf("introducer received %q at level %g, want %q at level 3", note.Message, note.Level, want)
+			}
+		})
+	}
+}